@@ -98,8 +98,14 @@ func StartMockLivestatusSource(nr int, numHosts int, numServices int) (listen st
 				continue
 			}
 
+			if len(req.Stats) == 0 && len(req.Filter) > 0 && (req.Table == "hosts" || req.Table == "services") {
+				conn.Write(mockFilteredResponse(dataFolder, req))
+				conn.Close()
+				continue
+			}
+
 			if len(req.Filter) > 0 || len(req.Stats) > 0 {
-				conn.Write([]byte("200            3\n[]\n"))
+				conn.Write([]byte("200           3\n[]\n"))
 				conn.Close()
 				continue
 			}
@@ -116,6 +122,60 @@ func StartMockLivestatusSource(nr int, numHosts int, numServices int) (listen st
 	return
 }
 
+// mockFilteredResponse returns the requested columns of all rows from the data file which match the filter.
+func mockFilteredResponse(dataFolder string, req *Request) []byte {
+	dat, err := ioutil.ReadFile(fmt.Sprintf("%s/%s.json", dataFolder, req.Table))
+	if err != nil {
+		panic("could not read file: " + err.Error())
+	}
+	dat = regexp.MustCompile("^200.*").ReplaceAll(dat, []byte{})
+	var raw = [][]interface{}{}
+	if err = json.Unmarshal(dat, &raw); err != nil {
+		panic("failed to decode: " + err.Error())
+	}
+	table := Objects.Tables[req.Table]
+	result := [][]interface{}{}
+Rows:
+	for _, row := range raw {
+		for _, f := range req.Filter {
+			if !mockMatchFilter(f, row) {
+				continue Rows
+			}
+		}
+		resRow := []interface{}{}
+		for _, name := range req.Columns {
+			col := table.GetColumn(name)
+			if col.Index >= len(row) {
+				// optional columns are not part of the example data
+				resRow = append(resRow, col.GetEmptyValue())
+				continue
+			}
+			resRow = append(resRow, row[col.Index])
+		}
+		result = append(result, resRow)
+	}
+	body, _ := json.Marshal(result)
+	return []byte(fmt.Sprintf("200 %11d\n%s\n", len(body)+1, body))
+}
+
+// mockMatchFilter returns true if the data row matches the filter.
+func mockMatchFilter(f *Filter, row []interface{}) bool {
+	if len(f.Filter) > 0 {
+		for _, sub := range f.Filter {
+			matched := mockMatchFilter(sub, row)
+			if f.GroupOperator == Or && matched {
+				return true
+			}
+			if f.GroupOperator == And && !matched {
+				return false
+			}
+		}
+		return f.GroupOperator == And
+	}
+	value := row[f.Column.Column.Index]
+	return f.MatchFilter(&value)
+}
+
 func prepareTmpData(dataFolder string, nr int, numHosts int, numServices int) (tempFolder string) {
 	tempFolder, err := ioutil.TempDir("", fmt.Sprintf("mockdata%d_", nr))
 	if err != nil {
@@ -123,9 +183,15 @@ func prepareTmpData(dataFolder string, nr int, numHosts int, numServices int) (t
 	}
 	// read existing json files and extend hosts and services
 	for name, table := range Objects.Tables {
-		if table.Virtual || table.GroupBy || table.PassthroughOnly {
+		if table.Virtual || table.GroupBy {
 			continue
 		}
+		if table.PassthroughOnly {
+			// passthrough tables are used unchanged, if there is example data
+			if _, err := os.Stat(fmt.Sprintf("%s/%s.json", dataFolder, name)); err != nil {
+				continue
+			}
+		}
 		file, err := os.Create(fmt.Sprintf("%s/%s.json", tempFolder, name))
 		if err != nil {
 			panic("failed to create temp file: " + err.Error())
@@ -160,6 +226,11 @@ func prepareTmpDataHostService(dataFolder string, tempFolder string, table *Tabl
 	}
 	num := len(raw)
 	last := raw[num-1]
+	// the example data may lack newer columns, fill them with empty values
+	keys := table.GetInitialKeys(NoFlags)
+	for len(last) < len(keys) {
+		last = append(last, table.GetColumn(keys[len(last)]).GetEmptyValue())
+	}
 	newData := [][]interface{}{}
 	if name == "hosts" {
 		nameIndex := table.GetColumn("name").Index
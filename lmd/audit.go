@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog is the current command audit log, nil unless AuditLog is configured.
+// It is replaced on reload, auditLogLock must be held to access it.
+var auditLog *AuditLog
+var auditLogLock sync.RWMutex
+
+// AuditEntry is a single line of the command audit log.
+type AuditEntry struct {
+	Time        string            `json:"time"`
+	Client      string            `json:"client"`
+	Listener    string            `json:"listener"`
+	AuthUser    string            `json:"auth_user,omitempty"`
+	Node        string            `json:"node,omitempty"`
+	ForwardedBy string            `json:"forwarded_by,omitempty"`
+	Command     string            `json:"command"`
+	Peers       []string          `json:"peers"`
+	Results     map[string]string `json:"results,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// NewAuditEntry creates an audit entry for a command from the given request.
+func NewAuditEntry(req *Request, remote string, l *Listener) *AuditEntry {
+	entry := &AuditEntry{
+		Time:        time.Now().Format(time.RFC3339),
+		Client:      remote,
+		AuthUser:    req.AuthUser,
+		ForwardedBy: req.ForwardedBy,
+		Command:     redactManagementKey(req.Command),
+		Peers:       []string{},
+	}
+	if l != nil {
+		entry.Listener = l.ConnectionString
+	}
+	if nodeAccessor != nil && nodeAccessor.IsClustered() {
+		entry.Node = nodeAccessor.ID
+	}
+	return entry
+}
+
+// SetResults stores the result for each target peer. Peers without result
+// did not answer in time.
+func (e *AuditEntry) SetResults(results map[string]error) {
+	e.Results = make(map[string]string)
+	for _, id := range e.Peers {
+		err, ok := results[id]
+		switch {
+		case !ok:
+			e.Results[id] = "timeout"
+		case err != nil:
+			e.Results[id] = err.Error()
+		default:
+			e.Results[id] = "ok"
+		}
+	}
+}
+
+// AuditLog writes external commands as json lines into a separate file.
+// The file will be rotated after reaching MaxSize bytes and keeps MaxFiles
+// old files as <file>.1, <file>.2,...
+type AuditLog struct {
+	noCopy   noCopy
+	lock     sync.Mutex
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+	file     *os.File
+	size     int64
+}
+
+// NewAuditLog opens the audit log file for appending.
+func NewAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	a := &AuditLog{
+		Path:     path,
+		MaxSize:  maxSize,
+		MaxFiles: maxFiles,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// initAuditLog (re)opens the audit log from the configuration. Reopening on
+// every reload makes it possible to rotate the file externally and send a SIGHUP.
+func initAuditLog(conf *Config) {
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+	auditLog.Close()
+	auditLog = nil
+	if conf.AuditLog == "" {
+		return
+	}
+	a, err := NewAuditLog(conf.AuditLog, int64(conf.AuditLogMaxSize)*1024*1024, conf.AuditLogMaxFiles)
+	if err != nil {
+		log.Errorf("failed to open audit log: %s", err.Error())
+		return
+	}
+	auditLog = a
+}
+
+// auditCommand counts the command and writes it to the audit log, if enabled.
+func auditCommand(entry *AuditEntry) {
+	promFrontendCommands.WithLabelValues(commandLabel(entry.Command)).Inc()
+	auditLogLock.RLock()
+	defer auditLogLock.RUnlock()
+	if auditLog == nil {
+		return
+	}
+	if err := auditLog.Write(entry); err != nil {
+		log.Errorf("failed to write audit log: %s", err.Error())
+	}
+}
+
+// commandLabel returns the metric label of a command. Only known commands are used
+// as label, so clients cannot create an unbounded number of label values.
+func commandLabel(command string) string {
+	name, _ := ParseCommand(command)
+	if _, ok := CommandTargets[name]; !ok {
+		return "other"
+	}
+	return name
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.Path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// Write appends a single entry and rotates the file if required.
+func (a *AuditLog) Write(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		return fmt.Errorf("audit log %s is closed", a.Path)
+	}
+	if a.MaxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.MaxSize {
+		if err = a.rotate(); err != nil {
+			return err
+		}
+	}
+	written, err := a.file.Write(line)
+	a.size += int64(written)
+	return err
+}
+
+// rotate renames the current file and all older files and starts a new one.
+func (a *AuditLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+	if a.MaxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", a.Path, a.MaxFiles))
+		for i := a.MaxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.Path, i), fmt.Sprintf("%s.%d", a.Path, i+1))
+		}
+		if err := os.Rename(a.Path, a.Path+".1"); err != nil {
+			return err
+		}
+	} else {
+		if err := os.Remove(a.Path); err != nil {
+			return err
+		}
+	}
+	log.Infof("rotated audit log %s", a.Path)
+	return a.open()
+}
+
+// Close closes the log file. It is safe to call on a nil audit log.
+func (a *AuditLog) Close() {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func readAuditLog(file string, num int) (entries []AuditEntry, err error) {
+	for retries := 0; retries < 50; retries++ {
+		entries = nil
+		fh, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(fh)
+		for scanner.Scan() {
+			entry := AuditEntry{}
+			if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				fh.Close()
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		fh.Close()
+		if len(entries) >= num {
+			return entries, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return entries, fmt.Errorf("expected %d audit entries, got %d", num, len(entries))
+}
+
+func TestAuditLogCommands(t *testing.T) {
+	file, err := ioutil.TempFile("", "lmd-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	extraConfig := fmt.Sprintf("AuditLog = \"%s\"\nCommandDeny = [\"SHUTDOWN_*\"]\nManagementKey = \"secret\"\n", file.Name())
+	peer := StartTestPeerExtra(1, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+
+	if _, err = sendTestCommand("test.sock", "COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0\nAuthUser: demo@localhost"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readAuditLog(file.Name(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0", entries[0].Command); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("demo@localhost", entries[0].AuthUser); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("test.sock", entries[0].Listener); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq([]string{"mockid0"}, entries[0].Peers); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(map[string]string{"mockid0": "ok"}, entries[0].Results); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = sendTestCommand("test.sock", "COMMAND [0] SHUTDOWN_PROGRAM"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = readAuditLog(file.Name(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("forbidden: command SHUTDOWN_PROGRAM is not allowed", entries[1].Error); err != nil {
+		t.Error(err)
+	}
+
+	// management commands are audited without their key
+	sendTestCommand("test.sock", "COMMAND [0] LMD_PAUSE_BACKEND;wrong;mockid0")
+	sendTestCommand("test.sock", "COMMAND [0] LMD_PAUSE_BACKEND;secret;mockid0")
+	entries, err = readAuditLog(file.Name(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries[2:] {
+		if err = assertEq("COMMAND [0] LMD_PAUSE_BACKEND;***;mockid0", entry.Command); err != nil {
+			t.Error(err)
+		}
+	}
+	if err = assertEq(errManagementDenied.Error(), entries[2].Error); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("", entries[3].Error); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+	initAuditLog(&Config{})
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmd-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := dir + "/audit.log"
+	a, err := NewAuditLog(file, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		entry := &AuditEntry{Command: fmt.Sprintf("COMMAND [%d] SCHEDULE_FORCED_HOST_CHECK;host;%d", i, i), Peers: []string{"id1"}}
+		if err = a.Write(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	for _, name := range []string{file, file + ".1", file + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 300 {
+			t.Errorf("%s exceeds max size: %d", name, info.Size())
+		}
+	}
+	if _, err = os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("only 2 rotated files should be kept")
+	}
+
+	entries, err := readAuditLog(file, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("COMMAND [9] SCHEDULE_FORCED_HOST_CHECK;host;9", entries[len(entries)-1].Command); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditCommandLabel(t *testing.T) {
+	labels := map[string]string{
+		"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0": "SCHEDULE_FORCED_HOST_CHECK",
+		"COMMAND [0] RANDOM_NAME_1":                           "other",
+		"COMMAND [0] RANDOM_NAME_2;x":                         "other",
+		"":                                                    "other",
+	}
+	for command, label := range labels {
+		if err := assertEq(label, commandLabel(command)); err != nil {
+			t.Errorf("%s: %s", command, err.Error())
+		}
+	}
+}
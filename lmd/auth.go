@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errAuthRequired = errors.New("unauthorized: authentication required")
+var errAuthFailed = errors.New("unauthorized: invalid credentials")
+
+// ListenerUser is a user which authenticates on listeners with Auth enabled. Requests of
+// this user get the AuthUser, are limited to the Backends and cannot send commands if ReadOnly is set.
+type ListenerUser struct {
+	Name     string
+	Tokens   []string
+	AuthUser string
+	Backends []string
+	ReadOnly bool
+}
+
+// Authenticator verifies the credentials for a single listener.
+type Authenticator struct {
+	users    map[string]*ListenerUser
+	allowed  map[string]bool // allowed user names, nil means all users
+	htpasswd []*Htpasswd
+}
+
+// listenerUserKey is the context key of the authenticated user of http requests.
+type listenerUserKey struct{}
+
+// GetAuthenticator returns the authenticator for the given listener or nil if no authentication is required.
+// Authentication is enabled by Auth or by setting Users or Htpasswd in the listener settings. Users limits
+// the allowed users, Htpasswd adds users with passwords from a htpasswd file.
+func GetAuthenticator(conf *Config, listen string) *Authenticator {
+	settings := GetListenerConfig(conf, listen)
+	if !settings.Auth && len(settings.Users) == 0 && settings.Htpasswd == "" {
+		return nil
+	}
+	auth := &Authenticator{users: make(map[string]*ListenerUser)}
+	if len(settings.Users) > 0 {
+		auth.allowed = make(map[string]bool)
+		for _, name := range settings.Users {
+			auth.allowed[name] = true
+		}
+	}
+	if settings.Htpasswd != "" {
+		auth.htpasswd = append(auth.htpasswd, NewHtpasswd(settings.Htpasswd))
+	}
+	for i := range conf.Users {
+		user := &conf.Users[i]
+		if auth.allowed == nil || auth.allowed[user.Name] {
+			auth.users[user.Name] = user
+		}
+	}
+	return auth
+}
+
+// Token returns the user for the given token. Livestatus clients may also use <user>:<password>.
+// It returns nil if the credentials are invalid.
+func (a *Authenticator) Token(token string) *ListenerUser {
+	for _, user := range a.users {
+		for _, t := range user.Tokens {
+			if t != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return user
+			}
+		}
+	}
+	parts := strings.SplitN(token, ":", 2)
+	if len(parts) == 2 {
+		return a.Password(parts[0], parts[1])
+	}
+	return nil
+}
+
+// Password returns the user if the password matches the htpasswd files, nil otherwise.
+func (a *Authenticator) Password(name string, password string) *ListenerUser {
+	if a.allowed != nil && !a.allowed[name] {
+		return nil
+	}
+	for _, htpasswd := range a.htpasswd {
+		if !htpasswd.Check(name, password) {
+			continue
+		}
+		if user, ok := a.users[name]; ok {
+			return user
+		}
+		return &ListenerUser{Name: name}
+	}
+	return nil
+}
+
+// HTTPUser returns the user from the bearer token or basic auth of the http request.
+func (a *Authenticator) HTTPUser(request *http.Request) *ListenerUser {
+	if name, password, ok := request.BasicAuth(); ok {
+		return a.Password(name, password)
+	}
+	header := request.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return a.Token(strings.TrimPrefix(header, "Bearer "))
+	}
+	return nil
+}
+
+// Restrict applies the AuthUser, Backends and ReadOnly settings of the user to a request
+// with expanded backends. The AuthUser of the request is taken from the user, requests with
+// another AuthUser are rejected. Users without fixed AuthUser may send any AuthUser.
+// It returns an error if the request is not allowed.
+func (u *ListenerUser) Restrict(req *Request) error {
+	if u.AuthUser != "" && req.AuthUser != "" && req.AuthUser != u.AuthUser {
+		return fmt.Errorf("forbidden: user %s is not allowed to use AuthUser %s", u.Name, req.AuthUser)
+	}
+	if req.AuthUser == "" {
+		req.AuthUser = u.AuthUser
+	}
+	if err := req.ApplyAuthUser(); err != nil {
+		return err
+	}
+	if u.ReadOnly && req.Command != "" {
+		return fmt.Errorf("forbidden: user %s is not allowed to send commands", u.Name)
+	}
+	if len(u.Backends) == 0 {
+		return nil
+	}
+	ok, err := req.RestrictBackends(u.Backends)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("forbidden: user %s is not allowed to use these backends", u.Name)
+	}
+	return nil
+}
+
+// authorizeRequests authenticates livestatus requests by their Auth header and restricts them to the user.
+// The connection stays authenticated for further keepalive requests.
+// It returns the user, the response code and any error encountered.
+func authorizeRequests(auth *Authenticator, reqs []*Request, user *ListenerUser) (*ListenerUser, int, error) {
+	for _, req := range reqs {
+		if req.Auth != "" {
+			user = auth.Token(req.Auth)
+			if user == nil {
+				return nil, 401, errAuthFailed
+			}
+		}
+		if user == nil {
+			return nil, 401, errAuthRequired
+		}
+		if err := user.Restrict(req); err != nil {
+			return user, 403, err
+		}
+	}
+	return user, 0, nil
+}
+
+// httpAuthHandler authenticates http requests before passing them to the router.
+type httpAuthHandler struct {
+	auth       *Authenticator
+	controller *HTTPServerController
+	next       http.Handler
+}
+
+// ServeHTTP rejects unauthenticated requests and stores the user in the request context.
+// Backend management and node requests with a valid signature or client certificate have
+// their own authentication.
+func (h *httpAuthHandler) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	path := request.URL.Path
+	if path == "/backends" || strings.HasPrefix(path, "/backends/") || isNodeRequest(request) {
+		h.next.ServeHTTP(w, request)
+		return
+	}
+	user := h.auth.HTTPUser(request)
+	if user == nil {
+		err := errAuthRequired
+		if request.Header.Get("Authorization") != "" {
+			err = errAuthFailed
+		}
+		log.Warnf("rejected http request from %s to %s: %s", request.RemoteAddr, request.Host, err.Error())
+		w.Header().Set("WWW-Authenticate", `Basic realm="LMD"`)
+		h.controller.restError(w, http.StatusUnauthorized, err)
+		return
+	}
+	h.next.ServeHTTP(w, request.WithContext(context.WithValue(request.Context(), listenerUserKey{}, user)))
+}
+
+// isNodeRequest returns true for node api requests which are authenticated by the
+// cluster secret or a client certificate. The body is kept for the node api handler.
+func isNodeRequest(request *http.Request) bool {
+	if request.URL.Path != "/ping" && request.URL.Path != "/query" {
+		return false
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	return verifyNodeRequestAuth(request, body) == nil
+}
+
+// requestUser returns the authenticated user of a http request or nil.
+func requestUser(request *http.Request) *ListenerUser {
+	user, _ := request.Context().Value(listenerUserKey{}).(*ListenerUser)
+	return user
+}
+
+// Htpasswd verifies passwords from a htpasswd file with {SHA} or $apr1$ (md5) hashes.
+// The file is read again after it has been changed.
+type Htpasswd struct {
+	noCopy    noCopy
+	lock      sync.Mutex
+	Path      string
+	modTime   time.Time
+	passwords map[string]string
+}
+
+// NewHtpasswd creates a new htpasswd file reader.
+func NewHtpasswd(path string) *Htpasswd {
+	return &Htpasswd{Path: path, passwords: make(map[string]string)}
+}
+
+// Check returns true if the password matches the user.
+func (h *Htpasswd) Check(name string, password string) bool {
+	h.lock.Lock()
+	h.reload()
+	hash, ok := h.passwords[name]
+	h.lock.Unlock()
+	if !ok {
+		return false
+	}
+	var expected string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(strings.TrimPrefix(hash, "$apr1$"), "$", 2)[0]
+		expected = apr1Hash(password, salt)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+}
+
+// reload reads the file if it has been changed. The lock must be held by the caller.
+func (h *Htpasswd) reload() {
+	info, err := os.Stat(h.Path)
+	if err != nil {
+		log.Warnf("cannot read htpasswd file: %s", err.Error())
+		return
+	}
+	if info.ModTime().Equal(h.modTime) {
+		return
+	}
+	file, err := os.Open(h.Path)
+	if err != nil {
+		log.Warnf("cannot read htpasswd file: %s", err.Error())
+		return
+	}
+	defer file.Close()
+	passwords := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if !strings.HasPrefix(parts[1], "{SHA}") && !strings.HasPrefix(parts[1], "$apr1$") {
+			log.Warnf("unsupported password hash for user %s in %s, only {SHA} and $apr1$ are supported", parts[0], h.Path)
+			continue
+		}
+		passwords[parts[0]] = parts[1]
+	}
+	h.passwords = passwords
+	h.modTime = info.ModTime()
+	log.Debugf("read %d users from %s", len(passwords), h.Path)
+}
+
+// apr1Hash returns the apache md5 crypt hash of the password.
+func apr1Hash(password string, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	final := alt.Sum(nil)
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(final)
+		} else {
+			ctx.Write(final[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final = ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+	encoded := []byte{}
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			encoded = append(encoded, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(final[0], final[6], final[12], 4)
+	encode(final[1], final[7], final[13], 4)
+	encode(final[2], final[8], final[14], 4)
+	encode(final[3], final[9], final[15], 4)
+	encode(final[4], final[10], final[5], 4)
+	encode(0, 0, final[11], 2)
+	return magic + salt + "$" + string(encoded)
+}
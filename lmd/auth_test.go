@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHtpasswd(t *testing.T) {
+	file, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# test users\nsha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\napr:$apr1$7gZbvBq3$BHKYrxFIasZ6ky/QRdIKT.\nplain:secret\n")
+	file.Close()
+
+	htpasswd := NewHtpasswd(file.Name())
+	tests := []struct {
+		name     string
+		password string
+		ok       bool
+	}{
+		{"sha", "secret", true},
+		{"sha", "wrong", false},
+		{"apr", "secret", true},
+		{"apr", "secre", false},
+		{"plain", "secret", false},
+		{"unknown", "secret", false},
+	}
+	for _, test := range tests {
+		if err := assertEq(test.ok, htpasswd.Check(test.name, test.password)); err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+		}
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	conf := &Config{
+		Users: []ListenerUser{
+			{Name: "admin", Tokens: []string{"admintoken"}},
+			{Name: "viewer", Tokens: []string{"viewertoken"}, AuthUser: "demo", ReadOnly: true},
+		},
+		Listeners: []ListenerConfig{
+			{Listen: "127.0.0.1:6557", Users: []string{"viewer"}},
+			{Listen: "127.0.0.1:6558", Auth: true},
+			{Listen: "127.0.0.1:6559", MaxRows: 10},
+		},
+	}
+	if GetAuthenticator(conf, "127.0.0.1:6559") != nil {
+		t.Errorf("expected no authentication for unconfigured listener")
+	}
+
+	auth := GetAuthenticator(conf, "127.0.0.1:6557")
+	if auth.Token("admintoken") != nil {
+		t.Errorf("admin must not be allowed on this listener")
+	}
+	if err := assertEq("viewer", auth.Token("viewertoken").Name); err != nil {
+		t.Error(err)
+	}
+	if auth.Token("") != nil || auth.Token("viewer:viewertoken") != nil {
+		t.Errorf("expected invalid credentials")
+	}
+	if err := assertEq("admin", GetAuthenticator(conf, "127.0.0.1:6558").Token("admintoken").Name); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuthLivestatus(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	auth := &Authenticator{users: map[string]*ListenerUser{
+		"viewer": {Name: "viewer", Tokens: []string{"viewertoken"}, AuthUser: "demo", ReadOnly: true},
+		"other":  {Name: "other", Tokens: []string{"othertoken"}, Backends: []string{"other"}},
+		"thruk":  {Name: "thruk", Tokens: []string{"thruktoken"}},
+	}}
+	parse := func(query string) []*Request {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		return []*Request{req}
+	}
+
+	_, code, err := authorizeRequests(auth, parse("GET hosts\n\n"), nil)
+	if err := assertEq(401, code); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(errAuthRequired, err); err != nil {
+		t.Error(err)
+	}
+
+	_, code, _ = authorizeRequests(auth, parse("GET hosts\nAuth: wrong\n\n"), nil)
+	if err := assertEq(401, code); err != nil {
+		t.Error(err)
+	}
+
+	reqs := parse("GET hosts\nAuth: viewertoken\n\n")
+	user, code, err := authorizeRequests(auth, reqs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq("demo", reqs[0].AuthUser); err != nil {
+		t.Error(err)
+	}
+
+	// the AuthUser is taken from the user
+	_, code, _ = authorizeRequests(auth, parse("GET hosts\nAuth: viewertoken\nAuthUser: other\n\n"), nil)
+	if err := assertEq(403, code); err != nil {
+		t.Error(err)
+	}
+
+	// users without fixed AuthUser may send any AuthUser
+	reqs = parse("GET hosts\nAuth: thruktoken\nAuthUser: other\n\n")
+	numFilter := len(reqs[0].Filter)
+	_, code, err = authorizeRequests(auth, reqs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq("other", reqs[0].AuthUser); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(numFilter, len(reqs[0].Filter)); err != nil {
+		t.Error(err)
+	}
+
+	// connection stays authenticated, but read only users cannot send commands
+	_, code, _ = authorizeRequests(auth, parse("COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0\n\n"), user)
+	if err := assertEq(403, code); err != nil {
+		t.Error(err)
+	}
+
+	_, code, err = authorizeRequests(auth, parse("GET hosts\nAuth: othertoken\n\n"), nil)
+	if err := assertEq(403, code); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("forbidden: user other is not allowed to use these backends", err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestAuthHTTP(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	file, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("web:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")
+	file.Close()
+
+	listener := &Listener{
+		ConnectionString: "http://127.0.0.1:8902",
+		LocalConfig: &Config{
+			Users: []ListenerUser{
+				{Name: "admin", Tokens: []string{"admintoken"}},
+				{Name: "viewer", Tokens: []string{"viewertoken"}, ReadOnly: true},
+				{Name: "other", Tokens: []string{"othertoken"}, Backends: []string{"other"}},
+				{Name: "contact", Tokens: []string{"contacttoken"}, AuthUser: "demo"},
+			},
+			Listeners: []ListenerConfig{
+				{Listen: "http://127.0.0.1:8902", Htpasswd: file.Name()},
+			},
+		},
+	}
+	handler, _ := initializeHTTPRouter(listener)
+
+	tests := []struct {
+		method string
+		path   string
+		auth   string
+		body   string
+		code   int
+	}{
+		{"GET", "/v1/hosts?columns=name", "", "", http.StatusUnauthorized},
+		{"GET", "/v1/hosts?columns=name", "Bearer wrong", "", http.StatusUnauthorized},
+		{"GET", "/v1/hosts?columns=name", "Bearer admintoken", "", http.StatusOK},
+		{"GET", "/v1/hosts?columns=name", "Basic d2ViOnNlY3JldA==", "", http.StatusOK},
+		{"GET", "/v1/hosts?columns=name", "Basic d2ViOndyb25n", "", http.StatusUnauthorized},
+		{"GET", "/v1/hosts?columns=name", "Bearer othertoken", "", http.StatusForbidden},
+		{"POST", "/v1/commands", "Bearer viewertoken", `{"commands": ["SCHEDULE_FORCED_HOST_CHECK;testhost_1;0"]}`, http.StatusForbidden},
+		{"POST", "/v1/commands", "Bearer admintoken", `{"commands": ["SCHEDULE_FORCED_HOST_CHECK;testhost_1;0"]}`, http.StatusOK},
+		{"POST", "/v1/commands", "Bearer admintoken", `{"commands": ["SCHEDULE_FORCED_HOST_CHECK;testhost_1;0"], "auth_user": "demo"}`, http.StatusOK},
+		{"POST", "/v1/commands", "Bearer contacttoken", `{"commands": ["SCHEDULE_FORCED_HOST_CHECK;testhost_1;0"], "auth_user": "other"}`, http.StatusForbidden},
+		{"POST", "/table/hosts", "Bearer othertoken", `{"columns": ["name"]}`, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if err := assertEq(test.code, rec.Code); err != nil {
+			t.Errorf("%s %s (%s): %s", test.method, test.path, test.auth, err.Error())
+		}
+		if test.code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s: missing WWW-Authenticate header", test.method, test.path)
+		}
+	}
+
+	// node requests need a valid signature instead of user credentials
+	secret := nodeAccessor.secret
+	nodeAccessor.secret = "secret"
+	defer func() { nodeAccessor.secret = secret }()
+	body := `{"_name":"ping","protocol":3}`
+	for _, signed := range []bool{false, true} {
+		req := httptest.NewRequest("POST", "/query", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		code := http.StatusUnauthorized
+		if signed {
+			setNodeRequestSignature(req, "secret", []byte(body))
+			code = http.StatusOK
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if err := assertEq(code, rec.Code); err != nil {
+			t.Errorf("signed node request %v: %s", signed, err.Error())
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
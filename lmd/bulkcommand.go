@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BulkCommandTable returns the table used to expand the placeholders of a bulk
+// command or an empty string if the command contains no placeholders.
+func BulkCommandTable(command string) string {
+	if strings.Contains(command, "$SERVICEDESC$") {
+		return "services"
+	}
+	if strings.Contains(command, "$HOSTNAME$") {
+		return "hosts"
+	}
+	return ""
+}
+
+// ExpandBulkCommand replaces the $HOSTNAME$ and $SERVICEDESC$ placeholders for
+// each cached object matching the request filter. Since every object comes from
+// a backend cache, each expanded command is only sent to the backend owning this object.
+// In cluster mode, the objects of backends owned by other nodes are fetched from these nodes.
+// It returns the expanded commands for each of the given backends.
+func ExpandBulkCommand(req *Request, backends []string) (commandsByPeer map[string][]string, err error) {
+	commandsByPeer = make(map[string][]string)
+	command := strings.TrimSpace(req.Command)
+	remote := []string{}
+	for _, id := range backends {
+		if nodeAccessor != nil && nodeAccessor.IsClustered() && nodeAccessor.BackendNode(id) != nil {
+			remote = append(remote, id)
+			continue
+		}
+		PeerMapLock.RLock()
+		p, ok := PeerMap[id]
+		PeerMapLock.RUnlock()
+		if !ok {
+			continue
+		}
+		commands := p.ExpandCommand(command, req.Table, req.Filter)
+		if len(commands) > 0 {
+			commandsByPeer[id] = commands
+		}
+	}
+	if len(remote) > 0 {
+		err = expandRemoteBulkCommand(command, req.Table, req.Filter, remote, commandsByPeer)
+	}
+	return
+}
+
+// expandRemoteBulkCommand expands the command with the matching objects of backends owned by other cluster nodes.
+// It returns an error unless all backends answered.
+func expandRemoteBulkCommand(command string, table string, filter []*Filter, backends []string, commandsByPeer map[string][]string) error {
+	columns := []string{"peer_key", "name"}
+	if table == "services" {
+		columns = []string{"peer_key", "host_name", "description"}
+	}
+	req := &Request{Table: table, Columns: columns, Filter: filter, Backends: backends}
+	if err := req.ExpandRequestedBackends(); err != nil {
+		return err
+	}
+	res, err := req.getDistributedResponse()
+	if err != nil {
+		return err
+	}
+	for _, id := range backends {
+		if msg, ok := res.Failed[id]; ok {
+			return fmt.Errorf("cannot expand bulk command for backend %s: %s", id, msg)
+		}
+	}
+	for _, row := range res.Result {
+		id := fmt.Sprintf("%v", row[0])
+		expanded := strings.Replace(command, "$HOSTNAME$", fmt.Sprintf("%v", row[1]), -1)
+		if len(row) > 2 {
+			expanded = strings.Replace(expanded, "$SERVICEDESC$", fmt.Sprintf("%v", row[2]), -1)
+		}
+		commandsByPeer[id] = append(commandsByPeer[id], expanded)
+	}
+	return nil
+}
+
+// ExpandCommand returns the command with placeholders replaced for each matching host or service.
+func (p *Peer) ExpandCommand(command string, table string, filter []*Filter) (commands []string) {
+	p.DataLock.RLock()
+	defer p.DataLock.RUnlock()
+	data, ok := p.Tables[table]
+	if !ok || data.Table == nil {
+		return
+	}
+	hostIndex := data.Table.ColumnsIndex["name"]
+	serviceIndex := -1
+	if table == "services" {
+		hostIndex = data.Table.ColumnsIndex["host_name"]
+		serviceIndex = data.Table.ColumnsIndex["description"]
+	}
+Rows:
+	for j := range data.Data {
+		row := &(data.Data[j])
+		for _, f := range filter {
+			if !p.MatchRowFilter(data.Table, &data.Refs, f, row, j) {
+				continue Rows
+			}
+		}
+		expanded := strings.Replace(command, "$HOSTNAME$", (*row)[hostIndex].(string), -1)
+		if serviceIndex >= 0 {
+			expanded = strings.Replace(expanded, "$SERVICEDESC$", (*row)[serviceIndex].(string), -1)
+		}
+		commands = append(commands, expanded)
+	}
+	return
+}
+
+// NewCommandResponse creates a response for command results with the given columns.
+func NewCommandResponse(req *Request, columns []string) *Response {
+	return &Response{
+		Code: 200,
+		Request: &Request{
+			Columns:           columns,
+			SendColumnsHeader: req.SendColumnsHeader,
+			ResponseFixed16:   req.ResponseFixed16,
+			OutputFormat:      req.OutputFormat,
+		},
+		Result: make([][]interface{}, 0),
+		Failed: make(map[string]string),
+	}
+}
+
+// BulkCommandDryRun returns the expanded commands without sending them.
+func BulkCommandDryRun(req *Request, commandsByPeer map[string][]string) *Response {
+	res := NewCommandResponse(req, []string{"peer_key", "command"})
+	for _, id := range sortedKeys(commandsByPeer) {
+		for _, command := range commandsByPeer[id] {
+			res.Result = append(res.Result, []interface{}{id, command})
+		}
+	}
+	res.ResultTotal = len(res.Result)
+	return res
+}
+
+func sortedKeys(commandsByPeer map[string][]string) (keys []string) {
+	for id := range commandsByPeer {
+		keys = append(keys, id)
+	}
+	sort.Strings(keys)
+	return
+}
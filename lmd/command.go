@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var reCommandName = regexp.MustCompile(`^COMMAND \[\d+\] ([A-Za-z_0-9]+)(;.*)?$`)
+
+// CommandTarget defines which object the first arguments of an external command refer to.
+type CommandTarget struct {
+	Table string // table containing the object
+	Args  int    // number of arguments used as index key
+}
+
+var (
+	targetHost         = CommandTarget{Table: "hosts", Args: 1}
+	targetService      = CommandTarget{Table: "services", Args: 2}
+	targetHostgroup    = CommandTarget{Table: "hostgroups", Args: 1}
+	targetServicegroup = CommandTarget{Table: "servicegroups", Args: 1}
+	targetComment      = CommandTarget{Table: "comments", Args: 1}
+	targetDowntime     = CommandTarget{Table: "downtimes", Args: 1}
+)
+
+// CommandTargets maps known external commands to the object they refer to.
+// Commands not listed here will be sent to all selected backends.
+var CommandTargets = map[string]CommandTarget{
+	"ACKNOWLEDGE_HOST_PROBLEM":                       targetHost,
+	"ACKNOWLEDGE_HOST_PROBLEM_EXPIRE":                targetHost,
+	"ADD_HOST_COMMENT":                               targetHost,
+	"CHANGE_CUSTOM_HOST_VAR":                         targetHost,
+	"CHANGE_HOST_CHECK_COMMAND":                      targetHost,
+	"CHANGE_HOST_CHECK_TIMEPERIOD":                   targetHost,
+	"CHANGE_HOST_EVENT_HANDLER":                      targetHost,
+	"CHANGE_HOST_MODATTR":                            targetHost,
+	"CHANGE_HOST_NOTIFICATION_TIMEPERIOD":            targetHost,
+	"CHANGE_MAX_HOST_CHECK_ATTEMPTS":                 targetHost,
+	"CHANGE_NORMAL_HOST_CHECK_INTERVAL":              targetHost,
+	"CHANGE_RETRY_HOST_CHECK_INTERVAL":               targetHost,
+	"DEL_ALL_HOST_COMMENTS":                          targetHost,
+	"DEL_DOWNTIME_BY_HOST_NAME":                      targetHost,
+	"DELAY_HOST_NOTIFICATION":                        targetHost,
+	"DISABLE_ALL_NOTIFICATIONS_BEYOND_HOST":          targetHost,
+	"DISABLE_HOST_AND_CHILD_NOTIFICATIONS":           targetHost,
+	"DISABLE_HOST_CHECK":                             targetHost,
+	"DISABLE_HOST_EVENT_HANDLER":                     targetHost,
+	"DISABLE_HOST_FLAP_DETECTION":                    targetHost,
+	"DISABLE_HOST_NOTIFICATIONS":                     targetHost,
+	"DISABLE_HOST_SVC_CHECKS":                        targetHost,
+	"DISABLE_HOST_SVC_NOTIFICATIONS":                 targetHost,
+	"DISABLE_PASSIVE_HOST_CHECKS":                    targetHost,
+	"ENABLE_ALL_NOTIFICATIONS_BEYOND_HOST":           targetHost,
+	"ENABLE_HOST_AND_CHILD_NOTIFICATIONS":            targetHost,
+	"ENABLE_HOST_CHECK":                              targetHost,
+	"ENABLE_HOST_EVENT_HANDLER":                      targetHost,
+	"ENABLE_HOST_FLAP_DETECTION":                     targetHost,
+	"ENABLE_HOST_NOTIFICATIONS":                      targetHost,
+	"ENABLE_HOST_SVC_CHECKS":                         targetHost,
+	"ENABLE_HOST_SVC_NOTIFICATIONS":                  targetHost,
+	"ENABLE_PASSIVE_HOST_CHECKS":                     targetHost,
+	"PROCESS_HOST_CHECK_RESULT":                      targetHost,
+	"REMOVE_HOST_ACKNOWLEDGEMENT":                    targetHost,
+	"SCHEDULE_AND_PROPAGATE_HOST_DOWNTIME":           targetHost,
+	"SCHEDULE_AND_PROPAGATE_TRIGGERED_HOST_DOWNTIME": targetHost,
+	"SCHEDULE_FORCED_HOST_CHECK":                     targetHost,
+	"SCHEDULE_FORCED_HOST_SVC_CHECKS":                targetHost,
+	"SCHEDULE_HOST_CHECK":                            targetHost,
+	"SCHEDULE_HOST_DOWNTIME":                         targetHost,
+	"SCHEDULE_HOST_SVC_CHECKS":                       targetHost,
+	"SCHEDULE_HOST_SVC_DOWNTIME":                     targetHost,
+	"SEND_CUSTOM_HOST_NOTIFICATION":                  targetHost,
+	"SET_HOST_NOTIFICATION_NUMBER":                   targetHost,
+	"START_OBSESSING_OVER_HOST":                      targetHost,
+	"STOP_OBSESSING_OVER_HOST":                       targetHost,
+
+	"ACKNOWLEDGE_SVC_PROBLEM":            targetService,
+	"ACKNOWLEDGE_SVC_PROBLEM_EXPIRE":     targetService,
+	"ADD_SVC_COMMENT":                    targetService,
+	"CHANGE_CUSTOM_SVC_VAR":              targetService,
+	"CHANGE_MAX_SVC_CHECK_ATTEMPTS":      targetService,
+	"CHANGE_NORMAL_SVC_CHECK_INTERVAL":   targetService,
+	"CHANGE_RETRY_SVC_CHECK_INTERVAL":    targetService,
+	"CHANGE_SVC_CHECK_COMMAND":           targetService,
+	"CHANGE_SVC_CHECK_TIMEPERIOD":        targetService,
+	"CHANGE_SVC_EVENT_HANDLER":           targetService,
+	"CHANGE_SVC_MODATTR":                 targetService,
+	"CHANGE_SVC_NOTIFICATION_TIMEPERIOD": targetService,
+	"DEL_ALL_SVC_COMMENTS":               targetService,
+	"DELAY_SVC_NOTIFICATION":             targetService,
+	"DISABLE_PASSIVE_SVC_CHECKS":         targetService,
+	"DISABLE_SVC_CHECK":                  targetService,
+	"DISABLE_SVC_EVENT_HANDLER":          targetService,
+	"DISABLE_SVC_FLAP_DETECTION":         targetService,
+	"DISABLE_SVC_NOTIFICATIONS":          targetService,
+	"ENABLE_PASSIVE_SVC_CHECKS":          targetService,
+	"ENABLE_SVC_CHECK":                   targetService,
+	"ENABLE_SVC_EVENT_HANDLER":           targetService,
+	"ENABLE_SVC_FLAP_DETECTION":          targetService,
+	"ENABLE_SVC_NOTIFICATIONS":           targetService,
+	"PROCESS_SERVICE_CHECK_RESULT":       targetService,
+	"REMOVE_SVC_ACKNOWLEDGEMENT":         targetService,
+	"SCHEDULE_FORCED_SVC_CHECK":          targetService,
+	"SCHEDULE_SVC_CHECK":                 targetService,
+	"SCHEDULE_SVC_DOWNTIME":              targetService,
+	"SEND_CUSTOM_SVC_NOTIFICATION":       targetService,
+	"SET_SVC_NOTIFICATION_NUMBER":        targetService,
+	"START_OBSESSING_OVER_SVC":           targetService,
+	"STOP_OBSESSING_OVER_SVC":            targetService,
+
+	"DISABLE_HOSTGROUP_HOST_CHECKS":         targetHostgroup,
+	"DISABLE_HOSTGROUP_HOST_NOTIFICATIONS":  targetHostgroup,
+	"DISABLE_HOSTGROUP_PASSIVE_HOST_CHECKS": targetHostgroup,
+	"DISABLE_HOSTGROUP_PASSIVE_SVC_CHECKS":  targetHostgroup,
+	"DISABLE_HOSTGROUP_SVC_CHECKS":          targetHostgroup,
+	"DISABLE_HOSTGROUP_SVC_NOTIFICATIONS":   targetHostgroup,
+	"ENABLE_HOSTGROUP_HOST_CHECKS":          targetHostgroup,
+	"ENABLE_HOSTGROUP_HOST_NOTIFICATIONS":   targetHostgroup,
+	"ENABLE_HOSTGROUP_PASSIVE_HOST_CHECKS":  targetHostgroup,
+	"ENABLE_HOSTGROUP_PASSIVE_SVC_CHECKS":   targetHostgroup,
+	"ENABLE_HOSTGROUP_SVC_CHECKS":           targetHostgroup,
+	"ENABLE_HOSTGROUP_SVC_NOTIFICATIONS":    targetHostgroup,
+	"SCHEDULE_HOSTGROUP_HOST_DOWNTIME":      targetHostgroup,
+	"SCHEDULE_HOSTGROUP_SVC_DOWNTIME":       targetHostgroup,
+
+	"DISABLE_SERVICEGROUP_HOST_CHECKS":         targetServicegroup,
+	"DISABLE_SERVICEGROUP_HOST_NOTIFICATIONS":  targetServicegroup,
+	"DISABLE_SERVICEGROUP_PASSIVE_HOST_CHECKS": targetServicegroup,
+	"DISABLE_SERVICEGROUP_PASSIVE_SVC_CHECKS":  targetServicegroup,
+	"DISABLE_SERVICEGROUP_SVC_CHECKS":          targetServicegroup,
+	"DISABLE_SERVICEGROUP_SVC_NOTIFICATIONS":   targetServicegroup,
+	"ENABLE_SERVICEGROUP_HOST_CHECKS":          targetServicegroup,
+	"ENABLE_SERVICEGROUP_HOST_NOTIFICATIONS":   targetServicegroup,
+	"ENABLE_SERVICEGROUP_PASSIVE_HOST_CHECKS":  targetServicegroup,
+	"ENABLE_SERVICEGROUP_PASSIVE_SVC_CHECKS":   targetServicegroup,
+	"ENABLE_SERVICEGROUP_SVC_CHECKS":           targetServicegroup,
+	"ENABLE_SERVICEGROUP_SVC_NOTIFICATIONS":    targetServicegroup,
+	"SCHEDULE_SERVICEGROUP_HOST_DOWNTIME":      targetServicegroup,
+	"SCHEDULE_SERVICEGROUP_SVC_DOWNTIME":       targetServicegroup,
+
+	"DEL_HOST_COMMENT":  targetComment,
+	"DEL_SVC_COMMENT":   targetComment,
+	"DEL_HOST_DOWNTIME": targetDowntime,
+	"DEL_SVC_DOWNTIME":  targetDowntime,
+}
+
+// ParseCommand splits a command line into the command name and its arguments.
+// It returns an empty name if the line is not a valid command.
+func ParseCommand(command string) (name string, args []string) {
+	matched := reCommandName.FindStringSubmatch(strings.TrimSpace(command))
+	if len(matched) != 3 {
+		return
+	}
+	name = strings.ToUpper(matched[1])
+	if matched[2] != "" {
+		args = strings.Split(matched[2][1:], ";")
+	}
+	return
+}
+
+// RouteCommand returns the backends which should receive the given command.
+// Known commands are sent only to the backends which have the referenced object in their cache.
+// Unknown commands and objects not found in any cache are sent to all given backends.
+func RouteCommand(command string, backends map[string]string) (targets []string) {
+	name, args := ParseCommand(command)
+	target, ok := CommandTargets[name]
+	if !ok || len(args) < target.Args {
+		targets = sortedBackends(backends)
+		log.Debugf("command %s cannot be routed, sending to all %d backends", name, len(targets))
+		return
+	}
+	key := strings.Join(args[0:target.Args], ";")
+
+	PeerMapLock.RLock()
+	for id := range backends {
+		p, ok := PeerMap[id]
+		if !ok {
+			continue
+		}
+		if p.HasObject(target.Table, key) {
+			targets = append(targets, id)
+		}
+	}
+	PeerMapLock.RUnlock()
+
+	if len(targets) == 0 {
+		targets = sortedBackends(backends)
+		log.Infof("%s %s not found in any backend, sending %s to all %d backends", target.Table, key, name, len(targets))
+		return
+	}
+	sort.Strings(targets)
+	log.Infof("routing %s for %s %s to backends: %s", name, target.Table, key, strings.Join(targets, ", "))
+	return
+}
+
+// HasObject returns true if the given object exists in the cached table index.
+func (p *Peer) HasObject(table string, key string) bool {
+	p.DataLock.RLock()
+	defer p.DataLock.RUnlock()
+	data, ok := p.Tables[table]
+	if !ok || data.Index == nil {
+		return false
+	}
+	_, ok = data.Index[key]
+	return ok
+}
+
+func sortedBackends(backends map[string]string) (list []string) {
+	for id := range backends {
+		list = append(list, id)
+	}
+	sort.Strings(list)
+	return
+}
+
+// CommandPolicy defines which commands will be accepted from a listener.
+type CommandPolicy struct {
+	ReadOnly        bool
+	CommandAllow    []string
+	CommandDeny     []string
+	RequireAuthUser bool
+}
+
+// GetCommandPolicy returns the effective command policy for the given listener.
+// Listener settings inherit the global allow list unless they have their own,
+// deny lists from both are combined and the AuthUser requirement can only be enabled.
+func GetCommandPolicy(conf *Config, listen string) *CommandPolicy {
+	settings := GetListenerConfig(conf, listen)
+	policy := &CommandPolicy{
+		ReadOnly:        settings.ReadOnly,
+		CommandAllow:    conf.CommandAllow,
+		CommandDeny:     append(append([]string{}, conf.CommandDeny...), settings.CommandDeny...),
+		RequireAuthUser: conf.RequireAuthUser || settings.RequireAuthUser,
+	}
+	if len(settings.CommandAllow) > 0 {
+		policy.CommandAllow = settings.CommandAllow
+	}
+	return policy
+}
+
+// Check verifies the command name against the read-only flag, the allow and deny lists and the AuthUser requirement.
+// It returns an error if the command is not allowed.
+func (policy *CommandPolicy) Check(command string, authUser string) error {
+	name, _ := ParseCommand(command)
+	if name == "" {
+		return fmt.Errorf("bad request: invalid command %s", command)
+	}
+	if policy.ReadOnly {
+		return fmt.Errorf("forbidden: commands are not allowed on this listener")
+	}
+	if len(policy.CommandAllow) > 0 && !matchCommandPatterns(policy.CommandAllow, name) {
+		return fmt.Errorf("forbidden: command %s is not allowed", name)
+	}
+	if matchCommandPatterns(policy.CommandDeny, name) {
+		return fmt.Errorf("forbidden: command %s is not allowed", name)
+	}
+	if policy.RequireAuthUser && authUser == "" {
+		return errors.New("forbidden: commands require an AuthUser header")
+	}
+	return nil
+}
+
+// AuthorizedBackends removes all backends where the AuthUser is not a contact with can_submit_commands.
+// It returns an error if no backend is left.
+func (policy *CommandPolicy) AuthorizedBackends(authUser string, backends []string) (authorized []string, err error) {
+	if !policy.RequireAuthUser {
+		return backends, nil
+	}
+	PeerMapLock.RLock()
+	for _, id := range backends {
+		p, ok := PeerMap[id]
+		if !ok {
+			continue
+		}
+		if p.CanSubmitCommands(authUser) {
+			authorized = append(authorized, id)
+		} else {
+			log.Infof("[%s] contact %s is not allowed to submit commands", p.Name, authUser)
+		}
+	}
+	PeerMapLock.RUnlock()
+	if len(authorized) == 0 {
+		err = fmt.Errorf("forbidden: contact %s is not allowed to submit commands", authUser)
+	}
+	return
+}
+
+// CanSubmitCommands returns true if the contact exists in the cache and has can_submit_commands set.
+func (p *Peer) CanSubmitCommands(contact string) bool {
+	p.DataLock.RLock()
+	defer p.DataLock.RUnlock()
+	data, ok := p.Tables["contacts"]
+	if !ok || data.Index == nil {
+		return false
+	}
+	row, ok := data.Index[contact]
+	if !ok {
+		return false
+	}
+	return numberToFloat(&row[data.Table.GetColumn("can_submit_commands").Index]) > 0
+}
+
+// matchCommandPatterns returns true if the command name matches any of the wildcard patterns.
+func matchCommandPatterns(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		regex, err := wildcardToRegexp(strings.ToUpper(pattern))
+		if err != nil {
+			log.Warnf("invalid command pattern %s: %s", pattern, err.Error())
+			continue
+		}
+		if regex.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
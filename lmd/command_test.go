@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCommandRouting(t *testing.T) {
+	peer := StartTestPeer(2, 10, 20)
+	PauseTestPeers(peer)
+
+	// make testhost_1 only known to the first backend
+	PeerMapLock.RLock()
+	p := PeerMap["mockid1"]
+	PeerMapLock.RUnlock()
+	p.DataLock.Lock()
+	delete(p.Tables["hosts"].Index, "testhost_1")
+	p.DataLock.Unlock()
+
+	backends := map[string]string{"mockid0": "mockid0", "mockid1": "mockid1"}
+	routes := map[string][]string{
+		"COMMAND [0] ACKNOWLEDGE_HOST_PROBLEM;testhost_1;1;1;1;admin;test":         {"mockid0"},
+		"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_2;0":                      {"mockid0", "mockid1"},
+		"COMMAND [0] SCHEDULE_FORCED_SVC_CHECK;testhost_2;testsvc_1;0":             {"mockid0", "mockid1"},
+		"COMMAND [0] ACKNOWLEDGE_SVC_PROBLEM;unknown;http;1;1;1;admin;test":        {"mockid0", "mockid1"},
+		"COMMAND [0] SAVE_STATE_INFORMATION":                                       {"mockid0", "mockid1"},
+		"COMMAND [0] ACKNOWLEDGE_HOST_PROBLEM":                                     {"mockid0", "mockid1"},
+		"COMMAND [0] ENABLE_HOSTGROUP_SVC_CHECKS;unknown":                          {"mockid0", "mockid1"},
+		"COMMAND [0] ACKNOWLEDGE_HOST_PROBLEM;testhost_1;1;1;1;admin;with;semicol": {"mockid0"},
+	}
+	for command, exp := range routes {
+		if err := assertEq(exp, RouteCommand(command, backends)); err != nil {
+			t.Errorf("%s: %s", command, err.Error())
+		}
+	}
+
+	// selected backends limit the routing
+	if err := assertEq([]string{"mockid1"}, RouteCommand("COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_2;0", map[string]string{"mockid1": "mockid1"})); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func sendTestCommand(socket string, command string) (string, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.Write([]byte(command + "\n\n"))
+	conn.(*net.UnixConn).CloseWrite()
+	res, err := ioutil.ReadAll(conn)
+	return strings.TrimSpace(string(res)), err
+}
+
+func TestCommandPolicy(t *testing.T) {
+	extraConfig := `
+		Listen      = ["test.sock", "test_ro.sock", "test_auth.sock"]
+		CommandDeny = ["SHUTDOWN_*"]
+
+		[[Listeners]]
+		Listen   = "test_ro.sock"
+		ReadOnly = true
+
+		[[Listeners]]
+		Listen          = "test_auth.sock"
+		RequireAuthUser = true
+	`
+	peer := StartTestPeerExtra(1, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+
+	commands := map[string]string{
+		"COMMAND [0] SHUTDOWN_PROGRAM\nAuthUser: demo@localhost":                        "forbidden: command SHUTDOWN_PROGRAM is not allowed",
+		"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0":                           "forbidden: commands require an AuthUser header",
+		"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0\nAuthUser: nobody":         "forbidden: contact nobody is not allowed to submit commands",
+		"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0\nAuthUser: demo@localhost": "",
+	}
+	for command, exp := range commands {
+		res, err := sendTestCommand("test_auth.sock", command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(exp, res); err != nil {
+			t.Errorf("%s: %s", command, err.Error())
+		}
+	}
+
+	res, err := sendTestCommand("test_ro.sock", "COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0\nAuthUser: demo@localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("forbidden: commands are not allowed on this listener", res); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestCommandPolicyMerge(t *testing.T) {
+	conf := &Config{
+		CommandAllow: []string{"ACKNOWLEDGE_*", "SCHEDULE_*"},
+		CommandDeny:  []string{"SCHEDULE_HOSTGROUP_*"},
+		Listeners: []ListenerConfig{
+			{Listen: "127.0.0.1:3333", CommandAllow: []string{"*"}, CommandDeny: []string{"SHUTDOWN_PROGRAM"}},
+		},
+	}
+
+	policy := GetCommandPolicy(conf, "/tmp/lmd.sock")
+	if err := assertEq(nil, policy.Check("COMMAND [0] acknowledge_host_problem;test", "")); err != nil {
+		t.Error(err)
+	}
+	if policy.Check("COMMAND [0] SCHEDULE_HOSTGROUP_HOST_DOWNTIME;test", "") == nil {
+		t.Errorf("global deny list should match")
+	}
+	if policy.Check("COMMAND [0] DISABLE_NOTIFICATIONS", "") == nil {
+		t.Errorf("global allow list should not match")
+	}
+
+	policy = GetCommandPolicy(conf, "127.0.0.1:3333")
+	if err := assertEq(nil, policy.Check("COMMAND [0] DISABLE_NOTIFICATIONS", "")); err != nil {
+		t.Error(err)
+	}
+	if policy.Check("COMMAND [0] SHUTDOWN_PROGRAM", "") == nil {
+		t.Errorf("listener deny list should match")
+	}
+	if policy.Check("COMMAND [0] SCHEDULE_HOSTGROUP_HOST_DOWNTIME;test", "") == nil {
+		t.Errorf("global deny list should still match")
+	}
+}
+
+func TestCommandWait(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+
+	commands := map[string][]interface{}{
+		"COMMAND [0] REMOVE_HOST_ACKNOWLEDGEMENT;testhost_1\nCommandWait: 5000":              {"mockid0", 1.0, "", 1.0},
+		"COMMAND [0] ACKNOWLEDGE_HOST_PROBLEM;testhost_1;1;1;1;admin;test\nCommandWait: 300": {"mockid0", 1.0, "", 0.0},
+		"COMMAND [0] DISABLE_NOTIFICATIONS\nCommandWait: 0":                                  {"mockid0", 1.0, "", 0.0},
+	}
+	for command, exp := range commands {
+		res, err := sendTestCommand("test.sock", command+"\nResponseHeader: fixed16")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq("200", res[0:3]); err != nil {
+			t.Fatalf("%s: %s", command, err.Error())
+		}
+		var result [][]interface{}
+		if err = json.Unmarshal([]byte(strings.SplitN(res, "\n", 2)[1]), &result); err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq([][]interface{}{exp}, result); err != nil {
+			t.Errorf("%s: %s", command, err.Error())
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestCommandBulk(t *testing.T) {
+	peer := StartTestPeer(1, 10, 20)
+	PauseTestPeers(peer)
+
+	services, err := peer.QueryString("GET services\nColumns: host_name description\nFilter: host_name = testhost_1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := make([][]interface{}, 0)
+	for _, row := range services {
+		exp = append(exp, []interface{}{"mockid0", "COMMAND [0] ACKNOWLEDGE_SVC_PROBLEM;testhost_1;" + row[1].(string) + ";1;1;0;admin;text"})
+	}
+	if len(exp) == 0 {
+		t.Fatal("test requires services for testhost_1")
+	}
+
+	queries := map[string][][]interface{}{
+		"COMMAND [0] ACKNOWLEDGE_SVC_PROBLEM;$HOSTNAME$;$SERVICEDESC$;1;1;0;admin;text\nFilter: host_name = testhost_1\nCommandDryRun: on": exp,
+		"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;$HOSTNAME$;0\nFilter: name = testhost_1\nFilter: name = testhost_2\nOr: 2\nCommandDryRun: on": {
+			{"mockid0", "COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0"},
+			{"mockid0", "COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_2;0"},
+		},
+		"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;$HOSTNAME$;0\nFilter: name = testhost_1\nCommandWait: 0": {
+			{"mockid0", 1.0, "", 0.0},
+		},
+	}
+	for query, exp := range queries {
+		res, err := sendTestCommand("test.sock", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result [][]interface{}
+		if err = json.Unmarshal([]byte(res), &result); err != nil {
+			t.Fatalf("%s: %s", res, err.Error())
+		}
+		if err = assertEq(exp, result); err != nil {
+			t.Errorf("%s: %s", query, err.Error())
+		}
+	}
+
+	res, err := sendTestCommand("test.sock", "COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;$HOSTNAME$;0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("bad request: bulk commands require a Filter header", res); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// commandQueue stores commands for unreachable backends, nil unless CommandQueueFile is configured.
+var commandQueue *CommandQueue
+
+// commandQueueInterval sets how often queued commands are retried.
+var commandQueueInterval = 1 * time.Second
+
+// commandQueueMaxBackoff is the maximum delay in seconds between two retries.
+const commandQueueMaxBackoff = 600
+
+var reCancelQueuedCommand = regexp.MustCompile(`^COMMAND \[\d+\] LMD_CANCEL_QUEUED_COMMAND;(\d+)$`)
+
+// QueuedCommand is a single command waiting for its backend.
+type QueuedCommand struct {
+	ID        int64
+	PeerID    string
+	Command   string
+	Queued    int64
+	Attempts  int
+	NextTry   int64
+	LastError string
+}
+
+// CommandQueue keeps commands which could not be sent, persists them to disk
+// and retries them with increasing delay once the backend is back online.
+// Commands for the same backend are sent in the order they have been queued.
+type CommandQueue struct {
+	noCopy        noCopy
+	lock          *LoggingLock
+	File          string `json:"-"`
+	MaxAge        int64  `json:"-"`
+	RetryInterval int64  `json:"-"`
+	LastID        int64
+	Commands      []*QueuedCommand
+	stopChannel   chan bool
+}
+
+// NewCommandQueue creates a new queue and reads pending commands from the given file.
+func NewCommandQueue(file string, maxAge int64, retryInterval int64) (q *CommandQueue, err error) {
+	q = &CommandQueue{
+		lock:          NewLoggingLock("CommandQueueLock"),
+		File:          file,
+		MaxAge:        maxAge,
+		RetryInterval: retryInterval,
+		Commands:      make([]*QueuedCommand, 0),
+	}
+	if _, sErr := os.Stat(file); os.IsNotExist(sErr) {
+		return
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, q); err != nil {
+		return nil, fmt.Errorf("cannot read command queue %s: %s", file, err.Error())
+	}
+	if len(q.Commands) > 0 {
+		log.Infof("read %d queued commands from %s", len(q.Commands), file)
+	}
+	return
+}
+
+// initCommandQueue stops the current queue and starts a new one from the configuration.
+func initCommandQueue(conf *Config) {
+	commandQueue.Stop()
+	commandQueue = nil
+	if conf.CommandQueueFile == "" {
+		return
+	}
+	q, err := NewCommandQueue(conf.CommandQueueFile, conf.CommandQueueMaxAge, conf.CommandQueueRetry)
+	if err != nil {
+		log.Errorf("failed to initialize command queue: %s", err.Error())
+		return
+	}
+	q.Start()
+	commandQueue = q
+}
+
+// Start starts retrying queued commands in the background.
+func (q *CommandQueue) Start() {
+	stopChannel := make(chan bool)
+	q.stopChannel = stopChannel
+	go func() {
+		defer logPanicExit()
+		ticker := time.NewTicker(commandQueueInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopChannel:
+				return
+			case <-ticker.C:
+				q.process()
+			}
+		}
+	}()
+}
+
+// Stop stops retrying commands. It is safe to call on a nil queue.
+func (q *CommandQueue) Stop() {
+	if q == nil || q.stopChannel == nil {
+		return
+	}
+	close(q.stopChannel)
+	q.stopChannel = nil
+}
+
+// Add queues commands for the given backend.
+func (q *CommandQueue) Add(peerID string, commands []string, reason string) {
+	now := time.Now().Unix()
+	q.lock.Lock()
+	for _, command := range commands {
+		q.LastID++
+		q.Commands = append(q.Commands, &QueuedCommand{
+			ID:        q.LastID,
+			PeerID:    peerID,
+			Command:   command,
+			Queued:    now,
+			NextTry:   now + q.RetryInterval,
+			LastError: reason,
+		})
+	}
+	q.persist()
+	q.lock.Unlock()
+}
+
+// HasPending returns true if there are queued commands for this backend.
+// New commands have to be queued behind them to keep the order.
+func (q *CommandQueue) HasPending(peerID string) bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	for _, cmd := range q.Commands {
+		if cmd.PeerID == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+// Cancel removes a queued command.
+func (q *CommandQueue) Cancel(id int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, cmd := range q.Commands {
+		if cmd.ID == id {
+			q.Commands = append(q.Commands[:i], q.Commands[i+1:]...)
+			log.Infof("[%s] canceled queued command: %s", cmd.PeerID, cmd.Command)
+			q.persist()
+			return nil
+		}
+	}
+	return fmt.Errorf("bad request: no queued command with id %d", id)
+}
+
+// GetTableData returns the rows of the commands_queue table for the given backend.
+// Values must be in the same order as the columns from NewCommandsQueueTable.
+func (q *CommandQueue) GetTableData(peerID string) (data [][]interface{}) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	for _, cmd := range q.Commands {
+		if cmd.PeerID != peerID {
+			continue
+		}
+		data = append(data, []interface{}{
+			cmd.ID,
+			cmd.Command,
+			cmd.Queued,
+			cmd.Attempts,
+			cmd.NextTry,
+			cmd.Queued + q.MaxAge,
+			cmd.LastError,
+		})
+	}
+	return
+}
+
+// process removes expired commands and retries all due commands for online backends.
+func (q *CommandQueue) process() {
+	now := time.Now().Unix()
+	due := make(map[string][]QueuedCommand)
+	waiting := make(map[string]bool)
+	q.lock.Lock()
+	commands := make([]*QueuedCommand, 0, len(q.Commands))
+	for _, cmd := range q.Commands {
+		if now-cmd.Queued > q.MaxAge {
+			log.Warnf("[%s] dropping queued command after %ds: %s", cmd.PeerID, q.MaxAge, cmd.Command)
+			continue
+		}
+		commands = append(commands, cmd)
+		// only the first command of each backend decides if it is time for a retry
+		if waiting[cmd.PeerID] {
+			continue
+		}
+		if _, ok := due[cmd.PeerID]; !ok && cmd.NextTry > now {
+			waiting[cmd.PeerID] = true
+			continue
+		}
+		due[cmd.PeerID] = append(due[cmd.PeerID], *cmd)
+	}
+	changed := len(commands) != len(q.Commands)
+	q.Commands = commands
+	if changed {
+		q.persist()
+	}
+	q.lock.Unlock()
+
+	peerIDs := make([]string, 0, len(due))
+	for peerID := range due {
+		peerIDs = append(peerIDs, peerID)
+	}
+	sort.Strings(peerIDs)
+	for _, peerID := range peerIDs {
+		PeerMapLock.RLock()
+		p, ok := PeerMap[peerID]
+		PeerMapLock.RUnlock()
+		if !ok || !p.isOnline() {
+			continue
+		}
+		q.send(p, due[peerID])
+	}
+}
+
+// send sends the commands in order and stops at the first connection error.
+// Commands rejected by the backend are removed from the queue.
+func (q *CommandQueue) send(p *Peer, commands []QueuedCommand) {
+	done := make(map[int64]bool)
+	numSent := 0
+	var failed *QueuedCommand
+	var err error
+	for i := range commands {
+		_, err = p.Query(&Request{Command: commands[i].Command})
+		if err != nil && isConnectionError(err) {
+			failed = &commands[i]
+			break
+		}
+		if err != nil {
+			log.Warnf("[%s] queued command rejected by backend, removing it from the queue: %s", p.Name, err.Error())
+		} else {
+			numSent++
+		}
+		done[commands[i].ID] = true
+	}
+	if numSent > 0 {
+		log.Infof("[%s] send %d queued commands successfully.", p.Name, numSent)
+		p.ScheduleImmediateUpdate()
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	commandsLeft := make([]*QueuedCommand, 0, len(q.Commands))
+	for _, cmd := range q.Commands {
+		if done[cmd.ID] {
+			continue
+		}
+		if failed != nil && cmd.ID == failed.ID {
+			cmd.Attempts++
+			cmd.LastError = err.Error()
+			cmd.NextTry = time.Now().Unix() + q.backoff(cmd.Attempts)
+			log.Warnf("[%s] sending queued command failed, retrying in %ds: %s", p.Name, cmd.NextTry-time.Now().Unix(), err.Error())
+		}
+		commandsLeft = append(commandsLeft, cmd)
+	}
+	q.Commands = commandsLeft
+	q.persist()
+}
+
+// isConnectionError returns true if the backend could not be reached or did not answer in time.
+// Other errors are rejections by the backend which will not succeed on retry.
+func isConnectionError(err error) bool {
+	switch e := err.(type) {
+	case *PeerError:
+		return e.Type() == ConnectionError
+	case net.Error:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// backoff returns the delay in seconds before the next retry.
+func (q *CommandQueue) backoff(attempts int) int64 {
+	delay := q.RetryInterval
+	for i := 1; i < attempts && delay < commandQueueMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > commandQueueMaxBackoff {
+		delay = commandQueueMaxBackoff
+	}
+	return delay
+}
+
+// persist writes the queue atomically to disk. The lock must be held by the caller.
+func (q *CommandQueue) persist() {
+	data, err := json.Marshal(q)
+	if err == nil {
+		var tmpFile *os.File
+		tmpFile, err = ioutil.TempFile(filepath.Dir(q.File), filepath.Base(q.File)+".tmp")
+		if err == nil {
+			_, err = tmpFile.Write(data)
+			tmpFile.Close()
+			if err == nil {
+				err = os.Rename(tmpFile.Name(), q.File)
+			}
+			if err != nil {
+				os.Remove(tmpFile.Name())
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf("cannot persist command queue: %s", err.Error())
+	}
+}
+
+// ProcessQueueCommand handles the LMD_CANCEL_QUEUED_COMMAND command.
+// It returns false if the command is not a queue command.
+func ProcessQueueCommand(command string) (isQueueCommand bool, err error) {
+	matched := reCancelQueuedCommand.FindStringSubmatch(command)
+	if len(matched) == 0 {
+		return false, nil
+	}
+	if commandQueue == nil {
+		return true, fmt.Errorf("bad request: command queue is not enabled")
+	}
+	id, _ := strconv.ParseInt(matched[1], 10, 64)
+	return true, commandQueue.Cancel(id)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCommandQueueTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := dir + "/queue.json"
+
+	extraConfig := fmt.Sprintf("CommandQueueFile = \"%s\"\nCommandQueueRetry = 1\n", file)
+	peer := StartTestPeerExtra(1, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+
+	commandQueue.Add("mockid0", []string{"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0", "COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_2;0"}, "connection refused")
+	res, err := peer.QueryString("GET commands_queue\nColumns: id command peer_key last_error\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("mockid0", res[0][2]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("connection refused", res[0][3]); err != nil {
+		t.Error(err)
+	}
+
+	peer.QueryString("COMMAND [0] LMD_CANCEL_QUEUED_COMMAND;1")
+	res, err = peer.QueryString("GET commands_queue\nColumns: id command\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_2;0", res[0][1]); err != nil {
+		t.Error(err)
+	}
+
+	// queue must survive restarts
+	q, err := NewCommandQueue(file, 60, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(q.Commands)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(int64(2), q.LastID); err != nil {
+		t.Error(err)
+	}
+
+	// peer is online, so the command will be sent with the next retry
+	for retries := 0; retries < 50; retries++ {
+		if !commandQueue.HasPending("mockid0") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err = assertEq(false, commandQueue.HasPending("mockid0")); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+	initCommandQueue(&Config{})
+}
+
+func TestCommandQueueExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewCommandQueue(dir+"/queue.json", 60, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Add("unknown", []string{"COMMAND [0] TEST"}, "")
+	q.Commands[0].Queued -= 120
+	q.process()
+	if err = assertEq(0, len(q.Commands)); err != nil {
+		t.Error(err)
+	}
+
+	for attempts, delay := range map[int]int64{1: 10, 2: 20, 3: 40, 10: commandQueueMaxBackoff} {
+		if err = assertEq(delay, q.backoff(attempts)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCommandQueueErrors(t *testing.T) {
+	tests := map[error]bool{
+		&PeerError{msg: "connection refused", kind: ConnectionError}: true,
+		&net.OpError{Op: "write", Err: fmt.Errorf("broken pipe")}:    true,
+		io.EOF: true,
+		&PeerError{msg: "remote site returned rc: 400", kind: ResponseError}: false,
+		fmt.Errorf("unknown backend"):                                        false,
+	}
+	for err, exp := range tests {
+		if res := assertEq(exp, isConnectionError(err)); res != nil {
+			t.Errorf("%s: %s", err.Error(), res.Error())
+		}
+	}
+}
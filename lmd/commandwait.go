@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandWaitConditions maps commands to a filter on the referenced host or
+// service which matches once the command has been processed by the core.
+var CommandWaitConditions = map[string]string{
+	"ACKNOWLEDGE_HOST_PROBLEM":        "acknowledged = 1",
+	"ACKNOWLEDGE_HOST_PROBLEM_EXPIRE": "acknowledged = 1",
+	"REMOVE_HOST_ACKNOWLEDGEMENT":     "acknowledged = 0",
+	"ENABLE_HOST_CHECK":               "active_checks_enabled = 1",
+	"DISABLE_HOST_CHECK":              "active_checks_enabled = 0",
+	"ENABLE_PASSIVE_HOST_CHECKS":      "accept_passive_checks = 1",
+	"DISABLE_PASSIVE_HOST_CHECKS":     "accept_passive_checks = 0",
+	"ENABLE_HOST_NOTIFICATIONS":       "notifications_enabled = 1",
+	"DISABLE_HOST_NOTIFICATIONS":      "notifications_enabled = 0",
+	"ENABLE_HOST_EVENT_HANDLER":       "event_handler_enabled = 1",
+	"DISABLE_HOST_EVENT_HANDLER":      "event_handler_enabled = 0",
+	"ENABLE_HOST_FLAP_DETECTION":      "flap_detection_enabled = 1",
+	"DISABLE_HOST_FLAP_DETECTION":     "flap_detection_enabled = 0",
+	"ACKNOWLEDGE_SVC_PROBLEM":         "acknowledged = 1",
+	"ACKNOWLEDGE_SVC_PROBLEM_EXPIRE":  "acknowledged = 1",
+	"REMOVE_SVC_ACKNOWLEDGEMENT":      "acknowledged = 0",
+	"ENABLE_SVC_CHECK":                "active_checks_enabled = 1",
+	"DISABLE_SVC_CHECK":               "active_checks_enabled = 0",
+	"ENABLE_PASSIVE_SVC_CHECKS":       "accept_passive_checks = 1",
+	"DISABLE_PASSIVE_SVC_CHECKS":      "accept_passive_checks = 0",
+	"ENABLE_SVC_NOTIFICATIONS":        "notifications_enabled = 1",
+	"DISABLE_SVC_NOTIFICATIONS":       "notifications_enabled = 0",
+	"ENABLE_SVC_EVENT_HANDLER":        "event_handler_enabled = 1",
+	"DISABLE_SVC_EVENT_HANDLER":       "event_handler_enabled = 0",
+	"ENABLE_SVC_FLAP_DETECTION":       "flap_detection_enabled = 1",
+	"DISABLE_SVC_FLAP_DETECTION":      "flap_detection_enabled = 0",
+}
+
+// CommandNewEntries maps commands which add a comment or downtime to the
+// referenced host or service to the table of the new entry.
+var CommandNewEntries = map[string]string{
+	"ADD_HOST_COMMENT":       "comments",
+	"ADD_SVC_COMMENT":        "comments",
+	"SCHEDULE_HOST_DOWNTIME": "downtimes",
+	"SCHEDULE_SVC_DOWNTIME":  "downtimes",
+}
+
+// CommandConfirmation describes how the effect of a command becomes visible in the cache.
+type CommandConfirmation struct {
+	Table     string                     // table of the referenced object
+	Key       string                     // index key of the referenced object
+	Condition []*Filter                  // filter for hosts and services
+	NewTable  string                     // comments or downtimes table which gets a new entry
+	knownIDs  map[string]map[string]bool // existing entries per backend before sending the command
+}
+
+// NewCommandConfirmation returns the confirmation for the given command or nil
+// if there is no way to check the effect of this command.
+func NewCommandConfirmation(command string, peers []string) *CommandConfirmation {
+	name, args := ParseCommand(command)
+	target, ok := CommandTargets[name]
+	if !ok || len(args) < target.Args {
+		return nil
+	}
+	conf := &CommandConfirmation{
+		Table: target.Table,
+		Key:   strings.Join(args[0:target.Args], ";"),
+	}
+	switch {
+	case CommandWaitConditions[name] != "":
+		line := CommandWaitConditions[name]
+		if err := ParseFilter(line, &line, conf.Table, &conf.Condition); err != nil {
+			log.Errorf("invalid wait condition for %s: %s", name, err.Error())
+			return nil
+		}
+	case CommandNewEntries[name] != "":
+		conf.NewTable = CommandNewEntries[name]
+		conf.knownIDs = make(map[string]map[string]bool)
+		PeerMapLock.RLock()
+		for _, id := range peers {
+			if p, ok := PeerMap[id]; ok {
+				conf.knownIDs[id] = p.entryIDs(conf.NewTable)
+			}
+		}
+		PeerMapLock.RUnlock()
+	case conf.Table == "comments" || conf.Table == "downtimes":
+		// removing comments or downtimes, wait till the entry is gone
+	default:
+		return nil
+	}
+	return conf
+}
+
+// MaxCommandWait is the maximum time in milliseconds a command waits for its confirmation.
+const MaxCommandWait = 60000
+
+// SendCommandWithResults sends a single command to all target backends and
+// returns the result for each backend. If CommandWait is set, it waits up to
+// CommandWait milliseconds till the effect of the command is visible in the cache.
+// In cluster mode, the node owning a backend sends the command and waits for its confirmation.
+func SendCommandWithResults(req *Request, targets []string, entry *AuditEntry) *Response {
+	commandWait := req.CommandWait
+	if commandWait > MaxCommandWait {
+		commandWait = MaxCommandWait
+	}
+	command := strings.TrimSpace(req.Command)
+	localCommands := make(map[string][]string)
+	remoteCommands := make(map[*NodeAddress]map[string][]string)
+	for _, id := range targets {
+		var node *NodeAddress
+		if nodeAccessor != nil && nodeAccessor.IsClustered() {
+			node = nodeAccessor.BackendNode(id)
+		}
+		if node == nil {
+			localCommands[id] = []string{command}
+			continue
+		}
+		if _, ok := remoteCommands[node]; !ok {
+			remoteCommands[node] = make(map[string][]string)
+		}
+		remoteCommands[node][id] = []string{command}
+	}
+
+	results := make(map[string]error)
+	confirmed := make(map[string]bool)
+	lock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for node, commands := range remoteCommands {
+		wg.Add(1)
+		go func(node *NodeAddress, commands map[string][]string) {
+			defer logPanicExit()
+			defer wg.Done()
+			nodeResults, nodeConfirmed := nodeAccessor.ForwardCommands(node, commands, []*AuditEntry{entry}, commandWait)
+			lock.Lock()
+			mergeCommandResults(results, confirmed, nodeResults, nodeConfirmed)
+			lock.Unlock()
+		}(node, commands)
+	}
+	localResults, localConfirmed := sendCommandsWithConfirmation(localCommands, nil, commandWait)
+	wg.Wait()
+	mergeCommandResults(results, confirmed, localResults, localConfirmed)
+
+	entry.SetResults(results)
+	go func() {
+		defer logPanicExit()
+		auditCommand(entry)
+	}()
+
+	return CommandResultResponse(req, targets, results, confirmed)
+}
+
+// sendCommandsWithConfirmation sends commands to backends of this node. If commandWait
+// is set, it waits up to commandWait milliseconds till the effect of the command is
+// visible for each backend which got a single command.
+func sendCommandsWithConfirmation(commandsByPeer map[string][]string, auditEntries []*AuditEntry, commandWait int) (map[string]error, map[string]bool) {
+	confirmations := make(map[string]*CommandConfirmation)
+	if commandWait > 0 {
+		for id, commands := range commandsByPeer {
+			if len(commands) != 1 {
+				continue
+			}
+			if conf := NewCommandConfirmation(commands[0], []string{id}); conf != nil {
+				confirmations[id] = conf
+			}
+		}
+	}
+	results := sendCommands(&commandsByPeer, auditEntries, false)
+
+	confirmed := make(map[string]bool)
+	lock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for id, conf := range confirmations {
+		if err, ok := results[id]; !ok || err != nil {
+			continue
+		}
+		PeerMapLock.RLock()
+		p, ok := PeerMap[id]
+		PeerMapLock.RUnlock()
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(peer *Peer, conf *CommandConfirmation) {
+			defer logPanicExitPeer(peer)
+			defer wg.Done()
+			ok := peer.WaitCommandConfirmation(conf, commandWait)
+			lock.Lock()
+			confirmed[peer.ID] = ok
+			lock.Unlock()
+		}(p, conf)
+	}
+	wg.Wait()
+	return results, confirmed
+}
+
+// mergeCommandResults adds the results and confirmations of some backends to the overall result.
+func mergeCommandResults(results map[string]error, confirmed map[string]bool, addResults map[string]error, addConfirmed map[string]bool) {
+	for id, err := range addResults {
+		results[id] = err
+	}
+	for id, ok := range addConfirmed {
+		confirmed[id] = ok
+	}
+}
+
+// CommandResultResponse creates a response with the result and confirmation for each backend.
+func CommandResultResponse(req *Request, targets []string, results map[string]error, confirmed map[string]bool) *Response {
+	res := NewCommandResponse(req, []string{"peer_key", "success", "error", "confirmed"})
+	for _, id := range targets {
+		err, ok := results[id]
+		if !ok {
+			err = fmt.Errorf("timeout while sending command")
+		}
+		row := []interface{}{id, 1, "", 0}
+		if err != nil {
+			row[1] = 0
+			row[2] = err.Error()
+			res.Failed[id] = err.Error()
+		}
+		if confirmed[id] {
+			row[3] = 1
+		}
+		res.Result = append(res.Result, row)
+	}
+	res.ResultTotal = len(res.Result)
+	return res
+}
+
+// WaitCommandConfirmation waits up to timeout milliseconds till the effect of
+// a command is visible. Hosts and services are checked with the WaitCondition
+// mechanism, comments and downtimes are refreshed till the entry shows up or is gone.
+// It returns true if the command has been confirmed.
+func (p *Peer) WaitCommandConfirmation(conf *CommandConfirmation, timeout int) bool {
+	if len(conf.Condition) > 0 {
+		if !p.HasObject(conf.Table, conf.Key) {
+			return false
+		}
+		req := &Request{
+			Table:         conf.Table,
+			WaitTrigger:   "all",
+			WaitObject:    conf.Key,
+			WaitCondition: conf.Condition,
+			WaitTimeout:   timeout,
+		}
+		return !p.WaitCondition(req)
+	}
+
+	deadline := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	for {
+		if conf.NewTable != "" {
+			if err := p.UpdateDeltaCommentsOrDowntimes(conf.NewTable); err == nil && p.hasNewEntry(conf) {
+				// refresh the host or service as well, so its comments and downtimes columns are up to date
+				p.updateObject(conf.Table, conf.Key)
+				return true
+			}
+		} else {
+			if err := p.UpdateDeltaCommentsOrDowntimes(conf.Table); err == nil && !p.HasObject(conf.Table, conf.Key) {
+				p.ScheduleImmediateUpdate()
+				return true
+			}
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// entryIDs returns the ids of all cached comments or downtimes.
+func (p *Peer) entryIDs(table string) map[string]bool {
+	ids := make(map[string]bool)
+	p.DataLock.RLock()
+	defer p.DataLock.RUnlock()
+	for id := range p.Tables[table].Index {
+		ids[id] = true
+	}
+	return ids
+}
+
+// hasNewEntry returns true if there is a new comment or downtime for the referenced host or service.
+func (p *Peer) hasNewEntry(conf *CommandConfirmation) bool {
+	hostName := conf.Key
+	serviceDescription := ""
+	if conf.Table == "services" {
+		tmp := strings.SplitN(conf.Key, ";", 2)
+		hostName = tmp[0]
+		serviceDescription = tmp[1]
+	}
+	known := conf.knownIDs[p.ID]
+	p.DataLock.RLock()
+	defer p.DataLock.RUnlock()
+	data := p.Tables[conf.NewTable]
+	if data.Table == nil {
+		return false
+	}
+	hostIndex := data.Table.ColumnsIndex["host_name"]
+	serviceIndex := data.Table.ColumnsIndex["service_description"]
+	for id, row := range data.Index {
+		if known[id] {
+			continue
+		}
+		if row[hostIndex] == hostName && row[serviceIndex] == serviceDescription {
+			return true
+		}
+	}
+	return false
+}
+
+// updateObject refreshes the dynamic data of a single host or service.
+func (p *Peer) updateObject(table string, key string) {
+	var err error
+	switch table {
+	case "hosts":
+		err = p.UpdateDeltaTableHosts("Filter: name = " + key + "\n")
+	case "services":
+		tmp := strings.SplitN(key, ";", 2)
+		err = p.UpdateDeltaTableServices("Filter: host_name = " + tmp[0] + "\nFilter: description = " + tmp[1] + "\n")
+	}
+	if err != nil {
+		log.Debugf("[%s] updating %s %s failed: %s", p.Name, table, key, err.Error())
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 
@@ -11,21 +12,57 @@ import (
 
 // HTTPServerController is the container object for the rest interface's server.
 type HTTPServerController struct {
+	listener *Listener
 }
 
 func (c *HTTPServerController) errorOutput(err error, w http.ResponseWriter) {
+	c.errorOutputCode(err, http.StatusBadRequest, w)
+}
+
+func (c *HTTPServerController) errorOutputCode(err error, code int, w http.ResponseWriter) {
 	j := make(map[string]interface{})
 	j["error"] = err.Error()
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusBadRequest)
+	w.WriteHeader(code)
 	json.NewEncoder(w).Encode(j)
 }
 
+// listenerConfig returns the settings of the http listener.
+func (c *HTTPServerController) listenerConfig() *ListenerConfig {
+	if c.listener == nil {
+		return &ListenerConfig{}
+	}
+	return GetListenerConfig(c.listener.LocalConfig, c.listener.ConnectionString)
+}
+
+// restrict applies the listener settings and the authenticated user to a request with expanded backends.
+// It returns an error if the request is not allowed.
+func (c *HTTPServerController) restrict(req *Request, request *http.Request) error {
+	if err := c.listenerConfig().Restrict(req); err != nil {
+		return err
+	}
+	if user := requestUser(request); user != nil {
+		return user.Restrict(req)
+	}
+	return nil
+}
+
+// acquireQuery waits for a free query slot for the client of the http request, see QueryScheduler.Acquire.
+func (c *HTTPServerController) acquireQuery(request *http.Request) (release func(), err error) {
+	release, err = currentQueryScheduler().Acquire(schedulerClient(request.RemoteAddr, requestUser(request)))
+	if err != nil {
+		log.Warnf("rejected http request from %s to %s: %s", request.RemoteAddr, request.Host, err.Error())
+	}
+	return
+}
+
 func (c *HTTPServerController) index(w http.ResponseWriter, request *http.Request, ps httprouter.Params) {
 	fmt.Fprintf(w, "LMD %s\n", VERSION)
 }
 
-func (c *HTTPServerController) queryTable(w http.ResponseWriter, requestData map[string]interface{}) {
+// queryTable answers a table query, requests from clients are restricted by the listener settings and the
+// authenticated user. Only node requests with a verified signature or client certificate are not restricted.
+func (c *HTTPServerController) queryTable(w http.ResponseWriter, requestData map[string]interface{}, request *http.Request, verifiedNode bool) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// Requested table (name)
@@ -44,10 +81,26 @@ func (c *HTTPServerController) queryTable(w http.ResponseWriter, requestData map
 	}
 
 	// Fetch backend data
-	req.ExpandRequestedBackends() // ParseRequests()
+	err = req.ExpandRequestedBackends() // ParseRequests()
+	if err != nil {
+		c.errorOutput(err, w)
+		return
+	}
+	release := func() {}
+	if !verifiedNode {
+		if err = c.restrict(req, request); err != nil {
+			c.errorOutputCode(err, http.StatusForbidden, w)
+			return
+		}
+		if release, err = c.acquireQuery(request); err != nil {
+			c.errorOutputCode(err, schedulerErrorCode(err), w)
+			return
+		}
+	}
 
 	// Ask request object to send query, get response
 	res, err := req.GetResponse()
+	release()
 	if err != nil {
 		c.errorOutput(err, w)
 		return
@@ -68,7 +121,8 @@ func (c *HTTPServerController) table(w http.ResponseWriter, request *http.Reques
 	requestData := make(map[string]interface{})
 	defer request.Body.Close()
 	decoder := json.NewDecoder(request.Body)
-	if err := decoder.Decode(&requestData); err != nil {
+	// an empty body is fine for GET requests, it returns all columns
+	if err := decoder.Decode(&requestData); err != nil && err != io.EOF {
 		c.errorOutput(fmt.Errorf("request not understood"), w)
 		return
 	}
@@ -79,48 +133,307 @@ func (c *HTTPServerController) table(w http.ResponseWriter, request *http.Reques
 		requestData["table"] = tableName
 	}
 
-	c.queryTable(w, requestData)
+	c.queryTable(w, requestData, request, false)
 }
 
 func (c *HTTPServerController) ping(w http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+	if _, err := readNodeRequest(request); err != nil {
+		c.errorOutputCode(err, http.StatusForbidden, w)
+		return
+	}
+	signed := &signedResponseWriter{ResponseWriter: w}
+	c.pingResponse(signed, nil)
+	signed.send(nodeAccessor.secret, request.Header.Get(nodeNonceHeader))
+}
+
+// pingResponse sends the node identifier along with the version and capabilities of this node.
+// With dynamic membership, the members of both nodes are exchanged.
+func (c *HTTPServerController) pingResponse(w http.ResponseWriter, requestData map[string]interface{}) {
 	w.Header().Set("Content-Type", "application/json")
+	if nodeAccessor.dynamic && requestData != nil {
+		nodeAccessor.addMembers([]interface{}{requestData["url"]})
+		nodeAccessor.addMembers(requestData["members"])
+	}
 
 	// Response data
 	id := nodeAccessor.ID
 	j := make(map[string]interface{})
 	j["identifier"] = id
+	j["version"] = VERSION
+	j["protocol"] = nodeProtocolVersion
+	j["capabilities"] = nodeCapabilities
+	if nodeAccessor.dynamic {
+		j["members"] = nodeAccessor.memberURLs()
+	}
+	j["weight"] = nodeWeight(nodeAccessor.weight)
 
 	// Send data
 	json.NewEncoder(w).Encode(j)
 }
 
+// forwardedCommand sends commands forwarded by another cluster node to
+// the backends of this node and returns the result for each backend.
+// The command policy of this listener is applied again to each command.
+func (c *HTTPServerController) forwardedCommand(w http.ResponseWriter, request *http.Request, requestData map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	forwardedBy, _ := requestData["forwarded_by"].(string)
+	rawCommands, ok := requestData["commands"].(map[string]interface{})
+	if !ok {
+		c.errorOutput(fmt.Errorf("missing commands"), w)
+		return
+	}
+	rawAuthUsers, _ := requestData["auth_users"].(map[string]interface{})
+	policy := c.commandPolicy()
+	commandsByPeer := make(map[string][]string)
+	rejected := make(map[string]error)
+	auditEntries := make([]*AuditEntry, 0)
+	for id, list := range rawCommands {
+		commands, _ := list.([]interface{})
+		authUsers, _ := rawAuthUsers[id].([]interface{})
+		for i, raw := range commands {
+			command, ok := raw.(string)
+			if !ok {
+				c.errorOutput(fmt.Errorf("commands must be strings"), w)
+				return
+			}
+			authUser := ""
+			if i < len(authUsers) {
+				authUser, _ = authUsers[i].(string)
+			}
+			entry := NewAuditEntry(&Request{Command: command, AuthUser: authUser, ForwardedBy: forwardedBy}, request.RemoteAddr, c.listener)
+			entry.Listener = request.Host
+			entry.Peers = []string{id}
+			err := policy.Check(command, authUser)
+			if err == nil {
+				_, err = policy.AuthorizedBackends(authUser, []string{id})
+			}
+			if err != nil {
+				log.Warnf("rejected command forwarded by node %s: %s", forwardedBy, err.Error())
+				rejectCommand(entry, err)
+				rejected[id] = err
+				continue
+			}
+			commandsByPeer[id] = append(commandsByPeer[id], command)
+			auditEntries = append(auditEntries, entry)
+		}
+	}
+	log.Infof("got commands for %d backends forwarded by node %s", len(commandsByPeer), forwardedBy)
+
+	// the forwarding node waits for the confirmation on this node, which owns the backends
+	rawWait := requestData["command_wait"]
+	commandWait := int(numberToFloat(&rawWait))
+	if commandWait > MaxCommandWait {
+		commandWait = MaxCommandWait
+	}
+	results, confirmed := sendCommandsWithConfirmation(commandsByPeer, auditEntries, commandWait)
+	j := make(map[string]interface{})
+	remoteResults := make(map[string]string)
+	for id := range rawCommands {
+		err, ok := results[id]
+		if rErr, isRejected := rejected[id]; isRejected {
+			err, ok = rErr, true
+		}
+		switch {
+		case !ok:
+			remoteResults[id] = "timeout while sending command"
+		case err != nil:
+			remoteResults[id] = err.Error()
+		default:
+			remoteResults[id] = ""
+		}
+	}
+	j["results"] = remoteResults
+	j["confirmed"] = confirmed
+	json.NewEncoder(w).Encode(j)
+}
+
+// replicate stores the replicated cache of a backend sent by its primary node.
+func (c *HTTPServerController) replicate(w http.ResponseWriter, requestData map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if nodeAccessor.replicator == nil {
+		c.errorOutput(fmt.Errorf("replication is disabled"), w)
+		return
+	}
+	if err := nodeAccessor.replicator.Receive(requestData); err != nil {
+		c.errorOutput(err, w)
+		return
+	}
+	j := make(map[string]interface{})
+	j["ok"] = true
+	json.NewEncoder(w).Encode(j)
+}
+
+// backendChange applies a backend added, updated or removed at runtime on another node.
+func (c *HTTPServerController) backendChange(w http.ResponseWriter, requestData map[string]interface{}) {
+	if backendManager == nil {
+		c.errorOutput(fmt.Errorf("backend management is not initialized"), w)
+		return
+	}
+	action, _ := requestData["action"].(string)
+	id, _ := requestData["id"].(string)
+	var con *Connection
+	if raw, ok := requestData["connection"]; ok {
+		con = &Connection{}
+		data, _ := json.Marshal(raw)
+		if err := json.Unmarshal(data, con); err != nil {
+			c.errorOutput(fmt.Errorf("request not understood"), w)
+			return
+		}
+	} else if action != "remove" {
+		c.errorOutput(fmt.Errorf("missing connection"), w)
+		return
+	}
+	c.managementResult(backendManager.ApplyNodeChange(action, con, id), w)
+}
+
 func (c *HTTPServerController) query(w http.ResponseWriter, request *http.Request, ps httprouter.Params) {
 	// Read request data
 	contentType := request.Header.Get("Content-Type")
 	requestData := make(map[string]interface{})
 	defer request.Body.Close()
+	body, err := readNodeRequest(request)
+	if err != nil {
+		log.Warnf("rejected node request from %s: %s", request.RemoteAddr, err.Error())
+		c.errorOutputCode(err, http.StatusForbidden, w)
+		return
+	}
+
+	// Responses are signed with the nonce of the request
+	signed := &signedResponseWriter{ResponseWriter: w}
+	defer signed.send(nodeAccessor.secret, request.Header.Get(nodeNonceHeader))
+	w = signed
+
 	if contentType == "application/json" {
-		decoder := json.NewDecoder(request.Body)
-		err := decoder.Decode(&requestData)
+		err := json.Unmarshal(body, &requestData)
 		if err != nil {
 			c.errorOutput(fmt.Errorf("request not understood"), w)
 			return
 		}
 	}
+	if err := checkNodeProtocol(requestData); err != nil {
+		c.errorOutput(err, w)
+		return
+	}
 
 	// Request type (requested api function)
 	requestedFunction, _ := requestData["_name"].(string)
 
 	switch requestedFunction {
 	case "ping":
-		c.ping(w, request, ps)
+		c.pingResponse(w, requestData)
+	case "leave":
+		url, _ := requestData["url"].(string)
+		nodeAccessor.removeMember(url)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true})
 	case "table":
-		c.queryTable(w, requestData)
+		// readNodeRequest rejects requests without valid signature or client certificate
+		c.queryTable(w, requestData, request, true)
+	case "command":
+		c.forwardedCommand(w, request, requestData)
+	case "replicate":
+		c.replicate(w, requestData)
+	case "backend":
+		c.backendChange(w, requestData)
 	default:
 		c.errorOutput(fmt.Errorf("unknown request: %s", requestedFunction), w)
 	}
 }
 
+// checkManagementAuth verifies the bearer token of backend management requests.
+func (c *HTTPServerController) checkManagementAuth(w http.ResponseWriter, request *http.Request) bool {
+	key := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if backendManager == nil || !backendManager.CheckKey(key) {
+		c.errorOutputCode(errManagementDenied, http.StatusForbidden, w)
+		return false
+	}
+	return true
+}
+
+// managementResult sends the result of a backend management action.
+func (c *HTTPServerController) managementResult(err error, w http.ResponseWriter) {
+	if err != nil {
+		c.errorOutput(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true})
+}
+
+func (c *HTTPServerController) listBackends(w http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+	if !c.checkManagementAuth(w, request) {
+		return
+	}
+	connections := backendManager.Connections()
+	list := make([]map[string]interface{}, 0, len(connections))
+	for i := range connections {
+		con := connections[i]
+		paused := false
+		PeerMapLock.RLock()
+		if p, ok := PeerMap[con.ID]; ok {
+			paused = p.StatusGet("Paused").(bool)
+		}
+		PeerMapLock.RUnlock()
+		list = append(list, map[string]interface{}{
+			"ID":      con.ID,
+			"Name":    con.Name,
+			"Source":  con.Source,
+			"Section": con.Section,
+			"Paused":  paused,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (c *HTTPServerController) addBackend(w http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+	if !c.checkManagementAuth(w, request) {
+		return
+	}
+	con := &Connection{}
+	defer request.Body.Close()
+	if err := json.NewDecoder(request.Body).Decode(con); err != nil {
+		c.errorOutput(fmt.Errorf("request not understood"), w)
+		return
+	}
+	c.managementResult(backendManager.Add(con), w)
+}
+
+func (c *HTTPServerController) updateBackend(w http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+	if !c.checkManagementAuth(w, request) {
+		return
+	}
+	con := &Connection{}
+	defer request.Body.Close()
+	if err := json.NewDecoder(request.Body).Decode(con); err != nil {
+		c.errorOutput(fmt.Errorf("request not understood"), w)
+		return
+	}
+	con.ID = ps.ByName("id")
+	c.managementResult(backendManager.Update(con), w)
+}
+
+func (c *HTTPServerController) removeBackend(w http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+	if !c.checkManagementAuth(w, request) {
+		return
+	}
+	c.managementResult(backendManager.Remove(ps.ByName("id")), w)
+}
+
+func (c *HTTPServerController) pauseBackend(w http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+	if !c.checkManagementAuth(w, request) {
+		return
+	}
+	c.managementResult(backendManager.Pause(ps.ByName("id")), w)
+}
+
+func (c *HTTPServerController) resumeBackend(w http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+	if !c.checkManagementAuth(w, request) {
+		return
+	}
+	c.managementResult(backendManager.Resume(ps.ByName("id")), w)
+}
+
 func parseRequestDataToRequest(requestData map[string]interface{}) (req *Request, err error) {
 	// New request object for specified table
 	req = &Request{}
@@ -142,6 +455,11 @@ func parseRequestDataToRequest(requestData map[string]interface{}) (req *Request
 		req.Limit = int(val.(float64))
 	}
 
+	// Timelimit in seconds
+	if val, ok := requestData["timelimit"]; ok {
+		req.Timelimit = int(val.(float64))
+	}
+
 	// Filter String in livestatus syntax
 	if val, ok := requestData["filter"]; ok {
 		err = parseHTTPFilterRequestData(req, val, "Filter")
@@ -233,11 +551,11 @@ func parseHTTPFilterRequestData(req *Request, val interface{}, prefix string) (e
 	return
 }
 
-func initializeHTTPRouter() (handler http.Handler, err error) {
+func initializeHTTPRouter(l *Listener) (handler http.Handler, err error) {
 	router := httprouter.New()
 
 	// Controller
-	controller := &HTTPServerController{}
+	controller := &HTTPServerController{listener: l}
 
 	// Routes
 	router.GET("/", controller.index)
@@ -246,6 +564,23 @@ func initializeHTTPRouter() (handler http.Handler, err error) {
 	router.POST("/ping", controller.ping)
 	router.POST("/query", controller.query)
 
+	// Rest api
+	router.GET("/v1/:table", controller.restTable)
+	router.POST("/v1/commands", controller.restCommands)
+
+	// Backend management
+	router.GET("/backends", controller.listBackends)
+	router.POST("/backends", controller.addBackend)
+	router.PUT("/backends/:id", controller.updateBackend)
+	router.DELETE("/backends/:id", controller.removeBackend)
+	router.POST("/backends/:id/pause", controller.pauseBackend)
+	router.POST("/backends/:id/resume", controller.resumeBackend)
+
 	handler = router
+	if l != nil {
+		if auth := GetAuthenticator(l.LocalConfig, l.ConnectionString); auth != nil {
+			handler = &httpAuthHandler{auth: auth, controller: controller, next: router}
+		}
+	}
 	return
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// includeWatchInterval sets how often the include fragments are checked for changes.
+var includeWatchInterval = 1 * time.Second
+
+// includeDebounce sets how long fragments have to stay unchanged before they will be applied.
+var includeDebounce = 3 * time.Second
+
+// IncludeFragment contains the settings allowed in included config fragments.
+type IncludeFragment struct {
+	Connections []Connection
+}
+
+// IncludeWatcher watches the config fragments from the Include option and
+// signals on the Changed channel if fragments have been added, changed or removed.
+type IncludeWatcher struct {
+	noCopy      noCopy
+	Patterns    []string
+	Changed     chan bool
+	stopChannel chan bool
+}
+
+// NewIncludeWatcher creates a new watcher for the given glob patterns.
+func NewIncludeWatcher(patterns []string) *IncludeWatcher {
+	w := &IncludeWatcher{
+		Patterns:    patterns,
+		Changed:     make(chan bool),
+		stopChannel: make(chan bool),
+	}
+	return w
+}
+
+// startIncludeWatcher starts a watcher for the Include patterns of the given config.
+// It returns nil if there is nothing to watch.
+func startIncludeWatcher(conf *Config) *IncludeWatcher {
+	if len(conf.Include) == 0 {
+		return nil
+	}
+	w := NewIncludeWatcher(conf.Include)
+	w.Start()
+	return w
+}
+
+// Start starts watching in the background.
+func (w *IncludeWatcher) Start() {
+	fingerprint := w.fingerprint()
+	go func() {
+		defer logPanicExit()
+		w.loop(fingerprint)
+	}()
+}
+
+// Stop stops watching. It is safe to call on a nil watcher.
+func (w *IncludeWatcher) Stop() {
+	if w == nil {
+		return
+	}
+	close(w.stopChannel)
+}
+
+// Changes returns the channel which signals changed fragments.
+// A nil watcher returns a nil channel which never fires.
+func (w *IncludeWatcher) Changes() chan bool {
+	if w == nil {
+		return nil
+	}
+	return w.Changed
+}
+
+// loop polls the fragments until stopped. Changes are only reported once the
+// fragments did not change for includeDebounce, so partially written files and
+// bulk changes from config management result in a single reload.
+func (w *IncludeWatcher) loop(lastFingerprint string) {
+	ticker := time.NewTicker(includeWatchInterval)
+	defer ticker.Stop()
+	var lastChange time.Time
+	for {
+		select {
+		case <-w.stopChannel:
+			return
+		case <-ticker.C:
+			fingerprint := w.fingerprint()
+			if fingerprint != lastFingerprint {
+				log.Debugf("config fragments changed, waiting %s before reloading", includeDebounce)
+				lastFingerprint = fingerprint
+				lastChange = time.Now()
+				continue
+			}
+			if lastChange.IsZero() || time.Since(lastChange) < includeDebounce {
+				continue
+			}
+			lastChange = time.Time{}
+			select {
+			case w.Changed <- true:
+			case <-w.stopChannel:
+				return
+			}
+		}
+	}
+}
+
+// fingerprint returns a string which changes whenever a fragment is added, changed or removed.
+func (w *IncludeWatcher) fingerprint() string {
+	files, _ := globIncludes(w.Patterns)
+	parts := make([]string, 0, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			parts = append(parts, file+":"+err.Error())
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", file, info.ModTime().UnixNano(), info.Size()))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// globIncludes returns a sorted list of all files matching the include patterns.
+func globIncludes(patterns []string) (files []string, err error) {
+	for _, pattern := range patterns {
+		matches, gErr := filepath.Glob(pattern)
+		if gErr != nil {
+			err = fmt.Errorf("invalid include pattern %s: %s", pattern, gErr.Error())
+			continue
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return
+}
+
+// readIncludes appends the connections from all include fragments.
+// Invalid fragments are skipped and returned as errors.
+func (conf *Config) readIncludes() (errs []error) {
+	files, err := globIncludes(conf.Include)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	ids := make(map[string]string)
+	for i := range conf.Connections {
+		ids[conf.Connections[i].ID] = "main configuration"
+	}
+	for _, file := range files {
+		fragment := IncludeFragment{}
+		meta, dErr := toml.DecodeFile(file, &fragment)
+		if dErr != nil {
+			errs = append(errs, fmt.Errorf("invalid config fragment %s: %s", file, dErr.Error()))
+			continue
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			errs = append(errs, fmt.Errorf("invalid config fragment %s: unsupported option %s", file, undecoded[0].String()))
+			continue
+		}
+		if vErr := fragment.validate(ids); vErr != nil {
+			errs = append(errs, fmt.Errorf("invalid config fragment %s: %s", file, vErr.Error()))
+			continue
+		}
+		for i := range fragment.Connections {
+			ids[fragment.Connections[i].ID] = file
+		}
+		conf.Connections = append(conf.Connections, fragment.Connections...)
+	}
+	return
+}
+
+// validate checks all connections of a fragment for required and duplicate ids.
+func (f *IncludeFragment) validate(ids map[string]string) error {
+	seen := make(map[string]bool)
+	for i := range f.Connections {
+		c := &f.Connections[i]
+		if c.ID == "" {
+			return fmt.Errorf("connection %d has no id", i+1)
+		}
+		if len(c.Source) == 0 {
+			return fmt.Errorf("connection %s has no source", c.ID)
+		}
+		if other, ok := ids[c.ID]; ok {
+			return fmt.Errorf("duplicate id %s, already used in %s", c.ID, other)
+		}
+		if seen[c.ID] {
+			return fmt.Errorf("duplicate id %s", c.ID)
+		}
+		seen[c.ID] = true
+	}
+	return nil
+}
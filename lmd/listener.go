@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -22,6 +23,7 @@ type Listener struct {
 	LocalConfig      *Config
 	waitGroupDone    *sync.WaitGroup
 	waitGroupInit    *sync.WaitGroup
+	auth             *Authenticator
 }
 
 // NewListener creates a new Listener object
@@ -40,9 +42,93 @@ func NewListener(LocalConfig *Config, listen string, waitGroupInit *sync.WaitGro
 	return &l
 }
 
+// ListenerConfig contains individual settings for a listener from the [[Listeners]] section.
+// Timeouts are in seconds and only apply to livestatus listeners.
+// ReadOnly, CommandAllow, CommandDeny and RequireAuthUser define the command policy, see GetCommandPolicy.
+// Auth, Users and Htpasswd enable authentication, see GetAuthenticator.
+type ListenerConfig struct {
+	Listen           string
+	ReadOnly         bool
+	Tables           []string
+	Backends         []string
+	OutputFormat     string
+	IdleTimeout      int
+	KeepAliveTimeout int
+	MaxRows          int
+	CommandAllow     []string
+	CommandDeny      []string
+	RequireAuthUser  bool
+	Auth             bool
+	Users            []string
+	Htpasswd         string
+	timeout          int // maximum lifetime of a connection, see ConnectionTimeout
+}
+
+// GetListenerConfig returns the settings for the given listener. Listeners from the
+// plain Listen list get the defaults. Unset timeouts default to the ListenTimeout.
+func GetListenerConfig(conf *Config, listen string) *ListenerConfig {
+	settings := ListenerConfig{Listen: listen}
+	for i := range conf.Listeners {
+		if conf.Listeners[i].Listen == listen {
+			settings = conf.Listeners[i]
+			break
+		}
+	}
+	if settings.IdleTimeout <= 0 {
+		settings.IdleTimeout = conf.ListenTimeout
+	}
+	if settings.KeepAliveTimeout <= 0 {
+		settings.KeepAliveTimeout = conf.ListenTimeout
+	}
+	settings.timeout = conf.ListenTimeout
+	if settings.IdleTimeout > settings.timeout {
+		settings.timeout = settings.IdleTimeout
+	}
+	if settings.KeepAliveTimeout > settings.timeout {
+		settings.timeout = settings.KeepAliveTimeout
+	}
+	return &settings
+}
+
+// ConnectionTimeout returns the time after which client connections are closed,
+// which is the largest of the ListenTimeout, IdleTimeout and KeepAliveTimeout.
+func (settings *ListenerConfig) ConnectionTimeout() time.Duration {
+	return time.Duration(settings.timeout) * time.Second
+}
+
+// Restrict applies the allowed tables, backends and the row limit to a request with expanded backends.
+// It returns an error if the request is not allowed on this listener.
+func (settings *ListenerConfig) Restrict(req *Request) error {
+	if req.Table != "" && len(settings.Tables) > 0 {
+		found := false
+		for _, table := range settings.Tables {
+			if table == req.Table {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("forbidden: table %s is not allowed on this listener", req.Table)
+		}
+	}
+	if len(settings.Backends) > 0 {
+		ok, err := req.RestrictBackends(settings.Backends)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("forbidden: backends are not available on this listener")
+		}
+	}
+	if settings.MaxRows > 0 && req.Command == "" && (req.Limit <= 0 || req.Limit > settings.MaxRows) {
+		req.Limit = settings.MaxRows
+	}
+	return nil
+}
+
 // QueryServer handles a single client connection.
 // It returns any error encountered.
-func QueryServer(c net.Conn) error {
+func QueryServer(c net.Conn, l *Listener) error {
 	localAddr := c.LocalAddr().String()
 	keepAlive := false
 	remote := c.RemoteAddr().String()
@@ -50,12 +136,14 @@ func QueryServer(c net.Conn) error {
 	if remote == "" {
 		remote = "unknown"
 	}
+	var user *ListenerUser
+	settings := GetListenerConfig(l.LocalConfig, l.ConnectionString)
 
 	for {
 		if !keepAlive {
 			promFrontendConnections.WithLabelValues(localAddr).Inc()
 			log.Debugf("incoming request from: %s to %s", remote, localAddr)
-			c.SetDeadline(time.Now().Add(time.Duration(10) * time.Second))
+			c.SetDeadline(time.Now().Add(time.Duration(settings.IdleTimeout) * time.Second))
 		}
 
 		reqs, err := ParseRequests(c)
@@ -71,13 +159,22 @@ func QueryServer(c net.Conn) error {
 			(&Response{Code: 400, Request: &Request{}, Error: err}).Send(c)
 			return err
 		}
+		if len(reqs) > 0 && l.auth != nil {
+			var code int
+			user, code, err = authorizeRequests(l.auth, reqs, user)
+			if err != nil {
+				log.Warnf("rejected request from %s to %s: %s", remote, localAddr, err.Error())
+				(&Response{Code: code, Request: reqs[0], Error: err}).Send(c)
+				return err
+			}
+		}
 		if len(reqs) > 0 {
-			keepAlive, err = ProcessRequests(reqs, c, remote)
+			keepAlive, err = ProcessRequests(reqs, c, remote, l, user)
 
 			// keep open keepalive request until either the client closes the connection or the deadline timeout is hit
 			if keepAlive {
 				log.Debugf("keepalive connection from %s, waiting for more requests", remote)
-				c.SetDeadline(time.Now().Add(time.Duration(10) * time.Second))
+				c.SetDeadline(time.Now().Add(time.Duration(settings.KeepAliveTimeout) * time.Second))
 				continue
 			}
 		} else if keepAlive {
@@ -94,23 +191,138 @@ func QueryServer(c net.Conn) error {
 	}
 }
 
-// ProcessRequests creates response for all given requests
-func ProcessRequests(reqs []*Request, c net.Conn, remote string) (bool, error) {
+// ProcessRequests creates response for all given requests. The user is nil unless the listener requires authentication.
+func ProcessRequests(reqs []*Request, c net.Conn, remote string, l *Listener, user *ListenerUser) (bool, error) {
 	if len(reqs) == 0 {
 		return false, nil
 	}
 	commandsByPeer := make(map[string][]string)
+	var auditEntries []*AuditEntry
+	settings := GetListenerConfig(l.LocalConfig, l.ConnectionString)
 	for _, req := range reqs {
 		t1 := time.Now()
+		if err := settings.Restrict(req); err != nil {
+			log.Warnf("rejected request from %s to %s: %s", remote, c.LocalAddr().String(), err.Error())
+			(&Response{Code: 403, Request: req, Error: err}).Send(c)
+			return false, err
+		}
+		if req.OutputFormat == "" && settings.OutputFormat != "" {
+			// invalid formats have been logged when the listener started
+			parseOutputFormat(&req.OutputFormat, settings.OutputFormat)
+		}
 		if req.Command != "" {
-			for _, pID := range req.BackendsMap {
+			policy := GetCommandPolicy(l.LocalConfig, l.ConnectionString)
+			if pErr := policy.Check(req.Command, req.AuthUser); pErr != nil {
+				log.Warnf("rejected command from %s to %s: %s", remote, c.LocalAddr().String(), pErr.Error())
+				rejectCommand(NewAuditEntry(req, remote, l), pErr)
+				(&Response{Code: 403, Request: req, Error: pErr}).Send(c)
+				return false, pErr
+			}
+			isManagementCommand, mErr := ProcessManagementCommand(req.Command)
+			if isManagementCommand {
+				entry := NewAuditEntry(req, remote, l)
+				if mErr != nil {
+					code := 400
+					if mErr == errManagementDenied {
+						code = 403
+					}
+					rejectCommand(entry, mErr)
+					(&Response{Code: code, Request: req, Error: mErr}).Send(c)
+					return false, mErr
+				}
+				auditCommand(entry)
+				log.Infof("incoming backend management command from %s to %s finished in %s", remote, c.LocalAddr().String(), time.Since(t1))
+				continue
+			}
+			isQueueCommand, qErr := ProcessQueueCommand(req.Command)
+			if isQueueCommand {
+				entry := NewAuditEntry(req, remote, l)
+				if qErr != nil {
+					rejectCommand(entry, qErr)
+					(&Response{Code: 400, Request: req, Error: qErr}).Send(c)
+					return false, qErr
+				}
+				auditCommand(entry)
+				continue
+			}
+			if req.Table != "" {
+				// bulk command with placeholders, expand it for all matching objects
+				backends, pErr := policy.AuthorizedBackends(req.AuthUser, sortedBackends(req.BackendsMap))
+				if pErr != nil {
+					log.Warnf("rejected command from %s to %s: %s", remote, c.LocalAddr().String(), pErr.Error())
+					rejectCommand(NewAuditEntry(req, remote, l), pErr)
+					(&Response{Code: 403, Request: req, Error: pErr}).Send(c)
+					return false, pErr
+				}
+				expanded, eErr := ExpandBulkCommand(req, backends)
+				if eErr != nil {
+					log.Warnf("rejected command from %s to %s: %s", remote, c.LocalAddr().String(), eErr.Error())
+					rejectCommand(NewAuditEntry(req, remote, l), eErr)
+					(&Response{Code: 500, Request: req, Error: eErr}).Send(c)
+					return false, eErr
+				}
+				if req.CommandDryRun {
+					if _, sErr := BulkCommandDryRun(req, expanded).Send(c); sErr != nil {
+						return false, sErr
+					}
+					continue
+				}
+				targets := sortedKeys(expanded)
+				num := 0
+				for _, pID := range targets {
+					for _, command := range expanded[pID] {
+						entry := NewAuditEntry(req, remote, l)
+						entry.Command = command
+						entry.Peers = []string{pID}
+						auditEntries = append(auditEntries, entry)
+						commandsByPeer[pID] = append(commandsByPeer[pID], command)
+						num++
+					}
+				}
+				log.Infof("expanded bulk command from %s to %d commands for %d backends", remote, num, len(targets))
+				if req.SendCommandResult {
+					results := SendCommands(&commandsByPeer, auditEntries)
+					commandsByPeer = make(map[string][]string)
+					auditEntries = nil
+					if _, sErr := CommandResultResponse(req, targets, results, nil).Send(c); sErr != nil {
+						return false, sErr
+					}
+				}
+				continue
+			}
+			entry := NewAuditEntry(req, remote, l)
+			targets, pErr := policy.AuthorizedBackends(req.AuthUser, RouteCommand(req.Command, req.BackendsMap))
+			if pErr != nil {
+				log.Warnf("rejected command from %s to %s: %s", remote, c.LocalAddr().String(), pErr.Error())
+				rejectCommand(entry, pErr)
+				(&Response{Code: 403, Request: req, Error: pErr}).Send(c)
+				return false, pErr
+			}
+			entry.Peers = targets
+			if req.SendCommandResult {
+				// send pending commands first to keep the order
+				if len(commandsByPeer) > 0 {
+					SendCommands(&commandsByPeer, auditEntries)
+					commandsByPeer = make(map[string][]string)
+					auditEntries = nil
+				}
+				size, sErr := SendCommandWithResults(req, targets, entry).Send(c)
+				log.Infof("incoming command request from %s to %s finished in %s, size: %.3f kB", remote, c.LocalAddr().String(), time.Since(t1), float64(size)/1024)
+				if sErr != nil {
+					return false, sErr
+				}
+				continue
+			}
+			auditEntries = append(auditEntries, entry)
+			for _, pID := range targets {
 				commandsByPeer[pID] = append(commandsByPeer[pID], strings.TrimSpace(req.Command))
 			}
 		} else {
 			// send all pending commands so far
 			if len(commandsByPeer) > 0 {
-				SendCommands(&commandsByPeer)
+				SendCommands(&commandsByPeer, auditEntries)
 				commandsByPeer = make(map[string][]string)
+				auditEntries = nil
 				log.Infof("incoming command request from %s to %s finished in %s", remote, c.LocalAddr().String(), time.Since(t1))
 			}
 			if req.WaitTrigger != "" {
@@ -119,7 +331,14 @@ func ProcessRequests(reqs []*Request, c net.Conn, remote string) (bool, error) {
 			if req.Table == "log" {
 				c.SetDeadline(time.Now().Add(time.Duration(60) * time.Second))
 			}
+			release, qErr := currentQueryScheduler().Acquire(schedulerClient(remote, user))
+			if qErr != nil {
+				log.Warnf("rejected request from %s to %s: %s", remote, c.LocalAddr().String(), qErr.Error())
+				(&Response{Code: schedulerErrorCode(qErr), Request: req, Error: qErr}).Send(c)
+				return false, qErr
+			}
 			response, rErr := req.GetResponse()
+			release()
 			if rErr != nil {
 				if netErr, ok := rErr.(net.Error); ok {
 					(&Response{Code: 500, Request: req, Error: netErr}).Send(c)
@@ -144,28 +363,79 @@ func ProcessRequests(reqs []*Request, c net.Conn, remote string) (bool, error) {
 	// send all remaining commands
 	if len(commandsByPeer) > 0 {
 		t1 := time.Now()
-		SendCommands(&commandsByPeer)
+		SendCommands(&commandsByPeer, auditEntries)
 		log.Infof("incoming command request from %s to %s finished in %s", remote, c.LocalAddr().String(), time.Since(t1))
 	}
 
 	return reqs[len(reqs)-1].KeepAlive, nil
 }
 
+// rejectCommand writes a rejected command to the audit log.
+func rejectCommand(entry *AuditEntry, err error) {
+	entry.Error = err.Error()
+	auditCommand(entry)
+}
+
 // SendCommands sends commands for this request to all selected remote sites.
-// It returns any error encountered.
-func SendCommands(commandsByPeer *map[string][]string) {
+// In cluster mode, commands for backends owned by other nodes are forwarded to these nodes.
+// The audit entries will be written once all peers have answered.
+// It returns the result for each peer which answered within 10 seconds.
+func SendCommands(commandsByPeer *map[string][]string, auditEntries []*AuditEntry) map[string]error {
+	return sendCommands(commandsByPeer, auditEntries, true)
+}
+
+// sendCommands sends the commands and forwards commands for backends of other
+// cluster nodes if forward is set. Forwarded commands are never forwarded again.
+func sendCommands(commandsByPeer *map[string][]string, auditEntries []*AuditEntry, forward bool) map[string]error {
 	wg := &sync.WaitGroup{}
-	for pID := range *commandsByPeer {
+	resultsLock := &sync.Mutex{}
+	results := make(map[string]error)
+	localCommands := *commandsByPeer
+	if forward && nodeAccessor != nil && nodeAccessor.IsClustered() {
+		localCommands = make(map[string][]string)
+		remoteCommands := make(map[*NodeAddress]map[string][]string)
+		for pID, commands := range *commandsByPeer {
+			node := nodeAccessor.BackendNode(pID)
+			if node == nil {
+				localCommands[pID] = commands
+				continue
+			}
+			if _, ok := remoteCommands[node]; !ok {
+				remoteCommands[node] = make(map[string][]string)
+			}
+			remoteCommands[node][pID] = commands
+		}
+		for node, commands := range remoteCommands {
+			wg.Add(1)
+			go func(node *NodeAddress, commands map[string][]string) {
+				defer logPanicExit()
+				defer wg.Done()
+				nodeResults, _ := nodeAccessor.ForwardCommands(node, commands, auditEntries, 0)
+				resultsLock.Lock()
+				for id, err := range nodeResults {
+					results[id] = err
+				}
+				resultsLock.Unlock()
+			}(node, commands)
+		}
+	}
+	for pID := range localCommands {
 		PeerMapLock.RLock()
 		p := PeerMap[pID]
 		PeerMapLock.RUnlock()
+		if p == nil {
+			resultsLock.Lock()
+			results[pID] = fmt.Errorf("unknown backend")
+			resultsLock.Unlock()
+			continue
+		}
 		wg.Add(1)
 		go func(peer *Peer) {
 			// make sure we log panics properly
 			defer wg.Done()
 			defer logPanicExitPeer(peer)
 			commandRequest := &Request{
-				Command: strings.Join((*commandsByPeer)[peer.ID], "\n\n"),
+				Command: strings.Join(localCommands[peer.ID], "\n\n"),
 			}
 			peer.PeerLock.Lock()
 			peer.Status["LastQuery"] = time.Now().Unix()
@@ -174,19 +444,55 @@ func SendCommands(commandsByPeer *map[string][]string) {
 				log.Infof("[%s] switched back to normal update interval", peer.Name)
 			}
 			peer.PeerLock.Unlock()
-			_, err := peer.Query(commandRequest)
+			var err error
+			if commandQueue != nil && commandQueue.HasPending(peer.ID) {
+				// keep the order of commands
+				commandQueue.Add(peer.ID, localCommands[peer.ID], "waiting for previously queued commands")
+				err = fmt.Errorf("queued: waiting for previously queued commands")
+			} else {
+				_, err = peer.Query(commandRequest)
+				if err != nil {
+					log.Warnf("[%s] sending command failed: %s", peer.Name, err.Error())
+					// only unreachable backends are retried, rejections are returned right away
+					if commandQueue != nil && isConnectionError(err) {
+						commandQueue.Add(peer.ID, localCommands[peer.ID], err.Error())
+						err = fmt.Errorf("queued: %s", err.Error())
+					}
+				}
+			}
+			resultsLock.Lock()
+			results[peer.ID] = err
+			resultsLock.Unlock()
 			if err != nil {
-				log.Warnf("[%s] sending command failed: %s", peer.Name, err.Error())
 				return
 			}
-			log.Infof("[%s] send %d commands successfully.", peer.Name, len((*commandsByPeer)[peer.ID]))
+			log.Infof("[%s] send %d commands successfully.", peer.Name, len(localCommands[peer.ID]))
 
 			// schedule immediate update
 			peer.ScheduleImmediateUpdate()
 		}(p)
 	}
+	if len(auditEntries) > 0 {
+		go func() {
+			defer logPanicExit()
+			wg.Wait()
+			resultsLock.Lock()
+			defer resultsLock.Unlock()
+			for _, entry := range auditEntries {
+				entry.SetResults(results)
+				auditCommand(entry)
+			}
+		}()
+	}
 	// Wait up to 10 seconds for all commands being sent
-	waitTimeout(wg, 10)
+	waitTimeout(wg, 10*time.Second)
+	resultsLock.Lock()
+	defer resultsLock.Unlock()
+	finished := make(map[string]error, len(results))
+	for id, err := range results {
+		finished[id] = err
+	}
+	return finished
 }
 
 // Listen start listening the actual connection
@@ -199,6 +505,9 @@ func (l *Listener) Listen() {
 	}()
 	l.waitGroupDone.Add(1)
 	listen := l.ConnectionString
+	if err := l.checkOutputFormat(); err != nil {
+		log.Warnf("ignoring OutputFormat of listener %s: %s", listen, err.Error())
+	}
 	if strings.HasPrefix(listen, "https://") {
 		listen = strings.TrimPrefix(listen, "https://")
 		l.LocalListenerHTTP("https", listen)
@@ -222,10 +531,26 @@ func (l *Listener) Listen() {
 	}
 }
 
+// checkOutputFormat returns an error if the default output format is not supported by this type of listener.
+func (l *Listener) checkOutputFormat() error {
+	format := GetListenerConfig(l.LocalConfig, l.ConnectionString).OutputFormat
+	if format == "" {
+		return nil
+	}
+	if strings.HasPrefix(l.ConnectionString, "http://") || strings.HasPrefix(l.ConnectionString, "https://") {
+		if _, ok := restContentTypes[format]; !ok {
+			return fmt.Errorf("unsupported format %s, must be json, ndjson, csv or sse", format)
+		}
+		return nil
+	}
+	return parseOutputFormat(&format, format)
+}
+
 // LocalListenerLivestatus starts a listening socket with livestatus protocol.
 func (l *Listener) LocalListenerLivestatus(connType string, listen string) {
 	var err error
 	var c net.Listener
+	l.auth = GetAuthenticator(l.LocalConfig, l.ConnectionString)
 	if connType == "tls" {
 		tlsConfig, tErr := getTLSListenerConfig(l.LocalConfig)
 		if tErr != nil {
@@ -267,6 +592,7 @@ func (l *Listener) LocalListenerLivestatus(connType string, listen string) {
 		}
 
 		// background waiting for query to finish/timeout
+		timeout := GetListenerConfig(l.LocalConfig, l.ConnectionString).ConnectionTimeout()
 		go func() {
 			// process client request with a timeout
 
@@ -278,12 +604,12 @@ func (l *Listener) LocalListenerLivestatus(connType string, listen string) {
 				// make sure we log panics properly
 				defer logPanicExit()
 
-				ch <- QueryServer(fd)
+				ch <- QueryServer(fd, l)
 			}()
 			select {
 			case <-ch:
 			// request finishes normally
-			case <-time.After(time.Duration(l.LocalConfig.ListenTimeout) * time.Second):
+			case <-time.After(timeout):
 				localAddr := fd.LocalAddr().String()
 				remote := fd.RemoteAddr().String()
 				log.Warnf("client request from %s to %s timed out", remote, localAddr)
@@ -329,7 +655,7 @@ func (l *Listener) LocalListenerHTTP(httpType string, listen string) {
 	}()
 
 	// Initialize HTTP router
-	router, err := initializeHTTPRouter()
+	router, err := initializeHTTPRouter(l)
 	if err != nil {
 		log.Fatalf("error initializing http server: %s", err.Error())
 		return
@@ -338,10 +664,14 @@ func (l *Listener) LocalListenerHTTP(httpType string, listen string) {
 	l.waitGroupInit.Done()
 
 	// Wait for and handle http requests
+	// commands may wait up to CommandWait for their result, so writing the
+	// response is limited by the connection timeout of this listener
+	settings := GetListenerConfig(l.LocalConfig, l.ConnectionString)
 	server := &http.Server{
 		Handler:      router,
 		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Second,
+		WriteTimeout: settings.ConnectionTimeout(),
+		IdleTimeout:  time.Duration(settings.KeepAliveTimeout) * time.Second,
 	}
 	server.Serve(c)
 
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenerConfig(t *testing.T) {
+	ioutil.WriteFile("test1.ini", []byte("Listen = [\"test1.sock\"]\nListenTimeout = 30\n[[Listeners]]\nListen = \"test2.sock\"\nReadOnly = true\nIdleTimeout = 5\n"), 0644)
+	ioutil.WriteFile("test2.ini", []byte("[[Listeners]]\nListen = \"test1.sock\"\nMaxRows = 10\n"), 0644)
+	defer os.Remove("test1.ini")
+	defer os.Remove("test2.ini")
+
+	conf := ReadConfig([]string{"test1.ini", "test2.ini"})
+	if err := assertEq([]string{"test1.sock", "test2.sock"}, conf.Listen); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(2, len(conf.Listeners)); err != nil {
+		t.Error(err)
+	}
+
+	settings := GetListenerConfig(conf, "test2.sock")
+	if err := assertEq(5, settings.IdleTimeout); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(30, settings.KeepAliveTimeout); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(30*time.Second, settings.ConnectionTimeout()); err != nil {
+		t.Error(err)
+	}
+	// larger listener timeouts extend the connection timeout
+	conf.Listeners[0].KeepAliveTimeout = 300
+	if err := assertEq(300*time.Second, GetListenerConfig(conf, "test2.sock").ConnectionTimeout()); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(10, GetListenerConfig(conf, "test1.sock").MaxRows); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(30, GetListenerConfig(conf, "test3.sock").IdleTimeout); err != nil {
+		t.Error(err)
+	}
+	if !GetCommandPolicy(conf, "test2.sock").ReadOnly || GetCommandPolicy(conf, "test1.sock").ReadOnly {
+		t.Errorf("expected read-only command policy for test2.sock only")
+	}
+}
+
+// listenerTestQuery sends a query to the livestatus socket and returns the response.
+func listenerTestQuery(t *testing.T, socket string, query string) string {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte(query))
+	// commands are read till the end of input
+	conn.(*net.UnixConn).CloseWrite()
+	res, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(res)
+}
+
+func TestListenerRestrictions(t *testing.T) {
+	extraConfig := `
+Listen = ["test.sock"]
+
+[[Listeners]]
+Listen       = "test_restricted.sock"
+ReadOnly     = true
+Tables       = ["hosts"]
+Backends     = ["mockid0"]
+OutputFormat = "wrapped_json"
+MaxRows      = 3
+`
+	peer := StartTestPeerExtra(2, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+
+	res := listenerTestQuery(t, "test_restricted.sock", "GET hosts\nColumns: name peer_key\nResponseHeader: fixed16\n\n")
+	if err := assertEq("200", res[0:3]); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(res, `{"data":`) || strings.Contains(res, "mockid1") {
+		t.Errorf("expected wrapped json from mockid0 only: %s", res)
+	}
+	if err := assertEq(3, strings.Count(res, "testhost_")); err != nil {
+		t.Error(err)
+	}
+
+	res = listenerTestQuery(t, "test_restricted.sock", "GET services\nResponseHeader: fixed16\n\n")
+	if err := assertEq("403", res[0:3]); err != nil {
+		t.Error(err)
+	}
+	res = listenerTestQuery(t, "test_restricted.sock", "GET hosts\nBackends: mockid1\nResponseHeader: fixed16\n\n")
+	if err := assertEq("403", res[0:3]); err != nil {
+		t.Error(err)
+	}
+	res = listenerTestQuery(t, "test_restricted.sock", "COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0\n\n")
+	if err := assertEq("forbidden: commands are not allowed on this listener\n", res); err != nil {
+		t.Error(err)
+	}
+
+	// other listeners are not restricted
+	res = listenerTestQuery(t, "test.sock", "GET services\nColumns: host_name\nResponseHeader: fixed16\n\n")
+	if err := assertEq("200", res[0:3]); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestListenerRestrictionsHTTP(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	listener := &Listener{
+		ConnectionString: "http://127.0.0.1:8903",
+		LocalConfig: &Config{
+			Listeners: []ListenerConfig{
+				{Listen: "http://127.0.0.1:8903", Tables: []string{"hosts"}, OutputFormat: "csv", MaxRows: 2},
+			},
+		},
+	}
+	handler, _ := initializeHTTPRouter(listener)
+
+	rec := restTestRequest(handler, "/v1/hosts?columns=name", "*/*")
+	if err := assertEq("text/csv", rec.Header().Get("Content-Type")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("name\ntesthost_1\ntesthost_2\n", rec.Body.String()); err != nil {
+		t.Error(err)
+	}
+	rec = restTestRequest(handler, "/v1/hosts?columns=name&limit=1", "application/json")
+	data, _ := restTestResult(t, rec)
+	if err := assertEq(1, len(data)); err != nil {
+		t.Error(err)
+	}
+	rec = restTestRequest(handler, "/v1/services?columns=description", "")
+	if err := assertEq(http.StatusForbidden, rec.Code); err != nil {
+		t.Error(err)
+	}
+
+	// only verified node requests are not restricted
+	secret := nodeAccessor.secret
+	nodeAccessor.secret = "secret"
+	defer func() { nodeAccessor.secret = secret }()
+	body := `{"_name":"table","table":"services","columns":["description"],"protocol":3}`
+	for _, signed := range []bool{false, true} {
+		req := httptest.NewRequest("POST", "/query", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		code := http.StatusForbidden
+		if signed {
+			setNodeRequestSignature(req, "secret", []byte(body))
+			code = http.StatusOK
+		}
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if err := assertEq(code, rec.Code); err != nil {
+			t.Errorf("signed node request %v: %s", signed, err.Error())
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
@@ -58,6 +58,17 @@ type Connection struct {
 	TLSKey         string
 	TLSCA          string
 	TLSSkipVerify  int
+	Tags           []string
+	// optional per connection overrides, zero values inherit the global settings
+	UpdateInterval      int64
+	FullUpdateInterval  int64
+	IdleTimeout         int64
+	IdleInterval        int64
+	ConnectTimeout      int
+	NetTimeout          int
+	StaleBackendTimeout int
+	// optional cost hint for distributing backends in cluster mode, ex. the number of services
+	Cost int
 }
 
 // Equals checks if two connection objects are identical.
@@ -71,14 +82,58 @@ func (c *Connection) Equals(other *Connection) bool {
 	equal = equal && c.TLSKey == other.TLSKey
 	equal = equal && c.TLSCA == other.TLSCA
 	equal = equal && c.TLSSkipVerify == other.TLSSkipVerify
+	equal = equal && c.UpdateInterval == other.UpdateInterval
+	equal = equal && c.FullUpdateInterval == other.FullUpdateInterval
+	equal = equal && c.IdleTimeout == other.IdleTimeout
+	equal = equal && c.IdleInterval == other.IdleInterval
+	equal = equal && c.ConnectTimeout == other.ConnectTimeout
+	equal = equal && c.NetTimeout == other.NetTimeout
+	equal = equal && c.StaleBackendTimeout == other.StaleBackendTimeout
+	equal = equal && c.Cost == other.Cost
 	equal = equal && strings.Join(c.Source, ":") == strings.Join(other.Source, ":")
+	equal = equal && strings.Join(c.Tags, ":") == strings.Join(other.Tags, ":")
 	return equal
 }
 
+// setDefaults fills all unset timing options from the global configuration.
+// A negative FullUpdateInterval disables full updates for this connection.
+func (c *Connection) setDefaults(conf *Config) {
+	if c.UpdateInterval <= 0 {
+		c.UpdateInterval = conf.Updateinterval
+	}
+	if c.FullUpdateInterval == 0 {
+		c.FullUpdateInterval = conf.FullUpdateInterval
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = conf.IdleTimeout
+	}
+	if c.IdleInterval <= 0 {
+		c.IdleInterval = conf.IdleInterval
+	}
+	if c.ConnectTimeout <= 0 {
+		c.ConnectTimeout = conf.ConnectTimeout
+	}
+	if c.NetTimeout <= 0 {
+		c.NetTimeout = conf.NetTimeout
+	}
+	if c.StaleBackendTimeout <= 0 {
+		c.StaleBackendTimeout = conf.StaleBackendTimeout
+	}
+}
+
 // Config defines the available configuration options from supplied config files.
 type Config struct {
 	Listen              []string
+	Listeners           []ListenerConfig
 	Nodes               []string
+	NodeWeight          int
+	ClusterReplication  bool
+	ClusterSecret       string
+	NodeSeeds           []string
+	AdvertiseAddress    string
+	ClusterQuorum       int
+	NodeDeadTimeout     int64
+	NodeTimeout         int
 	TLSCertificate      string
 	TLSKey              string
 	TLSClientPems       []string
@@ -90,11 +145,30 @@ type Config struct {
 	ConnectTimeout      int
 	NetTimeout          int
 	ListenTimeout       int
+	MaxQueries          int
+	QueryQueueTimeout   int
+	QueryRateLimit      float64
+	QueryRateBurst      int
 	ListenPrometheus    string
 	SkipSSLCheck        int
 	IdleTimeout         int64
 	IdleInterval        int64
 	StaleBackendTimeout int
+	Include             []string
+	CommandAllow        []string
+	CommandDeny         []string
+	RequireAuthUser     bool
+	Users               []ListenerUser
+	AuditLog            string
+	AuditLogMaxSize     int
+	AuditLogMaxFiles    int
+	CommandQueueFile    string
+	CommandQueueMaxAge  int64
+	CommandQueueRetry   int64
+	ManagementKey       string
+	BackendsFile        string
+	Webhooks            []Webhook
+	runtimeBackends     *RuntimeBackends
 }
 
 // PeerMap contains a map of available remote peers.
@@ -187,10 +261,14 @@ func main() {
 }
 
 func mainLoop(mainSignalChannel chan os.Signal) (exitCode int) {
-	LocalConfig := *(ReadConfig(flagConfigFile))
-	setDefaults(&LocalConfig)
-	setVerboseFlags(&LocalConfig)
-	InitLogging(&LocalConfig)
+	LocalConfig := ReadConfig(flagConfigFile)
+	setDefaults(LocalConfig)
+	setVerboseFlags(LocalConfig)
+	InitLogging(LocalConfig)
+	initAuditLog(LocalConfig)
+	initCommandQueue(LocalConfig)
+	initWebhooks(LocalConfig)
+	initQueryScheduler(LocalConfig)
 
 	osSignalChannel := make(chan os.Signal, 1)
 	signal.Notify(osSignalChannel, syscall.SIGHUP)
@@ -220,16 +298,20 @@ func mainLoop(mainSignalChannel chan os.Signal) (exitCode int) {
 	}
 
 	// initialize prometheus
-	prometheusListener := initPrometheus(&LocalConfig)
+	prometheusListener := initPrometheus(LocalConfig)
 
 	// start local listeners
-	initializeListeners(&LocalConfig, waitGroupListener, waitGroupInit, shutdownChannel)
+	initializeListeners(LocalConfig, waitGroupListener, waitGroupInit, shutdownChannel)
 
 	// start remote connections
-	initializePeers(&LocalConfig, waitGroupPeers, waitGroupInit, shutdownChannel)
+	initializePeers(LocalConfig, waitGroupPeers, waitGroupInit, shutdownChannel)
 
 	once.Do(PrintVersion)
 
+	// watch config fragments from Include
+	includeWatcher := startIncludeWatcher(LocalConfig)
+	defer func() { includeWatcher.Stop() }()
+
 	// just wait till someone hits ctrl+c or we have to reload
 	for {
 		select {
@@ -239,6 +321,13 @@ func mainLoop(mainSignalChannel chan os.Signal) (exitCode int) {
 			mainSignalHandler(sig, shutdownChannel, waitGroupPeers, waitGroupListener, prometheusListener)
 		case sig := <-mainSignalChannel:
 			return mainSignalHandler(sig, shutdownChannel, waitGroupPeers, waitGroupListener, prometheusListener)
+		case <-includeWatcher.Changes():
+			newConfig := applyIncludeChanges(LocalConfig, waitGroupListener, waitGroupPeers, waitGroupInit, shutdownChannel)
+			if newConfig != LocalConfig {
+				LocalConfig = newConfig
+				includeWatcher.Stop()
+				includeWatcher = startIncludeWatcher(LocalConfig)
+			}
 		}
 	}
 }
@@ -322,7 +411,7 @@ func initializePeers(LocalConfig *Config, waitGroupPeers *sync.WaitGroup, waitGr
 		c := LocalConfig.Connections[i]
 		// Keep peer if connection settings unchanged
 		var p *Peer
-		PeerMapLock.RLock()
+		PeerMapLock.Lock()
 		if v, ok := PeerMap[c.ID]; ok {
 			if c.Equals(v.Config) {
 				p = v
@@ -331,9 +420,13 @@ func initializePeers(LocalConfig *Config, waitGroupPeers *sync.WaitGroup, waitGr
 				p.shutdownChannel = shutdownChannel
 				p.LocalConfig = LocalConfig
 				p.PeerLock.Unlock()
+			} else {
+				// Stop the old peer, it will be replaced by a new one
+				log.Infof("[%s] connection settings changed, restarting peer", v.Name)
+				PeerMapStop(c.ID)
 			}
 		}
-		PeerMapLock.RUnlock()
+		PeerMapLock.Unlock()
 
 		// Create new peer otherwise
 		if p == nil {
@@ -348,6 +441,15 @@ func initializePeers(LocalConfig *Config, waitGroupPeers *sync.WaitGroup, waitGr
 		}
 		backends = append(backends, c.ID)
 
+		// Restore paused state from runtime changes
+		if LocalConfig.runtimeBackends != nil {
+			paused := LocalConfig.runtimeBackends.IsPaused(c.ID)
+			p.StatusSet("Paused", paused)
+			if paused && p.StatusGet("Updating").(bool) {
+				p.Stop()
+			}
+		}
+
 		// Put new or modified peer in map
 		PeerMapNew[c.ID] = p
 		PeerMapOrderNew = append(PeerMapOrderNew, c.ID)
@@ -359,6 +461,9 @@ func initializePeers(LocalConfig *Config, waitGroupPeers *sync.WaitGroup, waitGr
 	PeerMap = PeerMapNew
 	PeerMapLock.Unlock()
 
+	// Runtime backend management
+	backendManager = NewBackendManager(LocalConfig, waitGroupPeers, shutdownChannel)
+
 	// Node accessor
 	nodeAddresses := LocalConfig.Nodes
 	nodeAccessor = NewNodes(LocalConfig, nodeAddresses, nodeListenAddress, waitGroupInit, shutdownChannel)
@@ -535,6 +640,12 @@ func setDefaults(conf *Config) {
 	if conf.ListenTimeout <= 0 {
 		conf.ListenTimeout = 60
 	}
+	if conf.QueryQueueTimeout <= 0 {
+		conf.QueryQueueTimeout = 10
+	}
+	if conf.NodeTimeout <= 0 {
+		conf.NodeTimeout = 10
+	}
 	if conf.Updateinterval <= 0 {
 		conf.Updateinterval = 5
 	}
@@ -550,6 +661,18 @@ func setDefaults(conf *Config) {
 	if conf.StaleBackendTimeout <= 0 {
 		conf.StaleBackendTimeout = 30
 	}
+	if conf.AuditLogMaxFiles <= 0 {
+		conf.AuditLogMaxFiles = 5
+	}
+	if conf.CommandQueueMaxAge <= 0 {
+		conf.CommandQueueMaxAge = 86400
+	}
+	if conf.CommandQueueRetry <= 0 {
+		conf.CommandQueueRetry = 10
+	}
+	for i := range conf.Connections {
+		conf.Connections[i].setDefaults(conf)
+	}
 }
 
 // PrintVersion prints the version
@@ -560,30 +683,114 @@ func PrintVersion() {
 // ReadConfig reads all config files.
 // It returns a Config object.
 func ReadConfig(files []string) (conf *Config) {
+	conf, fragmentErrors, err := readConfigFiles(files)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\nuse --help to see all options.\n", err.Error())
+		os.Exit(3)
+	}
+	for _, fErr := range fragmentErrors {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", fErr.Error())
+	}
+
+	promPeerUpdateInterval.Set(float64(conf.Updateinterval))
+
+	return
+}
+
+// readConfigFiles reads all config files, include fragments and runtime backend changes.
+// Broken config files are returned as error, broken fragments are skipped and returned as fragmentErrors.
+func readConfigFiles(files []string) (conf *Config, fragmentErrors []error, err error) {
+	conf = &Config{}
+
 	// combine listeners from all files
 	var allListeners []string
+	var allListenerConfigs []ListenerConfig
 
 	for _, configFile := range files {
-		if _, err := os.Stat(configFile); err != nil {
-			fmt.Fprintf(os.Stderr, "ERROR: could not load configuration from %s: %s\nuse --help to see all options.\n", configFile, err.Error())
-			os.Exit(3)
+		if _, err = os.Stat(configFile); err != nil {
+			err = fmt.Errorf("could not load configuration from %s: %s", configFile, err.Error())
+			return
 		}
-		if _, err := toml.DecodeFile(configFile, &conf); err != nil {
-			panic(err)
+		if _, err = toml.DecodeFile(configFile, conf); err != nil {
+			err = fmt.Errorf("could not parse configuration from %s: %s", configFile, err.Error())
+			return
 		}
 		allListeners = append(allListeners, conf.Listen...)
 		conf.Listen = []string{}
+		allListenerConfigs = append(allListenerConfigs, conf.Listeners...)
+		conf.Listeners = []ListenerConfig{}
 	}
 	if flagLogFile != "" {
 		conf.LogFile = flagLogFile
 	}
 	conf.Listen = allListeners
+	conf.Listeners = allListenerConfigs
 
-	promPeerUpdateInterval.Set(float64(conf.Updateinterval))
+	// structured listeners will be started just like the plain ones
+	for _, settings := range conf.Listeners {
+		found := false
+		for _, listen := range conf.Listen {
+			if listen == settings.Listen {
+				found = true
+				break
+			}
+		}
+		if !found {
+			conf.Listen = append(conf.Listen, settings.Listen)
+		}
+	}
+
+	// add connections from config fragments
+	fragmentErrors = conf.readIncludes()
+
+	// apply backends changed at runtime
+	if conf.BackendsFile != "" {
+		runtimeBackends, rErr := ReadRuntimeBackends(conf.BackendsFile)
+		if rErr != nil {
+			fragmentErrors = append(fragmentErrors, fmt.Errorf("could not load backends from %s: %s", conf.BackendsFile, rErr.Error()))
+		} else {
+			conf.runtimeBackends = runtimeBackends
+			conf.Connections = runtimeBackends.Apply(conf.Connections)
+		}
+	}
 
 	return
 }
 
+// applyIncludeChanges reloads the configuration after config fragments have changed.
+// Only changed listeners and peers will be restarted. The running configuration
+// stays in place if any file or fragment is invalid.
+func applyIncludeChanges(LocalConfig *Config, waitGroupListener *sync.WaitGroup, waitGroupPeers *sync.WaitGroup, waitGroupInit *sync.WaitGroup, shutdownChannel chan bool) *Config {
+	newConfig, fragmentErrors, err := readConfigFiles(flagConfigFile)
+	for _, fErr := range fragmentErrors {
+		log.Errorf("%s", fErr.Error())
+		err = fErr
+	}
+	if err == nil {
+		setDefaults(newConfig)
+		setVerboseFlags(newConfig)
+		if len(newConfig.Connections) == 0 {
+			err = fmt.Errorf("no connections defined")
+		} else if len(newConfig.Listen) == 0 {
+			err = fmt.Errorf("no listeners defined")
+		}
+	}
+	if err != nil {
+		log.Errorf("config fragments rejected, keeping current configuration: %s", err.Error())
+		return LocalConfig
+	}
+
+	log.Infof("config fragments changed, reloading configuration...")
+	if nodeAccessor != nil && nodeAccessor.IsClustered() {
+		nodeAccessor.Stop()
+	}
+	initializeListeners(newConfig, waitGroupListener, waitGroupInit, shutdownChannel)
+	initializePeers(newConfig, waitGroupPeers, waitGroupInit, shutdownChannel)
+	promPeerUpdateInterval.Set(float64(newConfig.Updateinterval))
+
+	return newConfig
+}
+
 func logPanicExit() {
 	if r := recover(); r != nil {
 		log.Errorf("Panic: %s", r)
@@ -610,3 +817,28 @@ func PeerMapRemove(peerID string) {
 	}
 	delete(PeerMap, peerID)
 }
+
+// PeerMapStop stops a peer and its sub peers and removes them from the PeerMap.
+// PeerMapLock must be held.
+func PeerMapStop(peerID string) {
+	p, ok := PeerMap[peerID]
+	if !ok {
+		return
+	}
+	p.Stop()
+	p.Clear()
+	PeerMapRemove(peerID)
+	PeerMapRemoveSubPeers(peerID)
+}
+
+// PeerMapRemoveSubPeers stops the sub peers of a federated lmd or http backend and removes them from the PeerMap.
+// PeerMapLock must be held.
+func PeerMapRemoveSubPeers(parentID string) {
+	for subID, subPeer := range PeerMap {
+		if subPeer.ParentID == parentID {
+			subPeer.Stop()
+			subPeer.Clear()
+			PeerMapRemove(subID)
+		}
+	}
+}
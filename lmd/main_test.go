@@ -203,3 +203,179 @@ func TestMainConfig(t *testing.T) {
 	os.Remove("test2.ini")
 	os.Remove("test3.ini")
 }
+
+func TestMainConfigConnectionDefaults(t *testing.T) {
+	conf := &Config{
+		Updateinterval: 7,
+		NetTimeout:     90,
+		Connections: []Connection{
+			{ID: "id1", Name: "local", Source: []string{"/tmp/live.sock"}},
+			{ID: "id2", Name: "vpn", Source: []string{"10.0.0.1:6557"}, UpdateInterval: 60, NetTimeout: 300, FullUpdateInterval: -1},
+		},
+	}
+	setDefaults(conf)
+
+	if err := assertEq(int64(7), conf.Connections[0].UpdateInterval); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(90, conf.Connections[0].NetTimeout); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(int64(60), conf.Connections[1].UpdateInterval); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(300, conf.Connections[1].NetTimeout); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(int64(-1), conf.Connections[1].FullUpdateInterval); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(conf.StaleBackendTimeout, conf.Connections[1].StaleBackendTimeout); err != nil {
+		t.Error(err)
+	}
+
+	// changing the global default must only affect inheriting connections
+	changed := &Config{Updateinterval: 10, NetTimeout: 90}
+	setDefaults(changed)
+	con1 := Connection{ID: "id1", Name: "local", Source: []string{"/tmp/live.sock"}}
+	con1.setDefaults(changed)
+	con2 := Connection{ID: "id2", Name: "vpn", Source: []string{"10.0.0.1:6557"}, UpdateInterval: 60, NetTimeout: 300, FullUpdateInterval: -1}
+	con2.setDefaults(changed)
+	if con1.Equals(&conf.Connections[0]) {
+		t.Errorf("connection with inherited update interval should have changed")
+	}
+	if !con2.Equals(&conf.Connections[1]) {
+		t.Errorf("connection with own update interval should not have changed")
+	}
+}
+
+func TestMainConfigInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmd-conf.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile("test1.ini", []byte(fmt.Sprintf("Include = [\"%s/*.ini\"]\n[[Connections]]\nid = \"id1\"\nsource = [\"/tmp/live1.sock\"]\n", dir)), 0644)
+	defer os.Remove("test1.ini")
+	ioutil.WriteFile(dir+"/site2.ini", []byte("[[Connections]]\nid = \"id2\"\nsource = [\"/tmp/live2.sock\"]\n"), 0644)
+	ioutil.WriteFile(dir+"/site3.ini", []byte("[[Connections]]\nid = \"id3\"\nsource = [\"/tmp/live3.sock\"]\n"), 0644)
+
+	conf, fragmentErrors, err := readConfigFiles([]string{"test1.ini"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(0, len(fragmentErrors)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(3, len(conf.Connections)); err != nil {
+		t.Error(err)
+	}
+
+	// broken, duplicate and unsupported fragments are skipped
+	ioutil.WriteFile(dir+"/broken.ini", []byte("[[Connections]\n"), 0644)
+	ioutil.WriteFile(dir+"/duplicate.ini", []byte("[[Connections]]\nid = \"id1\"\nsource = [\"/tmp/live4.sock\"]\n"), 0644)
+	ioutil.WriteFile(dir+"/listen.ini", []byte("Listen = [\"test.sock\"]\n"), 0644)
+	conf, fragmentErrors, err = readConfigFiles([]string{"test1.ini"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(3, len(fragmentErrors)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(3, len(conf.Connections)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMainIncludeReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmd-conf.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(interval, debounce time.Duration) {
+		includeWatchInterval = interval
+		includeDebounce = debounce
+	}(includeWatchInterval, includeDebounce)
+	includeWatchInterval = 50 * time.Millisecond
+	includeDebounce = 200 * time.Millisecond
+
+	peer := StartTestPeerExtra(1, 10, 10, fmt.Sprintf("Include = [\"%s/*.ini\"]\n", dir))
+
+	mock := StartMockLivestatusSource(1, 10, 10)
+	ioutil.WriteFile(dir+"/site2.ini", []byte(fmt.Sprintf("[[Connections]]\nname = \"Site 2\"\nid = \"site2\"\nsource = [\"%s\"]\n", mock)), 0644)
+	if err = waitForBackends(peer, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// changed fragments replace the peer and stop the old one
+	oldPeer := testPeerMapGet("site2")
+	ioutil.WriteFile(dir+"/site2.ini", []byte(fmt.Sprintf("[[Connections]]\nname = \"Site 2 changed\"\nid = \"site2\"\nsource = [\"%s\"]\n", mock)), 0644)
+	if err = waitForReplacedPeer(oldPeer); err != nil {
+		t.Fatal(err)
+	}
+	if err = waitForBackends(peer, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// a changed update interval restarts only the affected peer
+	mainPeer := testPeerMapGet("mockid0")
+	oldPeer = testPeerMapGet("site2")
+	ioutil.WriteFile(dir+"/site2.ini", []byte(fmt.Sprintf("[[Connections]]\nname = \"Site 2 changed\"\nid = \"site2\"\nsource = [\"%s\"]\nUpdateInterval = 3\n", mock)), 0644)
+	if err = waitForReplacedPeer(oldPeer); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(int64(3), testPeerMapGet("site2").Config.UpdateInterval); err != nil {
+		t.Error(err)
+	}
+	if testPeerMapGet("mockid0") != mainPeer {
+		t.Errorf("unchanged peer should not be restarted")
+	}
+	if err = waitForBackends(peer, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// invalid fragments keep the running configuration
+	ioutil.WriteFile(dir+"/broken.ini", []byte("[[Connections]\n"), 0644)
+	time.Sleep(500 * time.Millisecond)
+	res, err := peer.QueryString("GET backends\nColumns: peer_key\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func testPeerMapGet(id string) *Peer {
+	PeerMapLock.RLock()
+	defer PeerMapLock.RUnlock()
+	return PeerMap[id]
+}
+
+// waitForReplacedPeer waits till the given peer has been replaced in the PeerMap and stopped updating.
+func waitForReplacedPeer(p *Peer) error {
+	for retries := 0; retries < 100; retries++ {
+		if testPeerMapGet(p.ID) != p && !p.StatusGet("Updating").(bool) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("peer %s is still updating", p.ID)
+}
+
+// waitForStoppedPeer waits till the update loop of the given peer has stopped.
+func waitForStoppedPeer(p *Peer) error {
+	for retries := 0; retries < 100; retries++ {
+		if !p.StatusGet("Updating").(bool) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("peer %s is still updating", p.ID)
+}
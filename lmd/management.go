@@ -0,0 +1,478 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+var reManagementCommand = regexp.MustCompile(`^COMMAND \[\d+\] LMD_(ADD|UPDATE|REMOVE|PAUSE|RESUME)_BACKEND;(.*)$`)
+var reManagementKey = regexp.MustCompile(`(LMD_(?:ADD|UPDATE|REMOVE|PAUSE|RESUME)_BACKEND;)[^;]*`)
+
+// errManagementDenied is returned if a management request is not authorized.
+var errManagementDenied = errors.New("forbidden: backend management is disabled or key does not match")
+
+// RuntimeBackends contains all backend changes made at runtime.
+// It is persisted in the BackendsFile and applied on top of the configured connections.
+type RuntimeBackends struct {
+	Connections []Connection
+	Removed     []string
+	Paused      []string
+}
+
+// BackendManager adds, updates, removes, pauses and resumes backend connections at runtime.
+type BackendManager struct {
+	noCopy          noCopy
+	LocalConfig     *Config
+	waitGroupPeers  *sync.WaitGroup
+	shutdownChannel chan bool
+	lock            *LoggingLock
+}
+
+// backendManager is the runtime backend manager for the current main loop.
+var backendManager *BackendManager
+
+// NewBackendManager creates a new BackendManager.
+func NewBackendManager(LocalConfig *Config, waitGroupPeers *sync.WaitGroup, shutdownChannel chan bool) *BackendManager {
+	m := &BackendManager{
+		LocalConfig:     LocalConfig,
+		waitGroupPeers:  waitGroupPeers,
+		shutdownChannel: shutdownChannel,
+		lock:            NewLoggingLock("BackendManagerLock"),
+	}
+	return m
+}
+
+// CheckKey returns true if the given key matches the configured ManagementKey.
+func (m *BackendManager) CheckKey(key string) bool {
+	if m.LocalConfig.ManagementKey == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(m.LocalConfig.ManagementKey)) == 1
+}
+
+// Connections returns a copy of all currently configured connections.
+func (m *BackendManager) Connections() []Connection {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	connections := make([]Connection, len(m.LocalConfig.Connections))
+	copy(connections, m.LocalConfig.Connections)
+	return connections
+}
+
+// Add creates and starts a new backend connection.
+// In cluster mode, the backend is added on all other nodes as well.
+func (m *BackendManager) Add(con *Connection) error {
+	persisted := *con
+	if err := m.add(con); err != nil {
+		return err
+	}
+	return m.propagate("add", map[string]interface{}{"connection": &persisted})
+}
+
+func (m *BackendManager) add(con *Connection) error {
+	if err := m.validate(con); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	PeerMapLock.RLock()
+	_, exists := PeerMap[con.ID]
+	PeerMapLock.RUnlock()
+	if exists {
+		return fmt.Errorf("bad request: backend %s does already exist", con.ID)
+	}
+
+	persisted := *con
+	p := NewPeer(m.LocalConfig, con, m.waitGroupPeers, m.shutdownChannel)
+	PeerMapLock.Lock()
+	PeerMap[con.ID] = p
+	PeerMapOrder = append(PeerMapOrder, con.ID)
+	PeerMapLock.Unlock()
+	m.LocalConfig.Connections = append(m.LocalConfig.Connections, *con)
+	log.Infof("[%s] backend added at runtime", p.Name)
+
+	m.updateNodes()
+	return m.persist(func(r *RuntimeBackends) {
+		r.set(&persisted)
+	})
+}
+
+// Update replaces an existing backend connection. The peer will only be restarted if the
+// connection settings did change. In cluster mode, the backend is updated on all other nodes as well.
+func (m *BackendManager) Update(con *Connection) error {
+	persisted := *con
+	if err := m.update(con); err != nil {
+		return err
+	}
+	return m.propagate("update", map[string]interface{}{"connection": &persisted})
+}
+
+func (m *BackendManager) update(con *Connection) error {
+	if err := m.validate(con); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	PeerMapLock.RLock()
+	oldPeer, exists := PeerMap[con.ID]
+	PeerMapLock.RUnlock()
+	if !exists {
+		return fmt.Errorf("bad request: backend %s does not exist", con.ID)
+	}
+
+	persisted := *con
+	con.setDefaults(m.LocalConfig)
+	if con.Equals(oldPeer.Config) {
+		log.Debugf("[%s] backend unchanged", oldPeer.Name)
+		return nil
+	}
+
+	p := NewPeer(m.LocalConfig, con, m.waitGroupPeers, m.shutdownChannel)
+	p.Status["Paused"] = oldPeer.StatusGet("Paused").(bool)
+	PeerMapLock.Lock()
+	oldPeer.Stop()
+	oldPeer.Clear()
+	PeerMapRemoveSubPeers(con.ID)
+	PeerMap[con.ID] = p
+	PeerMapLock.Unlock()
+	for i := range m.LocalConfig.Connections {
+		if m.LocalConfig.Connections[i].ID == con.ID {
+			m.LocalConfig.Connections[i] = *con
+		}
+	}
+	log.Infof("[%s] backend updated at runtime", p.Name)
+
+	m.updateNodes()
+	return m.persist(func(r *RuntimeBackends) {
+		r.set(&persisted)
+	})
+}
+
+// Remove stops and removes a backend connection.
+// In cluster mode, the backend is removed from all other nodes as well.
+func (m *BackendManager) Remove(id string) error {
+	if err := m.remove(id); err != nil {
+		return err
+	}
+	return m.propagate("remove", map[string]interface{}{"id": id})
+}
+
+func (m *BackendManager) remove(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	PeerMapLock.Lock()
+	p, exists := PeerMap[id]
+	if !exists {
+		PeerMapLock.Unlock()
+		return fmt.Errorf("bad request: backend %s does not exist", id)
+	}
+	PeerMapStop(id)
+	PeerMapLock.Unlock()
+
+	connections := make([]Connection, 0, len(m.LocalConfig.Connections))
+	for i := range m.LocalConfig.Connections {
+		if m.LocalConfig.Connections[i].ID != id {
+			connections = append(connections, m.LocalConfig.Connections[i])
+		}
+	}
+	m.LocalConfig.Connections = connections
+	log.Infof("[%s] backend removed at runtime", p.Name)
+
+	m.updateNodes()
+	return m.persist(func(r *RuntimeBackends) {
+		r.remove(id)
+	})
+}
+
+// Pause stops updating a backend but keeps its configuration.
+func (m *BackendManager) Pause(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, err := m.getPeer(id)
+	if err != nil {
+		return err
+	}
+	p.StatusSet("Paused", true)
+	p.Stop()
+	log.Infof("[%s] backend paused", p.Name)
+
+	return m.persist(func(r *RuntimeBackends) {
+		r.setPaused(id, true)
+	})
+}
+
+// Resume starts a previously paused backend again.
+func (m *BackendManager) Resume(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, err := m.getPeer(id)
+	if err != nil {
+		return err
+	}
+	p.StatusSet("Paused", false)
+	if nodeAccessor == nil || !nodeAccessor.IsClustered() || nodeAccessor.IsOurBackend(id) {
+		if !p.StatusGet("Updating").(bool) {
+			p.Start()
+		}
+	}
+	log.Infof("[%s] backend resumed", p.Name)
+
+	return m.persist(func(r *RuntimeBackends) {
+		r.setPaused(id, false)
+	})
+}
+
+func (m *BackendManager) getPeer(id string) (*Peer, error) {
+	PeerMapLock.RLock()
+	p, exists := PeerMap[id]
+	PeerMapLock.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("bad request: backend %s does not exist", id)
+	}
+	return p, nil
+}
+
+// ApplyNodeChange applies a backend change sent by another cluster node.
+// The change is not propagated again.
+func (m *BackendManager) ApplyNodeChange(action string, con *Connection, id string) error {
+	switch action {
+	case "add":
+		return m.add(con)
+	case "update":
+		return m.update(con)
+	case "remove":
+		return m.remove(id)
+	}
+	return fmt.Errorf("bad request: unknown backend action %s", action)
+}
+
+// propagate sends a backend change to all other online nodes, so all nodes keep the same backends.
+func (m *BackendManager) propagate(action string, parameters map[string]interface{}) error {
+	if nodeAccessor == nil || !nodeAccessor.IsClustered() {
+		return nil
+	}
+	parameters["action"] = action
+	var failed []string
+	for _, node := range nodeAccessor.partnerNodes() {
+		if !node.HasCapability("backend") {
+			failed = append(failed, fmt.Sprintf("%s: backend changes not supported", node.HumanIdentifier()))
+			continue
+		}
+		_, err := nodeAccessor.SendQueryWait(node, "backend", parameters, time.Duration(nodeAccessor.queryTimeout)*time.Second)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", node.HumanIdentifier(), err.Error()))
+		}
+	}
+	if len(failed) > 0 {
+		log.Warnf("failed to %s backend on cluster nodes: %s", action, strings.Join(failed, ", "))
+		return fmt.Errorf("backend changed on this node only, failed on: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// validate checks a connection for required attributes and usable tls settings.
+func (m *BackendManager) validate(con *Connection) error {
+	if con.ID == "" {
+		return errors.New("bad request: backend id is required")
+	}
+	if con.Name == "" {
+		con.Name = con.ID
+	}
+	if len(con.Source) == 0 {
+		return fmt.Errorf("bad request: backend %s requires at least one source", con.ID)
+	}
+	// NewPeer exits on broken tls settings, so test them first
+	tmp := &Peer{Config: con, LocalConfig: m.LocalConfig}
+	if _, err := tmp.getTLSClientConfig(); err != nil {
+		return fmt.Errorf("bad request: backend %s has invalid tls settings: %s", con.ID, err.Error())
+	}
+	return nil
+}
+
+// updateNodes hands the changed backend list over to the node accessor which starts, stops
+// and redistributes the peers.
+func (m *BackendManager) updateNodes() {
+	backends := make([]string, 0, len(m.LocalConfig.Connections))
+	for i := range m.LocalConfig.Connections {
+		backends = append(backends, m.LocalConfig.Connections[i].ID)
+	}
+	if nodeAccessor != nil {
+		nodeAccessor.SetBackends(backends)
+	}
+}
+
+// persist applies the given change to the runtime backends and writes them to the BackendsFile.
+func (m *BackendManager) persist(change func(r *RuntimeBackends)) error {
+	if m.LocalConfig.runtimeBackends == nil {
+		m.LocalConfig.runtimeBackends = &RuntimeBackends{}
+	}
+	change(m.LocalConfig.runtimeBackends)
+	if m.LocalConfig.BackendsFile == "" {
+		return nil
+	}
+	return m.LocalConfig.runtimeBackends.WriteFile(m.LocalConfig.BackendsFile)
+}
+
+// ProcessManagementCommand runs a LMD_*_BACKEND livestatus command extension.
+// It returns false if the command is not a management command at all.
+func ProcessManagementCommand(command string) (isManagementCommand bool, err error) {
+	matched := reManagementCommand.FindStringSubmatch(strings.TrimSpace(command))
+	if len(matched) != 3 {
+		return false, nil
+	}
+	args := strings.SplitN(matched[2], ";", 2)
+	if backendManager == nil || !backendManager.CheckKey(args[0]) {
+		return true, errManagementDenied
+	}
+	if len(args) != 2 || args[1] == "" {
+		return true, fmt.Errorf("bad request: missing argument for LMD_%s_BACKEND", matched[1])
+	}
+	switch matched[1] {
+	case "ADD", "UPDATE":
+		con := &Connection{}
+		if jErr := json.Unmarshal([]byte(args[1]), con); jErr != nil {
+			return true, fmt.Errorf("bad request: cannot parse connection: %s", jErr.Error())
+		}
+		if matched[1] == "ADD" {
+			return true, backendManager.Add(con)
+		}
+		return true, backendManager.Update(con)
+	case "REMOVE":
+		return true, backendManager.Remove(args[1])
+	case "PAUSE":
+		return true, backendManager.Pause(args[1])
+	case "RESUME":
+		return true, backendManager.Resume(args[1])
+	}
+	return true, fmt.Errorf("bad request: unknown management command %s", matched[1])
+}
+
+// redactManagementKey removes the key from management commands, so it does not end up in logs.
+func redactManagementKey(command string) string {
+	return reManagementKey.ReplaceAllString(command, "${1}***")
+}
+
+// set adds or replaces a connection.
+func (r *RuntimeBackends) set(con *Connection) {
+	r.Removed = removeFromList(r.Removed, con.ID)
+	for i := range r.Connections {
+		if r.Connections[i].ID == con.ID {
+			r.Connections[i] = *con
+			return
+		}
+	}
+	r.Connections = append(r.Connections, *con)
+}
+
+// remove drops a connection and remembers its id in case it is defined in the main configuration.
+func (r *RuntimeBackends) remove(id string) {
+	connections := make([]Connection, 0, len(r.Connections))
+	for i := range r.Connections {
+		if r.Connections[i].ID != id {
+			connections = append(connections, r.Connections[i])
+		}
+	}
+	r.Connections = connections
+	r.Paused = removeFromList(r.Paused, id)
+	r.Removed = append(removeFromList(r.Removed, id), id)
+}
+
+// setPaused sets or clears the paused flag for a connection.
+func (r *RuntimeBackends) setPaused(id string, paused bool) {
+	r.Paused = removeFromList(r.Paused, id)
+	if paused {
+		r.Paused = append(r.Paused, id)
+	}
+}
+
+// IsPaused returns true if the given backend id is paused.
+func (r *RuntimeBackends) IsPaused(id string) bool {
+	for _, p := range r.Paused {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply merges the runtime changes into the given list of connections.
+func (r *RuntimeBackends) Apply(connections []Connection) (merged []Connection) {
+	removed := make(map[string]bool)
+	for _, id := range r.Removed {
+		removed[id] = true
+	}
+	for i := range connections {
+		if !removed[connections[i].ID] {
+			merged = append(merged, connections[i])
+		}
+	}
+	for i := range r.Connections {
+		replaced := false
+		for j := range merged {
+			if merged[j].ID == r.Connections[i].ID {
+				merged[j] = r.Connections[i]
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, r.Connections[i])
+		}
+	}
+	return
+}
+
+// ReadRuntimeBackends reads the runtime backends from the given file.
+// A missing file is not an error.
+func ReadRuntimeBackends(file string) (r *RuntimeBackends, err error) {
+	r = &RuntimeBackends{}
+	if _, sErr := os.Stat(file); os.IsNotExist(sErr) {
+		return
+	}
+	_, err = toml.DecodeFile(file, r)
+	return
+}
+
+// WriteFile writes the runtime backends atomically to the given file.
+func (r *RuntimeBackends) WriteFile(file string) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return fmt.Errorf("cannot persist backends: %s", err.Error())
+	}
+	fmt.Fprintf(tmpFile, "# this file is written by lmd, manual changes will be overwritten\n\n")
+	err = toml.NewEncoder(tmpFile).Encode(r)
+	tmpFile.Close()
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("cannot persist backends: %s", err.Error())
+	}
+	return nil
+}
+
+func removeFromList(list []string, item string) []string {
+	res := make([]string, 0, len(list))
+	for _, i := range list {
+		if i != item {
+			res = append(res, i)
+		}
+	}
+	return res
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitForBackends(peer *Peer, num int) error {
+	for retries := 0; retries < 100; retries++ {
+		res, err := peer.QueryString("GET backends\nColumns: peer_key\nFilter: status = 0\n\n")
+		if err == nil && len(res) == num {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("backends did not come up, expected %d", num)
+}
+
+func TestManagementAddPauseRemove(t *testing.T) {
+	peer := StartTestPeerExtra(1, 10, 10, "ManagementKey = \"secret\"\n")
+
+	// wrong key must not change anything
+	mock := StartMockLivestatusSource(1, 10, 10)
+	add := fmt.Sprintf(`{"ID": "mockid1", "Name": "Runtime", "Source": ["%s"]}`, mock)
+	peer.QueryString("COMMAND [0] LMD_ADD_BACKEND;wrong;" + add)
+	PeerMapLock.RLock()
+	_, exists := PeerMap["mockid1"]
+	PeerMapLock.RUnlock()
+	if err := assertEq(false, exists); err != nil {
+		t.Fatal(err)
+	}
+
+	peer.QueryString("COMMAND [0] LMD_ADD_BACKEND;secret;" + add)
+	if err := waitForBackends(peer, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := peer.QueryString("GET hosts\nColumns: name\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(20, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	peer.QueryString("COMMAND [0] LMD_PAUSE_BACKEND;secret;mockid1")
+	PeerMapLock.RLock()
+	runtimePeer := PeerMap["mockid1"]
+	PeerMapLock.RUnlock()
+	if err = assertEq(true, runtimePeer.StatusGet("Paused")); err != nil {
+		t.Error(err)
+	}
+
+	peer.QueryString("COMMAND [0] LMD_RESUME_BACKEND;secret;mockid1")
+	if err = assertEq(false, runtimePeer.StatusGet("Paused")); err != nil {
+		t.Error(err)
+	}
+
+	peer.QueryString("COMMAND [0] LMD_REMOVE_BACKEND;secret;mockid1")
+	if err = waitForBackends(peer, 1); err != nil {
+		t.Error(err)
+	}
+	PeerMapLock.RLock()
+	_, exists = PeerMap["mockid1"]
+	PeerMapLock.RUnlock()
+	if err = assertEq(false, exists); err != nil {
+		t.Error(err)
+	}
+
+	// removed mock does not receive the exit command from the main loop anymore
+	mockPeer := NewPeer(&GlobalTestConfig, &Connection{Source: []string{mock}, Name: "Mock", ID: "mock"}, TestPeerWaitGroup, make(chan bool))
+	mockPeer.QueryString("COMMAND [0] MOCK_EXIT")
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestManagementHTTPAuth(t *testing.T) {
+	backendManager = NewBackendManager(&Config{ManagementKey: "secret"}, nil, nil)
+	defer func() { backendManager = nil }()
+	handler, _ := initializeHTTPRouter(nil)
+
+	req := httptest.NewRequest("GET", "/backends", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if err := assertEq(http.StatusForbidden, rec.Code); err != nil {
+		t.Error(err)
+	}
+
+	req = httptest.NewRequest("POST", "/backends", strings.NewReader(`{"ID": "x"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if err := assertEq(http.StatusBadRequest, rec.Code); err != nil {
+		t.Error(err)
+	}
+
+	req = httptest.NewRequest("GET", "/backends", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if err := assertEq(http.StatusOK, rec.Code); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestManagementRuntimeBackendsFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "lmd-backends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	r := &RuntimeBackends{}
+	r.set(&Connection{ID: "id2", Name: "Two", Source: []string{"/tmp/live2.sock"}, UpdateInterval: 30})
+	r.set(&Connection{ID: "id3", Name: "Three", Source: []string{"/tmp/live3.sock"}})
+	r.remove("id1")
+	r.remove("id3")
+	r.setPaused("id2", true)
+	if err = r.WriteFile(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = ReadRuntimeBackends(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := r.Apply([]Connection{
+		{ID: "id1", Name: "One", Source: []string{"/tmp/live1.sock"}},
+		{ID: "id2", Name: "Old", Source: []string{"/tmp/live2.sock"}},
+	})
+	if err = assertEq(1, len(merged)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("Two", merged[0].Name); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(int64(30), merged[0].UpdateInterval); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(true, r.IsPaused("id2")); err != nil {
+		t.Error(err)
+	}
+}
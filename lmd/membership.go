@@ -0,0 +1,195 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// initMembership enables dynamic membership from the seed nodes.
+// It returns the initial node addresses, this node is always part of them.
+func (n *Nodes) initMembership(LocalConfig *Config, listen string) (addresses []string) {
+	if LocalConfig.AdvertiseAddress == "" {
+		log.Fatalf("AdvertiseAddress is required when using NodeSeeds")
+	}
+	if len(LocalConfig.Nodes) > 0 {
+		log.Warnf("Nodes are ignored when using NodeSeeds")
+	}
+	n.dynamic = true
+	n.quorum = LocalConfig.ClusterQuorum
+	n.deadTimeout = LocalConfig.NodeDeadTimeout
+	if n.deadTimeout <= 0 {
+		n.deadTimeout = 300
+	}
+	n.seeds = make(map[string]bool)
+	for _, address := range LocalConfig.NodeSeeds {
+		n.seeds[parseNodeAddress(address, listen).url] = true
+	}
+	addresses = append(addresses, LocalConfig.AdvertiseAddress)
+	addresses = append(addresses, LocalConfig.NodeSeeds...)
+	return
+}
+
+// advertiseURL returns the url other nodes use to reach this node.
+func (n *Nodes) advertiseURL() string {
+	if n.thisNode != nil {
+		return n.thisNode.url
+	}
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.nodeAddresses[0].url
+}
+
+// memberURLs returns the urls of all nodes which have been seen, including this node.
+func (n *Nodes) memberURLs() (urls []string) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	urls = []string{}
+	for _, node := range n.nodeAddresses {
+		if node.isMe || node.lastSeen > 0 {
+			urls = append(urls, node.url)
+		}
+	}
+	return
+}
+
+// addMembers adds unknown nodes from a gossiped list of urls. They will be
+// pinged with the next availability check.
+func (n *Nodes) addMembers(members interface{}) {
+	list, _ := members.([]interface{})
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, member := range list {
+		url, _ := member.(string)
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			continue
+		}
+		known := false
+		for _, node := range n.nodeAddresses {
+			if node.url == url {
+				known = true
+				break
+			}
+		}
+		if known {
+			continue
+		}
+		node := parseNodeAddress(url, url)
+		n.nodeAddresses = append(n.nodeAddresses, node)
+		log.Infof("node %s joined the cluster", node.HumanIdentifier())
+	}
+}
+
+// removeMember removes a node which left the cluster and redistributes its backends.
+// Seed nodes are kept, so they will be found again once they are back.
+func (n *Nodes) removeMember(url string) {
+	n.lock.Lock()
+	removed := false
+	nodes := make([]*NodeAddress, 0, len(n.nodeAddresses))
+	for _, node := range n.nodeAddresses {
+		if node.url != url || node.isMe {
+			nodes = append(nodes, node)
+			continue
+		}
+		removed = true
+		log.Infof("node %s left the cluster", node.HumanIdentifier())
+		if n.seeds[node.url] {
+			node.id = ""
+			node.lastSeen = 0
+			nodes = append(nodes, node)
+		}
+	}
+	n.nodeAddresses = nodes
+	onlineNodes := make([]*NodeAddress, 0, len(n.onlineNodes))
+	for _, node := range n.onlineNodes {
+		if node.url != url {
+			onlineNodes = append(onlineNodes, node)
+		}
+	}
+	n.onlineNodes = onlineNodes
+	if removed {
+		n.updateMembership(time.Now().Unix())
+	}
+	n.lock.Unlock()
+	if removed {
+		n.redistribute()
+	}
+}
+
+// updateMembership checks the quorum and removes nodes which have not been seen
+// for deadTimeout seconds. Only a partition with quorum removes dead nodes, so a
+// minority partition will not claim their backends.
+// Seed nodes are always counted, so a node which cannot reach any seed on startup
+// has no quorum.
+// The lock must be held by the caller.
+func (n *Nodes) updateMembership(now int64) {
+	if n.thisNode != nil {
+		n.thisNode.lastSeen = now
+	}
+	known := 0
+	for _, node := range n.nodeAddresses {
+		if node.isMe || node.lastSeen > 0 || n.seeds[node.url] {
+			known++
+		}
+	}
+	quorum := n.quorum
+	if quorum <= 0 {
+		quorum = known/2 + 1
+	}
+	hasQuorum := len(n.onlineNodes) >= quorum
+	if hasQuorum != n.hasQuorum {
+		if hasQuorum {
+			log.Infof("cluster has quorum with %d of %d nodes online", len(n.onlineNodes), known)
+		} else {
+			log.Errorf("cluster lost quorum with %d of %d nodes online, releasing all backends", len(n.onlineNodes), known)
+		}
+	}
+	n.hasQuorum = hasQuorum
+	if !hasQuorum {
+		return
+	}
+
+	nodes := make([]*NodeAddress, 0, len(n.nodeAddresses))
+	for _, node := range n.nodeAddresses {
+		if node.isMe || node.lastSeen == 0 || node.lastSeen >= now-n.deadTimeout {
+			nodes = append(nodes, node)
+			continue
+		}
+		log.Infof("removing node %s, not seen for %ds", node.HumanIdentifier(), now-node.lastSeen)
+		if n.seeds[node.url] {
+			node.id = ""
+			node.lastSeen = 0
+			nodes = append(nodes, node)
+		}
+	}
+	n.nodeAddresses = nodes
+}
+
+// leave tells all other nodes that this node is leaving the cluster,
+// so they can take over its backends right away.
+func (n *Nodes) leave() {
+	if !n.dynamic || n.thisNode == nil {
+		return
+	}
+	n.lock.RLock()
+	nodes := make([]*NodeAddress, len(n.onlineNodes))
+	copy(nodes, n.onlineNodes)
+	n.lock.RUnlock()
+	wg := &sync.WaitGroup{}
+	for _, node := range nodes {
+		if node.isMe {
+			continue
+		}
+		wg.Add(1)
+		go func(node *NodeAddress) {
+			defer logPanicExit()
+			defer wg.Done()
+			requestData := make(map[string]interface{})
+			requestData["url"] = n.thisNode.url
+			if _, err := n.SendQueryWait(node, "leave", requestData, 2*time.Second); err != nil {
+				log.Debugf("failed to send leave to node %s: %s", node.HumanIdentifier(), err.Error())
+			}
+		}(node)
+	}
+	waitTimeout(wg, 3*time.Second)
+}
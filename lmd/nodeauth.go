@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodeProtocolVersion is increased on incompatible changes of the node api.
+// Nodes with a different protocol version will not join the cluster.
+const nodeProtocolVersion = 3
+
+// nodeCapabilities lists the node api functions supported by this node.
+var nodeCapabilities = []string{"ping", "table", "command", "replicate", "leave", "backend"}
+
+// nodeRequestMaxAge is the maximum difference in seconds between the timestamp of a signed request and the local clock.
+const nodeRequestMaxAge = 60
+
+const (
+	nodeTimestampHeader = "X-LMD-Timestamp"
+	nodeNonceHeader     = "X-LMD-Nonce"
+	nodeSignatureHeader = "X-LMD-Signature"
+)
+
+// nodeNonces contains the nonces of all signed node requests within the nodeRequestMaxAge,
+// so captured requests cannot be replayed.
+var nodeNonces = &nodeNonceCache{seen: make(map[string]int64)}
+
+// nodeNonceCache remembers nonces till their timestamp is out of range.
+type nodeNonceCache struct {
+	lock sync.Mutex
+	seen map[string]int64
+}
+
+// Add returns an error if the nonce has been used before, otherwise it is remembered.
+func (c *nodeNonceCache) Add(nonce string, now time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for seenNonce, expire := range c.seen {
+		if expire < now.Unix() {
+			delete(c.seen, seenNonce)
+		}
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return fmt.Errorf("replayed node request")
+	}
+	// timestamps may be up to nodeRequestMaxAge in the future
+	c.seen[nonce] = now.Unix() + 2*nodeRequestMaxAge
+	return nil
+}
+
+// signNodeRequest returns the hmac signature of a node request or response body.
+// Responses are signed with the nonce of the request.
+func signNodeRequest(secret string, timestamp string, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyNodeRequest checks the timestamp and signature of a node request or response.
+func verifyNodeRequest(secret string, timestamp string, nonce string, signature string, body []byte, now time.Time) error {
+	if timestamp == "" || nonce == "" || signature == "" {
+		return fmt.Errorf("missing node request signature")
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid node request timestamp")
+	}
+	if diff := now.Unix() - ts; diff > nodeRequestMaxAge || diff < -nodeRequestMaxAge {
+		return fmt.Errorf("node request timestamp out of range")
+	}
+	expected := signNodeRequest(secret, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("invalid node request signature")
+	}
+	return nil
+}
+
+// setNodeRequestSignature adds the timestamp, nonce and signature headers if a cluster secret is set.
+// It returns the nonce, which is used to verify the response.
+func setNodeRequestSignature(req *http.Request, secret string, body []byte) (nonce string) {
+	if secret == "" {
+		return ""
+	}
+	nonce = generateUUID()
+	setNodeSignature(req.Header, secret, nonce, body)
+	return nonce
+}
+
+// setNodeSignature sets the timestamp, nonce and signature headers.
+func setNodeSignature(header http.Header, secret string, nonce string, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	header.Set(nodeTimestampHeader, timestamp)
+	header.Set(nodeNonceHeader, nonce)
+	header.Set(nodeSignatureHeader, signNodeRequest(secret, timestamp, nonce, body))
+}
+
+// verifyNodeResponse checks the signature of a node response to a request with the given nonce.
+func verifyNodeResponse(secret string, nonce string, res *http.Response, body []byte) error {
+	if secret == "" {
+		return nil
+	}
+	if res.Header.Get(nodeNonceHeader) != nonce {
+		return fmt.Errorf("invalid node response nonce")
+	}
+	if err := verifyNodeRequest(secret, res.Header.Get(nodeTimestampHeader), nonce, res.Header.Get(nodeSignatureHeader), body, time.Now()); err != nil {
+		return fmt.Errorf("invalid node response: %s", err.Error())
+	}
+	return nil
+}
+
+// signedResponseWriter buffers a node api response, so it can be signed with the cluster secret.
+type signedResponseWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+// WriteHeader stores the status code till the response is sent.
+func (w *signedResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+// Write buffers the response body.
+func (w *signedResponseWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+// send signs the buffered response with the nonce of the request and sends it.
+func (w *signedResponseWriter) send(secret string, nonce string) {
+	if secret != "" {
+		setNodeSignature(w.Header(), secret, nonce, w.body.Bytes())
+	}
+	if w.code != 0 {
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+	w.ResponseWriter.Write(w.body.Bytes())
+}
+
+// errNodeAuthRequired is returned for node api requests if neither ClusterSecret nor client certificates are used.
+var errNodeAuthRequired = fmt.Errorf("node api requires ClusterSecret or https listeners with TLSClientPems")
+
+// readNodeRequest reads the body of a node api request and verifies its signature.
+// Signed requests are accepted only once.
+// Without a cluster secret, only requests with a verified client certificate are accepted.
+func readNodeRequest(request *http.Request) (body []byte, err error) {
+	body, err = ioutil.ReadAll(request.Body)
+	if err != nil {
+		return
+	}
+	err = verifyNodeRequestAuth(request, body)
+	if err == nil && nodeAccessor != nil && nodeAccessor.secret != "" {
+		err = nodeNonces.Add(request.Header.Get(nodeNonceHeader), time.Now())
+	}
+	return
+}
+
+// verifyNodeRequestAuth returns an error unless the request is signed with the
+// cluster secret or comes from a client with a verified certificate.
+func verifyNodeRequestAuth(request *http.Request, body []byte) error {
+	if nodeAccessor != nil && nodeAccessor.secret != "" {
+		return verifyNodeRequest(nodeAccessor.secret, request.Header.Get(nodeTimestampHeader), request.Header.Get(nodeNonceHeader), request.Header.Get(nodeSignatureHeader), body, time.Now())
+	}
+	if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 {
+		return nil
+	}
+	return errNodeAuthRequired
+}
+
+// hasNodeAuth returns true if node api requests can be authenticated, either
+// by the cluster secret or by client certificates on a https listener.
+func hasNodeAuth(LocalConfig *Config, listen string) bool {
+	if LocalConfig.ClusterSecret != "" {
+		return true
+	}
+	return len(LocalConfig.TLSClientPems) > 0 && strings.HasPrefix(listen, "https://")
+}
+
+// checkNodeProtocol returns an error unless the request data is from a compatible node.
+func checkNodeProtocol(data map[string]interface{}) error {
+	protocol, _ := data["protocol"].(float64)
+	if int(protocol) != nodeProtocolVersion {
+		return fmt.Errorf("incompatible node protocol version %v, expected %d", data["protocol"], nodeProtocolVersion)
+	}
+	return nil
+}
+
+// getNodeTLSClientConfig returns the tls config for requests to other nodes.
+// The server certificate is used as client certificate, so nodes can use the
+// same certificates and TLSClientPems for mutual tls between each other.
+func getNodeTLSClientConfig(LocalConfig *Config) (config *tls.Config, err error) {
+	config = &tls.Config{InsecureSkipVerify: LocalConfig.SkipSSLCheck > 0}
+	if LocalConfig.TLSCertificate != "" && LocalConfig.TLSKey != "" {
+		cer, err := tls.LoadX509KeyPair(LocalConfig.TLSCertificate, LocalConfig.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cer}
+	}
+	if len(LocalConfig.TLSClientPems) > 0 {
+		caCertPool := x509.NewCertPool()
+		for _, file := range LocalConfig.TLSClientPems {
+			caCert, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			caCertPool.AppendCertsFromPEM(caCert)
+		}
+		config.RootCAs = caCertPool
+	}
+	return
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -24,22 +30,38 @@ type Nodes struct {
 	ShutdownChannel  chan bool
 	loopInterval     int
 	heartbeatTimeout int
+	queryTimeout     int // seconds to wait for other nodes in distributed queries
+	weight           int
+	secret           string
 	backends         []string
 	thisNode         *NodeAddress
 	nodeAddresses    []*NodeAddress
 	onlineNodes      []*NodeAddress
 	assignedBackends []string
 	nodeBackends     map[string][]string
+	replicator       *Replicator
+	dynamic          bool // membership from seed nodes and gossip instead of a static node list
+	seeds            map[string]bool
+	quorum           int
+	deadTimeout      int64
+	hasQuorum        bool
 	stopChannel      chan bool
+	lock             *LoggingLock
 }
 
 // NodeAddress contains the ip of a node (plus url/port, if necessary)
 type NodeAddress struct {
-	id   string
-	ip   string
-	port int
-	url  string
-	isMe bool
+	id     string
+	ip     string
+	port   int
+	url    string
+	isMe   bool
+	weight int
+	// capabilities announced by the node in its ping response
+	capabilities map[string]bool
+	version      string
+	latency      float64
+	lastSeen     int64
 }
 
 // HumanIdentifier returns the node address.
@@ -52,53 +74,58 @@ func (a *NodeAddress) HumanIdentifier() string {
 	return human // :)
 }
 
+// HasCapability returns true if the node supports the given node api function.
+func (a *NodeAddress) HasCapability(name string) bool {
+	if nodeAccessor != nil {
+		nodeAccessor.lock.RLock()
+		defer nodeAccessor.lock.RUnlock()
+	}
+	return a.capabilities[name]
+}
+
 // NewNodes creates a new cluster manager.
 func NewNodes(LocalConfig *Config, addresses []string, listen string, waitGroupInit *sync.WaitGroup, shutdownChannel chan bool) *Nodes {
 	n := &Nodes{
 		WaitGroupInit:   waitGroupInit,
 		ShutdownChannel: shutdownChannel,
 		stopChannel:     make(chan bool),
+		lock:            NewLoggingLock("NodesLock"),
+		weight:          LocalConfig.NodeWeight,
+		secret:          LocalConfig.ClusterSecret,
+		queryTimeout:    LocalConfig.NodeTimeout,
+	}
+	if LocalConfig.ClusterReplication {
+		n.replicator = NewReplicator(n)
+	}
+	if (len(addresses) > 1 || len(LocalConfig.NodeSeeds) > 0) && !hasNodeAuth(LocalConfig, listen) {
+		log.Fatalf("cluster mode requires authentication of the node api, set ClusterSecret or use https listeners with TLSClientPems")
+	}
+	tlsConfig, err := getNodeTLSClientConfig(LocalConfig)
+	if err != nil {
+		log.Fatalf("failed to initialize node tls config: %s", err.Error())
 	}
-	tlsConfig := &tls.Config{InsecureSkipVerify: LocalConfig.SkipSSLCheck > 0}
 	n.HTTPClient = NewLMDHTTPClient(tlsConfig)
 	PeerMapLock.RLock()
 	for id := range PeerMap {
 		n.backends = append(n.backends, id)
 	}
 	PeerMapLock.RUnlock()
-	partsListen := reNodeAddress.FindStringSubmatch(listen)
+	if len(LocalConfig.NodeSeeds) > 0 {
+		addresses = n.initMembership(LocalConfig, listen)
+	}
 	for _, address := range addresses {
-		parts := reNodeAddress.FindStringSubmatch(address)
-		nodeAddress := &NodeAddress{}
-		var ip, port, url string
-		if parts[1] != "" && parts[2] != "" { // "http", "://"
-			// HTTP address
-			ip = parts[3]
-			port = parts[5]
-			if port == "" {
-				port = partsListen[5]
-			}
-			url = address
-		} else {
-			// IP or TCP address
-			ip = parts[3]
-			port = parts[5]
-			if port == "" {
-				port = partsListen[5]
-			}
-			url = partsListen[1] + partsListen[2] // "http://"
-			url += ip + ":" + port
-		}
-		if url[len(url)-1] != '/' {
-			url += "/" // url must end in a slash
-		}
-		nodeAddress.ip = ip
-		nodeAddress.port, _ = strconv.Atoi(port)
-		nodeAddress.url = url
+		nodeAddress := parseNodeAddress(address, listen)
+		duplicate := false
 		for _, otherNodeAddress := range n.nodeAddresses {
 			if otherNodeAddress.url == nodeAddress.url {
-				log.Fatalf("Duplicate node url: %s", nodeAddress.url)
+				duplicate = true
+			}
+		}
+		if duplicate {
+			if n.dynamic {
+				continue
 			}
+			log.Fatalf("Duplicate node url: %s", nodeAddress.url)
 		}
 		n.nodeAddresses = append(n.nodeAddresses, nodeAddress)
 	}
@@ -106,9 +133,43 @@ func NewNodes(LocalConfig *Config, addresses []string, listen string, waitGroupI
 	return n
 }
 
+// parseNodeAddress creates a node address from a configured address.
+// Bare ips and tcp addresses get the scheme and port of the http listener.
+func parseNodeAddress(address string, listen string) *NodeAddress {
+	partsListen := reNodeAddress.FindStringSubmatch(listen)
+	parts := reNodeAddress.FindStringSubmatch(address)
+	nodeAddress := &NodeAddress{}
+	var ip, port, url string
+	if parts[1] != "" && parts[2] != "" { // "http", "://"
+		// HTTP address
+		ip = parts[3]
+		port = parts[5]
+		if port == "" {
+			port = partsListen[5]
+		}
+		url = address
+	} else {
+		// IP or TCP address
+		ip = parts[3]
+		port = parts[5]
+		if port == "" {
+			port = partsListen[5]
+		}
+		url = partsListen[1] + partsListen[2] // "http://"
+		url += ip + ":" + port
+	}
+	if url[len(url)-1] != '/' {
+		url += "/" // url must end in a slash
+	}
+	nodeAddress.ip = ip
+	nodeAddress.port, _ = strconv.Atoi(port)
+	nodeAddress.url = url
+	return nodeAddress
+}
+
 // IsClustered checks if cluster mode is enabled.
 func (n *Nodes) IsClustered() bool {
-	return len(n.nodeAddresses) > 1
+	return n.dynamic || len(n.nodeAddresses) > 1
 }
 
 // Node returns the NodeAddress object for the specified node id.
@@ -138,6 +199,9 @@ func (n *Nodes) Initialize() {
 	if n.heartbeatTimeout == 0 {
 		n.heartbeatTimeout = 3
 	}
+	if n.queryTimeout == 0 {
+		n.queryTimeout = 10
+	}
 
 	// Generate identifier
 	ownIdentifier := &n.ID
@@ -149,13 +213,7 @@ func (n *Nodes) Initialize() {
 
 	// Start all peers in single mode
 	if !n.IsClustered() {
-		PeerMapLock.RLock()
-		for _, peer := range PeerMap {
-			if !peer.StatusGet("Updating").(bool) {
-				peer.Start()
-			}
-		}
-		PeerMapLock.RUnlock()
+		n.startPeers()
 	}
 
 	// Send first ping (detect own ip) and wait for it to finish
@@ -183,6 +241,7 @@ func (n *Nodes) Start() {
 // Stop stops the loop.
 // Partner nodes won't be pinged automatically anymore.
 func (n *Nodes) Stop() {
+	n.leave()
 	n.stopChannel <- true
 }
 
@@ -194,12 +253,19 @@ func (n *Nodes) loop() {
 		select {
 		case <-n.ShutdownChannel:
 			ticker.Stop()
+			n.leave()
 			return
 		case <-n.stopChannel:
 			ticker.Stop()
 			return
 		case <-ticker.C:
 			n.checkNodeAvailability()
+			if n.replicator != nil {
+				go func() {
+					defer logPanicExit()
+					n.replicator.Run()
+				}()
+			}
 
 		}
 	}
@@ -220,23 +286,55 @@ func (n *Nodes) checkNodeAvailability() {
 	if !initializing {
 		newOnlineNodes = append(newOnlineNodes, n.thisNode)
 	}
-	for _, node := range n.nodeAddresses {
+	n.lock.RLock()
+	nodes := make([]*NodeAddress, len(n.nodeAddresses))
+	copy(nodes, n.nodeAddresses)
+	n.lock.RUnlock()
+	for _, node := range nodes {
 		if !initializing && node.isMe {
 			// Skip this node unless we're initializing
 			continue
 		}
 		requestData := make(map[string]interface{})
 		requestData["identifier"] = ownIdentifier
+		if n.dynamic {
+			requestData["url"] = n.advertiseURL()
+			requestData["members"] = n.memberURLs()
+		}
 		log.Tracef("pinging node %s...", node.HumanIdentifier())
 		wg.Add(1)
 		go func(wg *sync.WaitGroup, node *NodeAddress) {
+			started := time.Now()
 			callback := func(responseData interface{}) {
 				// Parse response
 				dataMap, ok := responseData.(map[string]interface{})
 				log.Tracef("got response from %s", node.HumanIdentifier())
 				if !ok {
+					wg.Done()
+					return
+				}
+				if err := checkNodeProtocol(dataMap); err != nil {
+					log.Warnf("ignoring node %s: %s", node.HumanIdentifier(), err.Error())
+					wg.Done()
 					return
 				}
+				capabilities := make(map[string]bool)
+				if list, ok := dataMap["capabilities"].([]interface{}); ok {
+					for _, capability := range list {
+						if name, ok := capability.(string); ok {
+							capabilities[name] = true
+						}
+					}
+				}
+				if n.dynamic {
+					n.addMembers(dataMap["members"])
+				}
+				n.lock.Lock()
+				defer n.lock.Unlock()
+				node.capabilities = capabilities
+				node.version, _ = dataMap["version"].(string)
+				node.latency = time.Since(started).Seconds()
+				node.lastSeen = time.Now().Unix()
 
 				// Node id
 				responseIdentifier := dataMap["identifier"].(string)
@@ -247,6 +345,9 @@ func (n *Nodes) checkNodeAvailability() {
 					delete(n.nodeBackends, node.id)
 					node.id = responseIdentifier
 				}
+				if weight, ok := dataMap["weight"].(float64); ok {
+					node.weight = int(weight)
+				}
 
 				// Check whose response it is
 				if responseIdentifier == ownIdentifier {
@@ -283,7 +384,12 @@ func (n *Nodes) checkNodeAvailability() {
 	}
 
 	// Redistribute backends
+	n.lock.Lock()
 	n.onlineNodes = newOnlineNodes
+	if n.dynamic {
+		n.updateMembership(time.Now().Unix())
+	}
+	n.lock.Unlock()
 	n.redistribute()
 
 }
@@ -291,59 +397,183 @@ func (n *Nodes) checkNodeAvailability() {
 // redistribute assigns the peers to the available nodes.
 // It starts peers assigned to this node and stops other peers.
 func (n *Nodes) redistribute() {
-	// Nodes and backends
-	numberBackends := len(n.backends)
-	ownIndex, nodeOnline, numberAllNodes, numberAvailableNodes := n.getOnlineNodes()
-	allNodes := n.nodeAddresses
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	_, nodeOnline, _, _ := n.getOnlineNodes()
+	var onlineNodes []*NodeAddress
+	for i, node := range n.nodeAddresses {
+		if nodeOnline[i] {
+			onlineNodes = append(onlineNodes, node)
+		}
+	}
 
-	// Assign items to nodes
-	assignedNumberBackends := make([]int, numberAllNodes) // for each node
-	if numberAvailableNodes >= numberBackends {
-		// No node has more than one backend
-		for i := range allNodes {
-			if !nodeOnline[i] {
-				continue
+	distribution := distributeBackends(n.backends, n.backendCosts(), onlineNodes)
+	if n.dynamic && !n.hasQuorum {
+		// do not claim any backends without quorum, another partition may own them
+		distribution = make(map[string][]string)
+	}
+	nodeBackends := make(map[string][]string)
+	for _, node := range onlineNodes {
+		nodeBackends[node.id] = distribution[node.url]
+	}
+	n.nodeBackends = nodeBackends
+
+	var ourBackends []string
+	if n.thisNode != nil {
+		ourBackends = distribution[n.thisNode.url]
+	}
+	n.updateBackends(ourBackends)
+
+	if n.replicator != nil && n.thisNode != nil {
+		n.updateReplication(distribution, onlineNodes)
+	}
+}
+
+// updateReplication sets the secondary node for each backend of this node and
+// the backends this node keeps replicas for.
+func (n *Nodes) updateReplication(distribution map[string][]string, onlineNodes []*NodeAddress) {
+	targets := make(map[string]*NodeAddress)
+	secondaryFor := make(map[string]bool)
+	for url, backends := range distribution {
+		for _, backend := range backends {
+			secondary := secondaryNode(backend, url, onlineNodes)
+			switch {
+			case secondary == nil:
+			case url == n.thisNode.url:
+				targets[backend] = secondary
+			case secondary.url == n.thisNode.url:
+				secondaryFor[backend] = true
 			}
-			assignedNumberBackends[i] = 1
 		}
-	} else {
-		for i := range allNodes {
-			if !nodeOnline[i] {
-				continue
-			}
-			numberPerNode := numberBackends / numberAvailableNodes
-			if numberBackends%numberAvailableNodes != 0 {
-				numberPerNode++
-			}
-			assignedNumberBackends[i] = numberPerNode
+	}
+	n.replicator.SetTargets(targets, secondaryFor)
+}
+
+// backendCosts returns the configured cost hints of all backends which have one.
+func (n *Nodes) backendCosts() map[string]int {
+	costs := make(map[string]int)
+	PeerMapLock.RLock()
+	defer PeerMapLock.RUnlock()
+	for _, id := range n.backends {
+		if p, ok := PeerMap[id]; ok && p.Config.Cost > 0 {
+			costs[id] = p.Config.Cost
 		}
 	}
+	return costs
+}
 
-	// List backends that we're responsible for
-	assignedBackends := make([][]string, numberAllNodes) // for each node
-	nodeBackends := make(map[string][]string)
-	distributedCount := 0
-	numberAssignedBackends := 0
-	for i, number := range assignedNumberBackends {
-		numberAssignedBackends += number
-		if number != 0 {
-			// number == 0 means no backends for that node
-			list := make([]string, number)
-			for j := 0; j < number; j++ {
-				if len(n.backends) > distributedCount+j {
-					list[j] = n.backends[distributedCount+j]
-				}
+// distributeBackends assigns each backend to one of the given nodes using
+// weighted rendezvous hashing on the backend id and node url. Since every node
+// computes the same scores, all nodes agree on the distribution and a joining
+// or leaving node only moves the backends it gains or loses.
+// If cost hints are set, nodes are additionally limited to their weighted share
+// of the total cost, so expensive backends do not pile up on a single node.
+// It returns the assigned backends for each node url.
+func distributeBackends(backends []string, costs map[string]int, nodes []*NodeAddress) map[string][]string {
+	distribution := make(map[string][]string)
+	if len(nodes) == 0 {
+		return distribution
+	}
+
+	sorted := make([]string, len(backends))
+	copy(sorted, backends)
+	sort.Strings(sorted)
+
+	if len(costs) == 0 {
+		for _, backend := range sorted {
+			node := rankNodes(backend, nodes)[0]
+			distribution[node.url] = append(distribution[node.url], backend)
+		}
+		return distribution
+	}
+
+	// bounded loads: place expensive backends first
+	cost := func(backend string) float64 {
+		if c, ok := costs[backend]; ok && c > 0 {
+			return float64(c)
+		}
+		return 1
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return cost(sorted[i]) > cost(sorted[j])
+	})
+	totalCost := 0.0
+	maxCost := 0.0
+	for _, backend := range sorted {
+		totalCost += cost(backend)
+		maxCost = math.Max(maxCost, cost(backend))
+	}
+	totalWeight := 0.0
+	for _, node := range nodes {
+		totalWeight += float64(nodeWeight(node.weight))
+	}
+	load := make(map[string]float64)
+	for _, backend := range sorted {
+		candidates := rankNodes(backend, nodes)
+		chosen := candidates[0]
+		for _, node := range candidates {
+			capacity := math.Max(totalCost*float64(nodeWeight(node.weight))/totalWeight*nodeCapacityFactor, maxCost)
+			if load[node.url]+cost(backend) <= capacity {
+				chosen = node
+				break
 			}
-			distributedCount += number
-			assignedBackends[i] = list
-			id := allNodes[i].id
-			nodeBackends[id] = list
 		}
+		load[chosen.url] += cost(backend)
+		distribution[chosen.url] = append(distribution[chosen.url], backend)
 	}
-	n.nodeBackends = nodeBackends
-	ourBackends := assignedBackends[ownIndex]
+	for url := range distribution {
+		sort.Strings(distribution[url])
+	}
+	return distribution
+}
 
-	n.updateBackends(ourBackends)
+// rankNodes returns the nodes ordered by their score for the given backend.
+func rankNodes(backend string, nodes []*NodeAddress) []*NodeAddress {
+	list := make([]*NodeAddress, len(nodes))
+	copy(list, nodes)
+	scores := make(map[string]float64, len(nodes))
+	for _, node := range list {
+		scores[node.url] = rendezvousScore(node.url, backend, node.weight)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if scores[list[i].url] == scores[list[j].url] {
+			return list[i].url < list[j].url
+		}
+		return scores[list[i].url] > scores[list[j].url]
+	})
+	return list
+}
+
+// secondaryNode returns the node keeping the replica of a backend, which is
+// the best ranked node except the primary. It returns nil if there is no other node.
+func secondaryNode(backend string, primaryURL string, nodes []*NodeAddress) *NodeAddress {
+	for _, node := range rankNodes(backend, nodes) {
+		if node.url != primaryURL {
+			return node
+		}
+	}
+	return nil
+}
+
+// nodeCapacityFactor sets how much a node may exceed its share of the total backend cost.
+const nodeCapacityFactor = 1.25
+
+// rendezvousScore returns the weighted score of a backend on a node.
+// The node with the highest score owns the backend.
+func rendezvousScore(nodeKey string, backend string, weight int) float64 {
+	sum := sha256.Sum256([]byte(nodeKey + "\x00" + backend))
+	// map hash into the open interval (0,1)
+	x := (float64(binary.BigEndian.Uint64(sum[:8])>>11) + 0.5) / (1 << 53)
+	return -float64(nodeWeight(weight)) / math.Log(x)
+}
+
+// nodeWeight returns the weight of a node, unset weights default to 1.
+func nodeWeight(weight int) int {
+	if weight <= 0 {
+		return 1
+	}
+	return weight
 }
 
 func (n *Nodes) updateBackends(ourBackends []string) {
@@ -387,11 +617,72 @@ func (n *Nodes) updateBackends(ourBackends []string) {
 	}
 	for _, newBackend := range addBackends {
 		peer := PeerMap[newBackend]
-		peer.Start()
+		if !peer.StatusGet("Paused").(bool) && !peer.StatusGet("Updating").(bool) {
+			n.restoreReplica(peer)
+			peer.Start()
+		}
 	}
 	PeerMapLock.RUnlock()
 }
 
+// restoreReplica fills the cache of a peer taken over from a failed node from its replica.
+func (n *Nodes) restoreReplica(peer *Peer) {
+	if n.replicator == nil {
+		return
+	}
+	replica := n.replicator.Take(peer.ID)
+	if replica == nil {
+		return
+	}
+	if err := peer.RestoreReplica(replica); err != nil {
+		log.Warnf("[%s] restoring replica failed: %s", peer.Name, err.Error())
+		peer.Clear()
+	}
+}
+
+// SetBackends replaces the list of backends after they have been changed at runtime.
+// Backends will be redistributed in cluster mode. New peers are started if they belong to this node.
+func (n *Nodes) SetBackends(backends []string) {
+	n.lock.Lock()
+	n.backends = backends
+	n.lock.Unlock()
+	if n.IsClustered() {
+		n.redistribute()
+	}
+	n.startPeers()
+}
+
+// startPeers starts all peers which belong to this node unless they are paused or running already.
+// Sub peers of federated lmd backends are started by their parent.
+func (n *Nodes) startPeers() {
+	PeerMapLock.RLock()
+	defer PeerMapLock.RUnlock()
+	for id, peer := range PeerMap {
+		if peer.ParentID != "" {
+			continue
+		}
+		if n.IsClustered() && !n.IsOurBackend(id) {
+			continue
+		}
+		if peer.StatusGet("Paused").(bool) || peer.StatusGet("Updating").(bool) {
+			continue
+		}
+		peer.Start()
+	}
+}
+
+// partnerNodes returns all other online nodes.
+func (n *Nodes) partnerNodes() (nodes []*NodeAddress) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	for _, node := range n.onlineNodes {
+		if !node.isMe {
+			nodes = append(nodes, node)
+		}
+	}
+	return
+}
+
 func (n *Nodes) getOnlineNodes() (ownIndex int, nodeOnline []bool, numberAllNodes int, numberAvailableNodes int) {
 	allNodes := n.nodeAddresses
 	numberAllNodes = len(allNodes)
@@ -416,6 +707,41 @@ func (n *Nodes) getOnlineNodes() (ownIndex int, nodeOnline []bool, numberAllNode
 	return
 }
 
+// GetTableData returns the rows of the nodes table.
+// Values must be in the same order as the columns from NewNodesTable.
+func (n *Nodes) GetTableData() (data [][]interface{}) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	for _, node := range n.nodeAddresses {
+		online := 0
+		for _, otherNode := range n.onlineNodes {
+			if otherNode.url == node.url {
+				online = 1
+			}
+		}
+		isMe := 0
+		if node.isMe {
+			isMe = 1
+		}
+		backends := []string{}
+		if online == 1 && node.id != "" {
+			backends = append(backends, n.nodeBackends[node.id]...)
+		}
+		data = append(data, []interface{}{
+			node.url,
+			node.id,
+			online,
+			isMe,
+			nodeWeight(node.weight),
+			backends,
+			node.latency,
+			node.lastSeen,
+			node.version,
+		})
+	}
+	return
+}
+
 // IsOurBackend checks if backend is managed by this node.
 func (n *Nodes) IsOurBackend(backend string) bool {
 	ourBackends := n.assignedBackends
@@ -427,16 +753,130 @@ func (n *Nodes) IsOurBackend(backend string) bool {
 	return false
 }
 
+// BackendNode returns the node which is responsible for the given backend or
+// nil if the backend is not assigned to any other node.
+func (n *Nodes) BackendNode(backend string) *NodeAddress {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	for nodeID, backends := range n.nodeBackends {
+		for _, id := range backends {
+			if id != backend {
+				continue
+			}
+			for _, node := range n.nodeAddresses {
+				if node.id == nodeID && !node.isMe {
+					return node
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// ForwardCommands sends commands to the node owning their backends.
+// If commandWait is set, the node waits up to commandWait milliseconds till
+// the commands are confirmed. It returns the result and confirmation for each backend.
+func (n *Nodes) ForwardCommands(node *NodeAddress, commandsByPeer map[string][]string, auditEntries []*AuditEntry, commandWait int) (map[string]error, map[string]bool) {
+	results := make(map[string]error)
+	confirmed := make(map[string]bool)
+	requestData := make(map[string]interface{})
+	requestData["commands"] = commandsByPeer
+	requestData["auth_users"] = commandAuthUsers(commandsByPeer, auditEntries)
+	requestData["forwarded_by"] = n.ID
+	if commandWait > 0 {
+		requestData["command_wait"] = commandWait
+	}
+	var responseData interface{}
+	err := fmt.Errorf("node does not support commands")
+	if node.HasCapability("command") {
+		responseData, err = n.SendQueryWait(node, "command", requestData, 10*time.Second+time.Duration(commandWait)*time.Millisecond)
+	}
+	if err == nil {
+		dataMap, _ := responseData.(map[string]interface{})
+		remoteResults, _ := dataMap["results"].(map[string]interface{})
+		for id, res := range remoteResults {
+			if msg, _ := res.(string); msg != "" {
+				results[id] = fmt.Errorf("%s", msg)
+			} else {
+				results[id] = nil
+			}
+		}
+		remoteConfirmed, _ := dataMap["confirmed"].(map[string]interface{})
+		for id, ok := range remoteConfirmed {
+			confirmed[id], _ = ok.(bool)
+		}
+	}
+	for id := range commandsByPeer {
+		if _, ok := results[id]; ok {
+			continue
+		}
+		if err == nil {
+			err = fmt.Errorf("no result")
+		}
+		results[id] = fmt.Errorf("forwarding to node %s failed: %s", node.HumanIdentifier(), err.Error())
+	}
+	log.Debugf("forwarded commands for %d backends to node %s", len(commandsByPeer), node.HumanIdentifier())
+	return results, confirmed
+}
+
+// commandAuthUsers returns the AuthUser of each command taken from the audit entries,
+// so the receiving node can check its command policy.
+func commandAuthUsers(commandsByPeer map[string][]string, auditEntries []*AuditEntry) map[string][]string {
+	users := make(map[string]string)
+	for _, entry := range auditEntries {
+		for _, id := range entry.Peers {
+			users[id+"\x00"+strings.TrimSpace(entry.Command)] = entry.AuthUser
+		}
+	}
+	authUsers := make(map[string][]string)
+	for id, commands := range commandsByPeer {
+		for _, command := range commands {
+			authUsers[id] = append(authUsers[id], users[id+"\x00"+command])
+		}
+	}
+	return authUsers
+}
+
+// SendQueryWait sends a query to a node and waits up to timeout for the response data.
+// The timeout also cancels the http request, so slow nodes do not leave requests behind.
+func (n *Nodes) SendQueryWait(node *NodeAddress, name string, parameters map[string]interface{}, timeout time.Duration) (responseData interface{}, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	result := make(chan interface{}, 1)
+	err = n.sendQueryContext(ctx, node, name, parameters, func(data interface{}) {
+		result <- data
+	})
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timeout")
+		}
+		return
+	}
+	select {
+	case responseData = <-result:
+	case <-ctx.Done():
+		err = fmt.Errorf("timeout")
+	}
+	return
+}
+
 // SendQuery sends a query to a node.
 // It will be sent as http request; name is the api function to be called.
 // The returned data will be passed to the callback.
 func (n *Nodes) SendQuery(node *NodeAddress, name string, parameters map[string]interface{}, callback func(interface{})) error {
+	return n.sendQueryContext(context.Background(), node, name, parameters, callback)
+}
+
+// sendQueryContext sends a query to a node, the http request is canceled with the context.
+func (n *Nodes) sendQueryContext(ctx context.Context, node *NodeAddress, name string, parameters map[string]interface{}, callback func(interface{})) error {
 	// Prepare request data
 	requestData := make(map[string]interface{})
 	for key, value := range parameters {
 		requestData[key] = value
 	}
 	requestData["_name"] = name // requested function
+	requestData["protocol"] = nodeProtocolVersion
 
 	// Encode request data
 	contentType := "application/json"
@@ -450,17 +890,32 @@ func (n *Nodes) SendQuery(node *NodeAddress, name string, parameters map[string]
 		log.Fatalf("uninitialized node address provided to SendQuery %s", node.id)
 	}
 	url := node.url + "query"
-	res, err := n.HTTPClient.Post(url, contentType, bytes.NewBuffer(rawRequest))
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(rawRequest))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	nonce := setNodeRequestSignature(req, n.secret, rawRequest)
+	res, err := n.HTTPClient.Do(req)
 	if err != nil {
 		log.Tracef("error sending query (%s) to node (%s): %s", name, node, err.Error())
 		return err
 	}
 
-	// Read response data
+	// Read and verify response data
 	defer res.Body.Close()
-	decoder := json.NewDecoder(res.Body)
+	rawResponse, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.Tracef("%s", err.Error())
+		return err
+	}
+	if err := verifyNodeResponse(n.secret, nonce, res, rawResponse); err != nil {
+		log.Warnf("rejected response from node %s: %s", node.HumanIdentifier(), err.Error())
+		return err
+	}
 	var responseData interface{}
-	if err := decoder.Decode(&responseData); err != nil {
+	if err := json.Unmarshal(rawResponse, &responseData); err != nil {
 		// Parsing response failed
 		log.Tracef("%s", err.Error())
 		return err
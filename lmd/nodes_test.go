@@ -1,13 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestNodeManager(t *testing.T) {
 	extraConfig := `
 		Listen = ['test.sock', 'http://127.0.0.1:8901']
 		Nodes = ['http://127.0.0.1:8901', 'http://127.0.0.2:8902']
+		ClusterSecret = "secret"
 	`
 	peer := StartTestPeerExtra(4, 10, 10, extraConfig)
 	PauseTestPeers(peer)
@@ -84,3 +100,905 @@ func TestNodeManager(t *testing.T) {
 		panic(err.Error())
 	}
 }
+
+func TestNodeDistributedQueries(t *testing.T) {
+	extraConfig := `
+		Listen = ['test.sock', 'http://127.0.0.1:8901']
+		Nodes = ['http://127.0.0.1:8901', 'http://127.0.0.2:8902']
+		ClusterSecret = "secret"
+	`
+	peer := StartTestPeerExtra(4, 10, 20, extraConfig)
+	PauseTestPeers(peer)
+
+	// add a second node which answers through the node api of this node
+	forwarded := int32(0)
+	reverseProxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: "127.0.0.1:8901"})
+	restore := addTestNode(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&forwarded, 1)
+		reverseProxy.ServeHTTP(w, r)
+	}))
+
+	// distributed results must match the local result over all backends
+	queries := []string{
+		"GET hosts\nColumns: state\nStats: name !=\nStats: min state\nStats: max state\nStats: avg state\n",
+		"GET services\nColumns: host_name state\nStats: sum state\nStats: state = 0\n",
+		"GET hosts\nColumns: name peer_key state\nSort: name asc\nSort: peer_key asc\nLimit: 5\nOffset: 3\n",
+		"GET log\nColumns: time type message peer_key\nSort: time desc\nSort: peer_key asc\n",
+	}
+	for _, query := range queries {
+		res, err := peer.QueryString(query + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		local, err := peer.QueryString(query + "Backends: mockid0 mockid1 mockid2 mockid3\n\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(local) == 0 {
+			t.Errorf("empty result for query:\n%s", query)
+		}
+		if err = assertEq(local, res); err != nil {
+			t.Errorf("query:\n%s\n%s", query, err.Error())
+		}
+	}
+
+	// requests without columns
+	res, err := peer.QueryString("GET hosts\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(41, len(res)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("accept_passive_checks", res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	if atomic.LoadInt32(&forwarded) == 0 {
+		t.Errorf("queries have not been sent to the second node")
+	}
+
+	// total counts ignore offset and limit
+	response := testDistributedResponse(t, "GET services\nColumns: host_name description\nSort: host_name asc\nLimit: 5\nOffset: 3\n\n")
+	if err = assertEq(40, response.ResultTotal); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(5, len(response.Result)); err != nil {
+		t.Error(err)
+	}
+
+	// errors from stats requests are returned
+	PeerMapLock.RLock()
+	p := PeerMap["mockid3"]
+	PeerMapLock.RUnlock()
+	p.StatusSet("PeerStatus", PeerStatusDown)
+	p.StatusSet("LastError", "backend down")
+	response = testDistributedResponse(t, "GET hosts\nColumns: state\nStats: name !=\n\n")
+	if err = assertEq(map[string]string{"mockid3": "backend down"}, response.Failed); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(30.0, response.Result[0][1]); err != nil {
+		t.Error(err)
+	}
+	p.StatusSet("PeerStatus", PeerStatusUp)
+
+	// bulk commands are expanded with the objects from the node owning the backend
+	atomic.StoreInt32(&forwarded, 0)
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;$HOSTNAME$;0\nFilter: name = testhost_1\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expanded, err := ExpandBulkCommand(req, []string{"mockid0", "mockid1", "mockid2", "mockid3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"mockid0", "mockid1", "mockid2", "mockid3"} {
+		if err = assertEq([]string{"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0"}, expanded[id]); err != nil {
+			t.Errorf("%s: %s", id, err.Error())
+		}
+	}
+	if atomic.LoadInt32(&forwarded) == 0 {
+		t.Errorf("bulk command has not been expanded by the second node")
+	}
+
+	restore()
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestNodeDistributedTimeout(t *testing.T) {
+	extraConfig := `
+		Listen = ['test.sock', 'http://127.0.0.1:8901']
+		Nodes = ['http://127.0.0.1:8901', 'http://127.0.0.2:8902']
+		ClusterSecret = "secret"
+		NodeTimeout = 1
+	`
+	peer := StartTestPeerExtra(4, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+
+	// add a second node which does not answer in time
+	release := make(chan bool)
+	canceled := make(chan bool, 2)
+	timelimits := make(chan interface{}, 2)
+	restore := addTestNode(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requestData map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&requestData); err == nil {
+			timelimits <- requestData["timelimit"]
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			canceled <- true
+		}
+	}))
+
+	for i, query := range []string{
+		"GET hosts\nColumns: name\n\n",
+		"GET hosts\nColumns: name\nTimelimit: 1\n\n",
+	} {
+		if i == 1 {
+			// the timelimit of the request is used if it is shorter than the node timeout
+			nodeAccessor.queryTimeout = 30
+		}
+		start := time.Now()
+		res := testDistributedResponse(t, query)
+		if time.Since(start) > 3*time.Second {
+			t.Errorf("query took too long: %s", time.Since(start))
+		}
+		// data from the responding node is returned
+		if err := assertEq(20, len(res.Result)); err != nil {
+			t.Error(err)
+		}
+		if err := assertEq(2, len(res.Failed)); err != nil {
+			t.Error(err)
+		}
+		if !strings.Contains(res.Failed["mockid3"], "timeout after 1s waiting for cluster node") {
+			t.Errorf("unexpected error: %s", res.Failed["mockid3"])
+		}
+		// the timelimit is forwarded to the partner node
+		var expected interface{}
+		if i == 1 {
+			expected = float64(1)
+		}
+		if err := assertEq(expected, <-timelimits); err != nil {
+			t.Error(err)
+		}
+		// the request to the slow node is canceled after the timeout
+		select {
+		case <-canceled:
+		case <-time.After(3 * time.Second):
+			t.Errorf("request to slow node has not been canceled")
+		}
+	}
+
+	close(release)
+	restore()
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+// addTestNode adds a second cluster node served by the given handler, which
+// is responsible for the backends mockid2 and mockid3. It returns a function
+// to restore the previous nodes.
+func addTestNode(handler http.Handler) (restore func()) {
+	server := httptest.NewServer(handler)
+	node := &NodeAddress{id: "secondnode", url: server.URL + "/"}
+	nodeAccessor.lock.Lock()
+	nodeAddresses := nodeAccessor.nodeAddresses
+	nodeBackends := nodeAccessor.nodeBackends
+	nodeAccessor.nodeAddresses = append(nodeAccessor.nodeAddresses, node)
+	nodeAccessor.nodeBackends = map[string][]string{
+		nodeAccessor.thisNode.id: {"mockid0", "mockid1"},
+		node.id:                  {"mockid2", "mockid3"},
+	}
+	nodeAccessor.lock.Unlock()
+	return func() {
+		nodeAccessor.lock.Lock()
+		nodeAccessor.nodeAddresses = nodeAddresses
+		nodeAccessor.nodeBackends = nodeBackends
+		nodeAccessor.lock.Unlock()
+		server.Close()
+	}
+}
+
+func testDistributedResponse(t *testing.T, query string) *Response {
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestNodeCommandForwarding(t *testing.T) {
+	file, err := ioutil.TempFile("", "lmd-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	extraConfig := fmt.Sprintf(`
+		Listen = ['test.sock', 'http://127.0.0.1:8901']
+		Nodes = ['http://127.0.0.1:8901', 'http://127.0.0.2:8902']
+		ClusterSecret = "secret"
+		CommandDeny = ["DISABLE_*"]
+		AuditLog = "%s"
+	`, file.Name())
+	peer := StartTestPeerExtra(2, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+
+	// send commands through the node api of this node
+	results, _ := nodeAccessor.ForwardCommands(nodeAccessor.thisNode, map[string][]string{
+		"mockid0": {"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0"},
+		"unknown": {"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0"},
+	}, nil, 0)
+	if err = assertEq(nil, results["mockid0"]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("unknown backend", fmt.Sprintf("%v", results["unknown"])); err != nil {
+		t.Error(err)
+	}
+
+	// the command policy is checked again on the receiving node
+	results, _ = nodeAccessor.ForwardCommands(nodeAccessor.thisNode, map[string][]string{
+		"mockid1": {"COMMAND [0] DISABLE_NOTIFICATIONS"},
+	}, nil, 0)
+	if err = assertEq("forbidden: command DISABLE_NOTIFICATIONS is not allowed", fmt.Sprintf("%v", results["mockid1"])); err != nil {
+		t.Error(err)
+	}
+
+	authUsers := commandAuthUsers(map[string][]string{"mockid0": {"COMMAND [0] DISABLE_NOTIFICATIONS"}}, []*AuditEntry{
+		{Command: "COMMAND [0] DISABLE_NOTIFICATIONS\n", AuthUser: "demo", Peers: []string{"mockid0"}},
+	})
+	if err = assertEq(map[string][]string{"mockid0": {"demo"}}, authUsers); err != nil {
+		t.Error(err)
+	}
+
+	entries, err := readAuditLog(file.Name(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err = assertEq(nodeAccessor.ID, entry.ForwardedBy); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// backends of this node are not forwarded
+	if err = assertEq((*NodeAddress)(nil), nodeAccessor.BackendNode("mockid0")); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+	initAuditLog(&Config{})
+}
+
+func TestNodeCommandWait(t *testing.T) {
+	extraConfig := `
+		Listen = ['test.sock', 'http://127.0.0.1:8901']
+		Nodes = ['http://127.0.0.1:8901', 'http://127.0.0.2:8902']
+		ClusterSecret = "secret"
+	`
+	peer := StartTestPeerExtra(2, 10, 10, extraConfig)
+
+	// forwarded commands are confirmed on the receiving node
+	command := "COMMAND [0] REMOVE_HOST_ACKNOWLEDGEMENT;testhost_1"
+	results, confirmed := nodeAccessor.ForwardCommands(nodeAccessor.thisNode, map[string][]string{"mockid0": {command}}, nil, 5000)
+	if err := assertEq(nil, results["mockid0"]); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(map[string]bool{"mockid0": true}, confirmed); err != nil {
+		t.Error(err)
+	}
+
+	// backends of other nodes are confirmed by their owner
+	forwarded := make(chan map[string]interface{}, 5)
+	restore := addTestNode(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requestData map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&requestData)
+		switch requestData["_name"] {
+		case "ping":
+			writeSignedTestResponse(w, r, map[string]interface{}{"identifier": "secondnode", "protocol": nodeProtocolVersion, "capabilities": nodeCapabilities})
+		case "command":
+			forwarded <- requestData
+			writeSignedTestResponse(w, r, map[string]interface{}{"results": map[string]string{"mockid2": ""}, "confirmed": map[string]bool{"mockid2": true}})
+		}
+	}))
+	defer restore()
+	nodeAccessor.lock.Lock()
+	second := nodeAccessor.nodeAddresses[len(nodeAccessor.nodeAddresses)-1]
+	second.capabilities = map[string]bool{"command": true}
+	nodeAccessor.lock.Unlock()
+
+	targets := []string{"mockid0", "mockid2"}
+	res := SendCommandWithResults(&Request{Command: command, CommandWait: 10 * MaxCommandWait}, targets, &AuditEntry{Command: command, Peers: targets})
+	if err := assertEq([][]interface{}{{"mockid0", 1, "", 1}, {"mockid2", 1, "", 1}}, res.Result); err != nil {
+		t.Error(err)
+	}
+	select {
+	case requestData := <-forwarded:
+		if err := assertEq(map[string]interface{}{"mockid2": []interface{}{command}}, requestData["commands"]); err != nil {
+			t.Error(err)
+		}
+		// the wait is capped
+		if err := assertEq(float64(MaxCommandWait), requestData["command_wait"]); err != nil {
+			t.Error(err)
+		}
+	default:
+		t.Errorf("command has not been forwarded to the second node")
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestNodeBackendManagement(t *testing.T) {
+	extraConfig := `
+		Listen = ['test.sock', 'http://127.0.0.1:8901']
+		Nodes = ['http://127.0.0.1:8901', 'http://127.0.0.2:8902']
+		ClusterSecret = "secret"
+	`
+	peer := StartTestPeerExtra(2, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+	for _, id := range []string{"mockid0", "mockid1"} {
+		if err := waitForStoppedPeer(testPeerMapGet(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// add a second online node which records backend changes
+	changes := make(chan map[string]interface{}, 5)
+	restore := addTestNode(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requestData map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&requestData)
+		switch requestData["_name"] {
+		case "ping":
+			writeSignedTestResponse(w, r, map[string]interface{}{"identifier": "secondnode", "protocol": nodeProtocolVersion, "capabilities": nodeCapabilities})
+		case "backend":
+			changes <- requestData
+			writeSignedTestResponse(w, r, map[string]interface{}{"ok": true})
+		}
+	}))
+	nodeAccessor.lock.Lock()
+	second := nodeAccessor.nodeAddresses[len(nodeAccessor.nodeAddresses)-1]
+	second.capabilities = map[string]bool{"backend": true}
+	nodeAccessor.onlineNodes = []*NodeAddress{nodeAccessor.thisNode, second}
+	nodeAccessor.lock.Unlock()
+
+	// added backends are redistributed and sent to the other nodes
+	if err := backendManager.Add(&Connection{ID: "mockid5", Name: "Runtime", Source: []string{"/tmp/lmd-missing.sock"}}); err != nil {
+		t.Fatal(err)
+	}
+	var change map[string]interface{}
+	select {
+	case change = <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("backend change has not been sent to the second node")
+	}
+	if err := assertEq("add", change["action"]); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("mockid5", change["connection"].(map[string]interface{})["ID"]); err != nil {
+		t.Error(err)
+	}
+	nodeAccessor.lock.RLock()
+	owners := 0
+	for _, backends := range nodeAccessor.nodeBackends {
+		for _, id := range backends {
+			if id == "mockid5" {
+				owners++
+			}
+		}
+	}
+	nodeAccessor.lock.RUnlock()
+	if err := assertEq(1, owners); err != nil {
+		t.Error(err)
+	}
+
+	// changes from other nodes are applied without sending them again
+	_, err := nodeAccessor.SendQueryWait(nodeAccessor.thisNode, "backend", map[string]interface{}{"action": "remove", "id": "mockid5"}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	PeerMapLock.RLock()
+	_, exists := PeerMap["mockid5"]
+	PeerMapLock.RUnlock()
+	if err = assertEq(false, exists); err != nil {
+		t.Error(err)
+	}
+	nodeAccessor.lock.RLock()
+	numBackends := len(nodeAccessor.backends)
+	nodeAccessor.lock.RUnlock()
+	if err = assertEq(2, numBackends); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(0, len(changes)); err != nil {
+		t.Error(err)
+	}
+
+	nodeAccessor.lock.Lock()
+	nodeAccessor.onlineNodes = []*NodeAddress{nodeAccessor.thisNode}
+	nodeAccessor.lock.Unlock()
+	restore()
+	nodeAccessor.redistribute()
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestNodeRequestSignature(t *testing.T) {
+	now := time.Now()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	body := []byte(`{"_name":"ping"}`)
+	signature := signNodeRequest("secret", timestamp, "nonce", body)
+
+	if err := verifyNodeRequest("secret", timestamp, "nonce", signature, body, now); err != nil {
+		t.Error(err)
+	}
+	tests := map[string]error{
+		"wrong secret":  verifyNodeRequest("other", timestamp, "nonce", signature, body, now),
+		"changed body":  verifyNodeRequest("secret", timestamp, "nonce", signature, []byte(`{"_name":"table"}`), now),
+		"changed nonce": verifyNodeRequest("secret", timestamp, "other", signature, body, now),
+		"old timestamp": verifyNodeRequest("secret", timestamp, "nonce", signature, body, now.Add(5*time.Minute)),
+		"no signature":  verifyNodeRequest("secret", "", "", "", body, now),
+	}
+	for name, err := range tests {
+		if err == nil {
+			t.Errorf("%s: request should be rejected", name)
+		}
+	}
+
+	// nonces are accepted once within the time range of the timestamp
+	nonces := &nodeNonceCache{seen: make(map[string]int64)}
+	if err := nonces.Add("nonce", now); err != nil {
+		t.Error(err)
+	}
+	if err := nonces.Add("nonce", now.Add(time.Minute)); err == nil {
+		t.Errorf("replayed nonce should be rejected")
+	}
+	if err := nonces.Add("nonce", now.Add(3*time.Minute)); err != nil {
+		t.Error(err)
+	}
+}
+
+// writeSignedTestResponse sends a response signed like the node api of this node.
+func writeSignedTestResponse(w http.ResponseWriter, r *http.Request, data interface{}) {
+	body, _ := json.Marshal(data)
+	setNodeSignature(w.Header(), "secret", r.Header.Get(nodeNonceHeader), body)
+	w.Write(body)
+}
+
+func TestNodeAuthRequired(t *testing.T) {
+	saved := nodeAccessor
+	defer func() { nodeAccessor = saved }()
+	nodeAccessor = &Nodes{}
+
+	// without cluster secret, only verified client certificates are accepted
+	req := httptest.NewRequest("POST", "/query", bytes.NewBufferString(`{"_name":"ping"}`))
+	if _, err := readNodeRequest(req); err != errNodeAuthRequired {
+		t.Errorf("expected node auth error, got %v", err)
+	}
+	req = httptest.NewRequest("POST", "https://127.0.0.1/query", bytes.NewBufferString(`{"_name":"ping"}`))
+	req.TLS.VerifiedChains = [][]*x509.Certificate{{&x509.Certificate{}}}
+	if _, err := readNodeRequest(req); err != nil {
+		t.Error(err)
+	}
+
+	if err := assertEq(false, hasNodeAuth(&Config{TLSClientPems: []string{"ca.pem"}}, "http://127.0.0.1:8901")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(true, hasNodeAuth(&Config{TLSClientPems: []string{"ca.pem"}}, "https://127.0.0.1:8901")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(true, hasNodeAuth(&Config{ClusterSecret: "secret"}, "http://127.0.0.1:8901")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNodeAuth(t *testing.T) {
+	extraConfig := `
+		Listen = ['test.sock', 'http://127.0.0.1:8901']
+		Nodes = ['http://127.0.0.1:8901', 'http://127.0.0.2:8902']
+		ClusterSecret = "secret"
+	`
+	peer := StartTestPeerExtra(1, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+
+	// signed requests from this node are accepted
+	if nodeAccessor.thisNode == nil {
+		t.Fatalf("thisNode should not be nil")
+	}
+	if err := assertEq(true, nodeAccessor.thisNode.HasCapability("command")); err != nil {
+		t.Error(err)
+	}
+	results, _ := nodeAccessor.ForwardCommands(nodeAccessor.thisNode, map[string][]string{"mockid0": {"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0"}}, nil, 0)
+	if err := assertEq(nil, results["mockid0"]); err != nil {
+		t.Error(err)
+	}
+
+	// unsigned requests are rejected
+	body := []byte(`{"_name":"table","table":"hosts","protocol":3}`)
+	res, err := http.Post("http://127.0.0.1:8901/query", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if err = assertEq(http.StatusForbidden, res.StatusCode); err != nil {
+		t.Error(err)
+	}
+
+	// signed requests from nodes with another protocol version are rejected
+	body = []byte(`{"_name":"ping","protocol":1}`)
+	req, _ := http.NewRequest("POST", "http://127.0.0.1:8901/query", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	setNodeRequestSignature(req, "secret", body)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if err = assertEq(http.StatusBadRequest, res.StatusCode); err != nil {
+		t.Error(err)
+	}
+
+	// responses are signed with the nonce of the request
+	body = []byte(`{"_name":"ping","protocol":3}`)
+	req, _ = http.NewRequest("POST", "http://127.0.0.1:8901/query", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	nonce := setNodeRequestSignature(req, "secret", body)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err = verifyNodeResponse("secret", nonce, res, response); err != nil {
+		t.Error(err)
+	}
+	if err = verifyNodeResponse("secret", "other", res, response); err == nil {
+		t.Errorf("response to another request should be rejected")
+	}
+	if err = verifyNodeResponse("secret", nonce, res, []byte(`{"identifier":"forged"}`)); err == nil {
+		t.Errorf("forged response should be rejected")
+	}
+
+	// replayed requests are rejected
+	req, _ = http.NewRequest("POST", "http://127.0.0.1:8901/query", bytes.NewBuffer(body))
+	req.Header = res.Request.Header
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if err = assertEq(http.StatusForbidden, res.StatusCode); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func testNodeAddresses(num int) (nodes []*NodeAddress) {
+	for i := 1; i <= num; i++ {
+		nodes = append(nodes, &NodeAddress{url: fmt.Sprintf("http://10.0.0.%d:8080/", i)})
+	}
+	return
+}
+
+func testBackendIDs(num int) (backends []string) {
+	for i := 0; i < num; i++ {
+		backends = append(backends, fmt.Sprintf("id%d", i))
+	}
+	return
+}
+
+// testBackendOwners returns the node url for each backend.
+func testBackendOwners(distribution map[string][]string) map[string]string {
+	owners := make(map[string]string)
+	for url, backends := range distribution {
+		for _, backend := range backends {
+			owners[backend] = url
+		}
+	}
+	return owners
+}
+
+func TestNodeDistributionJoinLeave(t *testing.T) {
+	backends := testBackendIDs(200)
+	nodes := testNodeAddresses(4)
+
+	before := testBackendOwners(distributeBackends(backends, nil, nodes[:3]))
+	if err := assertEq(200, len(before)); err != nil {
+		t.Fatal(err)
+	}
+
+	// node joins: only backends moving to the new node change their owner
+	joined := testBackendOwners(distributeBackends(backends, nil, nodes))
+	moved := 0
+	for backend, url := range joined {
+		if url == before[backend] {
+			continue
+		}
+		moved++
+		if url != nodes[3].url {
+			t.Errorf("backend %s moved from %s to %s", backend, before[backend], url)
+		}
+	}
+	if moved < 20 || moved > 80 {
+		t.Errorf("expected about a quarter of the backends to move, got %d", moved)
+	}
+
+	// node leaves: only backends of the leaving node change their owner
+	left := testBackendOwners(distributeBackends(backends, nil, nodes[1:]))
+	for backend, url := range left {
+		if joined[backend] != nodes[0].url && url != joined[backend] {
+			t.Errorf("backend %s moved from %s to %s", backend, joined[backend], url)
+		}
+	}
+
+	// the distribution must not depend on the order of backends and nodes
+	reversed := make([]string, 0, len(backends))
+	for i := len(backends) - 1; i >= 0; i-- {
+		reversed = append(reversed, backends[i])
+	}
+	if err := assertEq(joined, testBackendOwners(distributeBackends(reversed, nil, []*NodeAddress{nodes[3], nodes[1], nodes[2], nodes[0]}))); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNodeDistributionWeights(t *testing.T) {
+	backends := testBackendIDs(300)
+	nodes := testNodeAddresses(2)
+	nodes[1].weight = 2
+
+	distribution := distributeBackends(backends, nil, nodes)
+	if num := len(distribution[nodes[1].url]); num < 170 || num > 230 {
+		t.Errorf("expected about two thirds of the backends on the weighted node, got %d", num)
+	}
+}
+
+func TestNodeDistributionCosts(t *testing.T) {
+	backends := testBackendIDs(20)
+	nodes := testNodeAddresses(2)
+	costs := map[string]int{}
+	for i, backend := range backends {
+		costs[backend] = 1
+		if i < 4 {
+			costs[backend] = 100
+		}
+	}
+
+	distribution := distributeBackends(backends, costs, nodes)
+	for _, node := range nodes {
+		load := 0
+		for _, backend := range distribution[node.url] {
+			load += costs[backend]
+		}
+		if load > 270 {
+			t.Errorf("node %s exceeds its share of the total cost: %d", node.url, load)
+		}
+	}
+	if err := assertEq(20, len(testBackendOwners(distribution))); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNodesTable(t *testing.T) {
+	extraConfig := `
+		Listen = ['test.sock', 'http://127.0.0.1:8901']
+		Nodes = ['http://127.0.0.1:8901', 'http://127.0.0.2:8902']
+		ClusterSecret = "secret"
+	`
+	peer := StartTestPeerExtra(2, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+
+	res, err := peer.QueryString("GET nodes\nColumns: url online this_node backends version\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{"http://127.0.0.1:8901/", 1.0, 1.0, []interface{}{"mockid0", "mockid1"}, VERSION}, res[0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq([]interface{}{"http://127.0.0.2:8902/", 0.0, 0.0, []interface{}{}, ""}, res[1]); err != nil {
+		t.Error(err)
+	}
+
+	// same table through the http api, which includes the columns header
+	httpRes, err := http.Post("http://127.0.0.1:8901/table/nodes", "application/json", bytes.NewBufferString(`{"columns":["url","online"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpRes.Body.Close()
+	var result [][]interface{}
+	if err = json.NewDecoder(httpRes.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"url", "online"}, {"http://127.0.0.1:8901/", 1.0}, {"http://127.0.0.2:8902/", 0.0}}, result); err != nil {
+		t.Error(err)
+	}
+
+	// nodes without any initialized backend still list the cluster
+	PeerMapLock.RLock()
+	for _, p := range PeerMap {
+		p.DataLock.Lock()
+		delete(p.Tables, "nodes")
+		p.DataLock.Unlock()
+	}
+	PeerMapLock.RUnlock()
+	res, err = peer.QueryString("GET nodes\nColumns: url online\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"http://127.0.0.1:8901/", 1.0}, {"http://127.0.0.2:8902/", 0.0}}, res); err != nil {
+		t.Error(err)
+	}
+	res, err = peer.QueryString("GET nodes\nStats: online = 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{1.0}}, res); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestNodeMembership(t *testing.T) {
+	extraConfig := `
+		Listen = ['test.sock', 'http://127.0.0.1:8901']
+		NodeSeeds = ['http://127.0.0.2:8902']
+		AdvertiseAddress = 'http://127.0.0.1:8901'
+		ClusterSecret = "secret"
+		ClusterQuorum = 1
+	`
+	peer := StartTestPeerExtra(1, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+
+	if err := assertEq(true, nodeAccessor.IsClustered()); err != nil {
+		t.Fatal(err)
+	}
+	if nodeAccessor.thisNode == nil {
+		t.Fatalf("thisNode should not be nil")
+	}
+	// the seed is unreachable, ClusterQuorum allows this node to work on its own
+	if err := assertEq(true, nodeAccessor.hasQuorum); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq([]string{"mockid0"}, nodeAccessor.assignedBackends); err != nil {
+		t.Error(err)
+	}
+
+	query := func(body string) {
+		req, _ := http.NewRequest("POST", "http://127.0.0.1:8901/query", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		setNodeRequestSignature(req, "secret", []byte(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	// unsigned pings and leaves do not change the members
+	for _, body := range []string{
+		`{"_name":"ping","protocol":3,"url":"http://127.0.0.4:8904/","members":["http://127.0.0.4:8904/"]}`,
+		`{"_name":"leave","protocol":3,"url":"http://127.0.0.2:8902/"}`,
+	} {
+		res, err := http.Post("http://127.0.0.1:8901/query", "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if err = assertEq(http.StatusForbidden, res.StatusCode); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := assertEq(2, len(nodeAccessor.nodeAddresses)); err != nil {
+		t.Error(err)
+	}
+
+	// a new node joins with its first ping
+	query(`{"_name":"ping","protocol":3,"url":"http://127.0.0.3:8903/","members":["http://127.0.0.3:8903/"]}`)
+	if err := assertEq(3, len(nodeAccessor.nodeAddresses)); err != nil {
+		t.Error(err)
+	}
+
+	// and leaves again
+	query(`{"_name":"leave","protocol":3,"url":"http://127.0.0.3:8903/"}`)
+	if err := assertEq(2, len(nodeAccessor.nodeAddresses)); err != nil {
+		t.Error(err)
+	}
+
+	// seeds are kept after leaving
+	query(`{"_name":"leave","protocol":3,"url":"http://127.0.0.2:8902/"}`)
+	if err := assertEq(2, len(nodeAccessor.nodeAddresses)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestNodeQuorum(t *testing.T) {
+	now := time.Now().Unix()
+	nodes := testNodeAddresses(3)
+	nodes[0].isMe = true
+	n := &Nodes{
+		lock:          NewLoggingLock("NodesLock"),
+		dynamic:       true,
+		seeds:         map[string]bool{},
+		deadTimeout:   60,
+		thisNode:      nodes[0],
+		nodeAddresses: nodes,
+	}
+	nodes[1].lastSeen = now
+	nodes[2].lastSeen = now - 120
+
+	// minority partition must not claim backends or remove nodes
+	n.onlineNodes = []*NodeAddress{nodes[0]}
+	n.updateMembership(now)
+	if err := assertEq(false, n.hasQuorum); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(3, len(n.nodeAddresses)); err != nil {
+		t.Error(err)
+	}
+
+	// majority partition removes the dead node
+	n.onlineNodes = []*NodeAddress{nodes[0], nodes[1]}
+	n.updateMembership(now)
+	if err := assertEq(true, n.hasQuorum); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(2, len(n.nodeAddresses)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNodeQuorumIsolatedStart(t *testing.T) {
+	now := time.Now().Unix()
+	nodes := testNodeAddresses(3)
+	nodes[0].isMe = true
+	n := &Nodes{
+		lock:          NewLoggingLock("NodesLock"),
+		dynamic:       true,
+		seeds:         map[string]bool{nodes[1].url: true, nodes[2].url: true},
+		deadTimeout:   60,
+		thisNode:      nodes[0],
+		nodeAddresses: nodes,
+	}
+
+	// a node which cannot reach any seed must not claim backends
+	n.onlineNodes = []*NodeAddress{nodes[0]}
+	n.updateMembership(now)
+	if err := assertEq(false, n.hasQuorum); err != nil {
+		t.Error(err)
+	}
+
+	// reaching one of the seeds is enough
+	nodes[1].lastSeen = now
+	n.onlineNodes = []*NodeAddress{nodes[0], nodes[1]}
+	n.updateMembership(now)
+	if err := assertEq(true, n.hasQuorum); err != nil {
+		t.Error(err)
+	}
+}
@@ -354,6 +354,8 @@ func InitObjects() {
 	Objects.AddTable("sites", NewBackendsTable("sites"))
 	Objects.AddTable("columns", NewColumnsTable("columns"))
 	Objects.AddTable("tables", NewColumnsTable("tables"))
+	Objects.AddTable("commands_queue", NewCommandsQueueTable())
+	Objects.AddTable("nodes", NewNodesTable())
 
 	Objects.AddTable("status", NewStatusTable())
 	Objects.AddTable("timeperiods", NewTimeperiodsTable())
@@ -404,6 +406,7 @@ func NewBackendsTable(name string) (t *Table) {
 	t.AddColumn("parent", RefNoUpdate, VirtCol, "Parent id when having cascaded LMDs.")
 	t.AddColumn("lmd_version", RefNoUpdate, VirtCol, "LMD version string.")
 	t.AddColumn("configtool", RefNoUpdate, VirtCol, "Thruks config tool configuration if available.")
+	t.AddColumn("tags", RefNoUpdate, VirtCol, "List of tags from the connection configuration.")
 
 	t.AddColumn("empty", VirtUpdate, VirtCol, "placeholder for unknown columns")
 	return
@@ -421,6 +424,40 @@ func NewColumnsTable(name string) (t *Table) {
 	return
 }
 
+// NewCommandsQueueTable returns a new commands_queue table
+func NewCommandsQueueTable() (t *Table) {
+	t = &Table{Name: "commands_queue", Virtual: true}
+	t.AddColumn("id", VirtUpdate, IntCol, "Id of the queued command, used to cancel it")
+	t.AddColumn("command", VirtUpdate, StringCol, "The queued command")
+	t.AddColumn("queued", VirtUpdate, IntCol, "Timestamp when the command has been queued")
+	t.AddColumn("attempts", VirtUpdate, IntCol, "Number of failed retries")
+	t.AddColumn("next_try", VirtUpdate, IntCol, "Timestamp of the next retry")
+	t.AddColumn("expires", VirtUpdate, IntCol, "Timestamp when the command will be dropped")
+	t.AddColumn("last_error", VirtUpdate, StringCol, "Last error message")
+	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
+	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+
+	t.AddColumn("empty", VirtUpdate, VirtCol, "placeholder for unknown columns")
+	return
+}
+
+// NewNodesTable returns a new nodes table
+func NewNodesTable() (t *Table) {
+	t = &Table{Name: "nodes", Virtual: true}
+	t.AddColumn("url", VirtUpdate, StringCol, "Url of the cluster node")
+	t.AddColumn("id", VirtUpdate, StringCol, "Id of the cluster node, changes on each restart")
+	t.AddColumn("online", VirtUpdate, IntCol, "Whether the node answered the last ping (0/1)")
+	t.AddColumn("this_node", VirtUpdate, IntCol, "Whether this is the node answering the query (0/1)")
+	t.AddColumn("weight", VirtUpdate, IntCol, "Weight of the node when distributing backends")
+	t.AddColumn("backends", VirtUpdate, StringListCol, "List of backend ids assigned to this node")
+	t.AddColumn("latency", VirtUpdate, FloatCol, "Duration of the last ping in seconds")
+	t.AddColumn("last_seen", VirtUpdate, IntCol, "Timestamp of the last answered ping")
+	t.AddColumn("version", VirtUpdate, StringCol, "LMD version of the node")
+
+	t.AddColumn("empty", VirtUpdate, VirtCol, "placeholder for unknown columns")
+	return
+}
+
 // NewStatusTable returns a new status table
 func NewStatusTable() (t *Table) {
 	t = &Table{Name: "status"}
@@ -168,6 +168,7 @@ func NewPeer(LocalConfig *Config, config *Connection, waitGroup *sync.WaitGroup,
 		Config:          config,
 		LocalConfig:     LocalConfig,
 	}
+	config.setDefaults(LocalConfig)
 	p.Status["PeerKey"] = p.ID
 	p.Status["PeerName"] = p.Name
 	p.Status["CurPeerAddrNum"] = 0
@@ -187,7 +188,12 @@ func NewPeer(LocalConfig *Config, config *Connection, waitGroup *sync.WaitGroup,
 	p.Status["ReponseTime"] = 0
 	p.Status["Idling"] = false
 	p.Status["Updating"] = false
+	p.Status["Paused"] = false
 	p.Status["Section"] = config.Section
+	p.Status["Tags"] = config.Tags
+	if config.Tags == nil {
+		p.Status["Tags"] = []string{}
+	}
 	p.Status["PeerParent"] = ""
 
 	/* initialize http client if there are any http(s) connections */
@@ -338,7 +344,7 @@ func (p *Peer) periodicUpdate(ok *bool, lastTimeperiodUpdateMinute *int) {
 	now := time.Now().Unix()
 	currentMinute, _ := strconv.Atoi(time.Now().Format("4"))
 	if idling {
-		if now < lastUpdate+p.LocalConfig.IdleInterval {
+		if now < lastUpdate+p.Config.IdleInterval {
 			return
 		}
 	} else {
@@ -353,7 +359,7 @@ func (p *Peer) periodicUpdate(ok *bool, lastTimeperiodUpdateMinute *int) {
 			*ok = p.checkIcinga2Reload()
 		}
 
-		if now < lastUpdate+p.LocalConfig.Updateinterval {
+		if now < lastUpdate+p.Config.UpdateInterval {
 			return
 		}
 	}
@@ -383,7 +389,7 @@ func (p *Peer) periodicUpdate(ok *bool, lastTimeperiodUpdateMinute *int) {
 	}
 
 	// full update interval
-	if !idling && p.LocalConfig.FullUpdateInterval > 0 && now > lastFullUpdate+p.LocalConfig.FullUpdateInterval {
+	if !idling && p.Config.FullUpdateInterval > 0 && now > lastFullUpdate+p.Config.FullUpdateInterval {
 		*ok = p.UpdateAllTables()
 		return
 	}
@@ -398,7 +404,7 @@ func (p *Peer) periodicUpdateLMD(ok *bool) {
 	p.PeerLock.RUnlock()
 
 	now := time.Now().Unix()
-	if now < lastUpdate+p.LocalConfig.Updateinterval {
+	if now < lastUpdate+p.Config.UpdateInterval {
 		return
 	}
 
@@ -434,7 +440,19 @@ func (p *Peer) periodicUpdateLMD(ok *bool) {
 		subPeer, ok := PeerMap[subID]
 		if !ok {
 			log.Debugf("[%s] starting sub peer for %s", p.Name, subName)
-			c := Connection{ID: subID, Name: subName, Source: p.Source}
+			c := Connection{
+				ID:                  subID,
+				Name:                subName,
+				Source:              p.Source,
+				UpdateInterval:      p.Config.UpdateInterval,
+				FullUpdateInterval:  p.Config.FullUpdateInterval,
+				IdleTimeout:         p.Config.IdleTimeout,
+				IdleInterval:        p.Config.IdleInterval,
+				ConnectTimeout:      p.Config.ConnectTimeout,
+				NetTimeout:          p.Config.NetTimeout,
+				StaleBackendTimeout: p.Config.StaleBackendTimeout,
+				Tags:                p.Config.Tags,
+			}
 			subPeer = NewPeer(p.LocalConfig, &c, p.waitGroup, p.shutdownChannel)
 			subPeer.ParentID = p.ID
 			subPeer.Flags |= LMDSub
@@ -489,9 +507,9 @@ func (p *Peer) updateIdleStatus() bool {
 	lastQuery := p.Status["LastQuery"].(int64)
 	idling := p.Status["Idling"].(bool)
 	p.PeerLock.RUnlock()
-	if lastQuery == 0 && lastMainRestart < now-p.LocalConfig.IdleTimeout {
+	if lastQuery == 0 && lastMainRestart < now-p.Config.IdleTimeout {
 		shouldIdle = true
-	} else if lastQuery > 0 && lastQuery < now-p.LocalConfig.IdleTimeout {
+	} else if lastQuery > 0 && lastQuery < now-p.Config.IdleTimeout {
 		shouldIdle = true
 	}
 	if !idling && shouldIdle {
@@ -520,7 +538,7 @@ func (p *Peer) StatusGet(key string) interface{} {
 // ScheduleImmediateUpdate resets all update timer so the next updateloop iteration
 // will performan an update.
 func (p *Peer) ScheduleImmediateUpdate() {
-	p.StatusSet("LastUpdate", time.Now().Unix()-p.LocalConfig.Updateinterval-1)
+	p.StatusSet("LastUpdate", time.Now().Unix()-p.Config.UpdateInterval-1)
 	p.StatusSet("LastFullServiceUpdate", time.Now().Unix()-MinFullScanInterval-1)
 	p.StatusSet("LastFullHostUpdate", time.Now().Unix()-MinFullScanInterval-1)
 }
@@ -595,6 +613,7 @@ func (p *Peer) InitAllTables() bool {
 	}
 	promPeerUpdates.WithLabelValues(p.Name).Inc()
 	promPeerUpdateDuration.WithLabelValues(p.Name).Set(duration.Seconds())
+	streamNotify(p.ID)
 
 	return true
 }
@@ -646,6 +665,7 @@ func (p *Peer) UpdateAllTables() bool {
 	log.Infof("[%s] update complete in: %s", p.Name, duration.String())
 	promPeerUpdates.WithLabelValues(p.Name).Inc()
 	promPeerUpdateDuration.WithLabelValues(p.Name).Set(duration.Seconds())
+	streamNotify(p.ID)
 	return true
 }
 
@@ -692,6 +712,8 @@ func (p *Peer) UpdateDeltaTables() bool {
 	p.PeerLock.Unlock()
 	promPeerUpdates.WithLabelValues(p.Name).Inc()
 	promPeerUpdateDuration.WithLabelValues(p.Name).Set(duration.Seconds())
+	// hosts, services, comments and downtimes have been published by the delta updates
+	streamPublish(p.ID, "status", nil)
 	return true
 }
 
@@ -727,18 +749,34 @@ func (p *Peer) UpdateDeltaTableHosts(filterStr string) (err error) {
 	lastUpdate := p.Tables[table.Name].LastUpdate
 	fieldIndex := len(keys) - 1
 	now := time.Now().Unix()
+	stateIndex, stateTypeIndex := table.GetColumn("state").Index, table.GetColumn("state_type").Index
+	hooks := currentWebhooks()
+	checkWebhooks := hooks.HasRules(table.Name)
+	changes := []StateChange{}
+	publishStream := streamHasSubscribers()
+	changedKeys := [][]string{}
 	for i := range res {
 		resRow := &res[i]
-		dataRow := nameindex[(*resRow)[fieldIndex].(string)]
+		key := (*resRow)[fieldIndex].(string)
+		dataRow := nameindex[key]
 		if dataRow == nil {
 			continue
 		}
+		previousState, previousStateType := dataRow[stateIndex], dataRow[stateTypeIndex]
 		for j, k := range indexes {
 			dataRow[k] = (*resRow)[j]
 		}
 		lastUpdate[i] = now
+		if publishStream {
+			changedKeys = append(changedKeys, []string{key})
+		}
+		if checkWebhooks && (dataRow[stateIndex] != previousState || dataRow[stateTypeIndex] != previousStateType) {
+			changes = append(changes, StateChange{Key: key, PreviousState: previousState, PreviousStateType: previousStateType})
+		}
 	}
 	p.DataLock.Unlock()
+	hooks.Check(p, table.Name, changes)
+	streamPublish(p.ID, table.Name, changedKeys)
 	promPeerUpdatedHosts.WithLabelValues(p.Name).Add(float64(len(res)))
 	log.Debugf("[%s] updated %d hosts", p.Name, len(res))
 
@@ -778,18 +816,34 @@ func (p *Peer) UpdateDeltaTableServices(filterStr string) (err error) {
 	fieldIndex1 := len(keys) - 2
 	fieldIndex2 := len(keys) - 1
 	now := time.Now().Unix()
+	stateIndex, stateTypeIndex := table.GetColumn("state").Index, table.GetColumn("state_type").Index
+	hooks := currentWebhooks()
+	checkWebhooks := hooks.HasRules(table.Name)
+	changes := []StateChange{}
+	publishStream := streamHasSubscribers()
+	changedKeys := [][]string{}
 	for i := range res {
 		resRow := &res[i]
-		dataRow := nameindex[(*resRow)[fieldIndex1].(string)+";"+(*resRow)[fieldIndex2].(string)]
+		key := (*resRow)[fieldIndex1].(string) + ";" + (*resRow)[fieldIndex2].(string)
+		dataRow := nameindex[key]
 		if dataRow == nil {
 			continue
 		}
+		previousState, previousStateType := dataRow[stateIndex], dataRow[stateTypeIndex]
 		for j, k := range indexes {
 			dataRow[k] = (*resRow)[j]
 		}
 		lastUpdate[i] = now
+		if publishStream {
+			changedKeys = append(changedKeys, []string{(*resRow)[fieldIndex1].(string), (*resRow)[fieldIndex2].(string)})
+		}
+		if checkWebhooks && (dataRow[stateIndex] != previousState || dataRow[stateTypeIndex] != previousStateType) {
+			changes = append(changes, StateChange{Key: key, PreviousState: previousState, PreviousStateType: previousStateType})
+		}
 	}
 	p.DataLock.Unlock()
+	hooks.Check(p, table.Name, changes)
+	streamPublish(p.ID, table.Name, changedKeys)
 	promPeerUpdatedServices.WithLabelValues(p.Name).Add(float64(len(res)))
 	log.Debugf("[%s] updated %d services", p.Name, len(res))
 
@@ -945,6 +999,7 @@ func (p *Peer) UpdateDeltaCommentsOrDowntimes(name string) (err error) {
 	p.DataLock.Lock()
 	idIndex := p.Tables[table.Name].Index
 	missingIds := []string{}
+	changedKeys := [][]string{}
 	resIndex := make(map[string]bool)
 	for i := range res {
 		resRow := &res[i]
@@ -953,6 +1008,7 @@ func (p *Peer) UpdateDeltaCommentsOrDowntimes(name string) (err error) {
 		if !ok {
 			log.Debugf("adding %s with id %s", name, id)
 			missingIds = append(missingIds, id)
+			changedKeys = append(changedKeys, []string{id})
 		}
 		resIndex[id] = true
 	}
@@ -966,6 +1022,7 @@ func (p *Peer) UpdateDeltaCommentsOrDowntimes(name string) (err error) {
 			tmp := idIndex[id]
 			data.RemoveItem(tmp)
 			delete(idIndex, id)
+			changedKeys = append(changedKeys, []string{id})
 		}
 	}
 	p.Tables[table.Name] = data
@@ -995,6 +1052,7 @@ func (p *Peer) UpdateDeltaCommentsOrDowntimes(name string) (err error) {
 		p.Tables[table.Name] = data
 		p.DataLock.Unlock()
 	}
+	streamPublish(p.ID, table.Name, changedKeys)
 
 	log.Debugf("[%s] updated %s", p.Name, name)
 	return
@@ -1118,7 +1176,7 @@ func (p *Peer) sendTo(req *Request, query string, peerAddr string, conn net.Conn
 
 	// tcp/unix connections
 	// set read timeout
-	conn.SetDeadline(time.Now().Add(time.Duration(p.LocalConfig.NetTimeout) * time.Second))
+	conn.SetDeadline(time.Now().Add(time.Duration(p.Config.NetTimeout) * time.Second))
 	fmt.Fprintf(conn, "%s", query)
 
 	// close write part of connection
@@ -1225,14 +1283,14 @@ func (p *Peer) GetConnection() (conn net.Conn, connType string, err error) {
 		case "tcp":
 			fallthrough
 		case "unix":
-			conn, err = net.DialTimeout(connType, peerAddr, time.Duration(p.LocalConfig.ConnectTimeout)*time.Second)
+			conn, err = net.DialTimeout(connType, peerAddr, time.Duration(p.Config.ConnectTimeout)*time.Second)
 		case "tls":
 			tlsConfig, cErr := p.getTLSClientConfig()
 			if cErr != nil {
 				err = cErr
 			} else {
 				dialer := new(net.Dialer)
-				dialer.Timeout = time.Duration(p.LocalConfig.ConnectTimeout) * time.Second
+				dialer.Timeout = time.Duration(p.Config.ConnectTimeout) * time.Second
 				conn, err = tls.DialWithDialer(dialer, "tcp", peerAddr, tlsConfig)
 			}
 		case "http":
@@ -1252,7 +1310,7 @@ func (p *Peer) GetConnection() (conn net.Conn, connType string, err error) {
 					err = &PeerError{msg: fmt.Sprintf("unknown scheme: %s", uri.Scheme), kind: ConnectionError}
 				}
 			}
-			conn, err = net.DialTimeout("tcp", host, time.Duration(p.LocalConfig.ConnectTimeout)*time.Second)
+			conn, err = net.DialTimeout("tcp", host, time.Duration(p.Config.ConnectTimeout)*time.Second)
 			if conn != nil {
 				conn.Close()
 			}
@@ -1315,7 +1373,7 @@ func (p *Peer) setNextAddrFromErr(err error) {
 	now := time.Now().Unix()
 	lastOnline := p.Status["LastOnline"].(int64)
 	log.Debugf("[%s] last online: %s", p.Name, timeOrNever(lastOnline))
-	if lastOnline < now-int64(p.LocalConfig.StaleBackendTimeout) || (p.ErrorCount > numSources && lastOnline <= 0) {
+	if lastOnline < now-int64(p.Config.StaleBackendTimeout) || (p.ErrorCount > numSources && lastOnline <= 0) {
 		if p.Status["PeerStatus"].(PeerStatus) != PeerStatusDown {
 			log.Warnf("[%s] site went offline: %s", p.Name, err.Error())
 			// clear existing data from memory
@@ -1338,13 +1396,11 @@ func (p *Peer) CreateObjectByType(table *Table) (_, err error) {
 	}
 
 	keys := table.GetInitialKeys(p.Flags)
-	refs := make(map[string][][]interface{})
-	index := make(map[string][]interface{})
 
 	// complete virtual table ends here
 	if len(keys) == 0 || table.Virtual {
 		p.DataLock.Lock()
-		p.Tables[table.Name] = DataTable{Table: table, Data: make([][]interface{}, 1), Refs: refs, Index: index}
+		p.Tables[table.Name] = DataTable{Table: table, Data: make([][]interface{}, 1), Refs: make(map[string][][]interface{}), Index: make(map[string][]interface{})}
 		p.DataLock.Unlock()
 		return
 	}
@@ -1370,6 +1426,39 @@ func (p *Peer) CreateObjectByType(table *Table) (_, err error) {
 		log.Debugf("[%s] fetched %d initial %s objects", p.Name, len(res), table.Name)
 	}
 
+	if err = p.createObjectsFromData(table, res); err != nil {
+		return
+	}
+
+	now := time.Now().Unix()
+	p.PeerLock.Lock()
+	p.Status["LastUpdate"] = now
+	p.Status["LastFullUpdate"] = now
+	p.PeerLock.Unlock()
+
+	return
+}
+
+// rowRefs returns the references of a single cached row, using the row number 0.
+// DataLock must be held.
+func (p *Peer) rowRefs(table *Table, row []interface{}) map[string][][]interface{} {
+	refs := make(map[string][][]interface{})
+	for _, refNum := range table.RefColCacheIndexes {
+		refCol := table.Columns[refNum]
+		key := fmt.Sprintf("%v", row[refCol.RefIndex])
+		if refCol.Name == "services" {
+			key = fmt.Sprintf("%v;%s", row[table.ColumnsIndex["hostname_index"]], key)
+		}
+		refs[refCol.Name] = [][]interface{}{p.Tables[refCol.Name].Index[key]}
+	}
+	return refs
+}
+
+// createObjectsFromData creates references and indexes for the given rows and stores them as table data.
+func (p *Peer) createObjectsFromData(table *Table, res [][]interface{}) (err error) {
+	refs := make(map[string][][]interface{})
+	index := make(map[string][]interface{})
+
 	// expand references, create a hash entry for each reference type, ex.: hosts
 	// with an array containing the references (using the same index as the original row)
 	for _, refNum := range table.RefColCacheIndexes {
@@ -1417,10 +1506,6 @@ func (p *Peer) CreateObjectByType(table *Table) (_, err error) {
 	p.DataLock.Lock()
 	p.Tables[table.Name] = DataTable{Table: table, Data: res, Refs: refs, Index: index, LastUpdate: lastUpdate}
 	p.DataLock.Unlock()
-	p.PeerLock.Lock()
-	p.Status["LastUpdate"] = now
-	p.Status["LastFullUpdate"] = now
-	p.PeerLock.Unlock()
 
 	return
 }
@@ -1445,7 +1530,7 @@ func (p *Peer) createIndex(table *Table, res *[][]interface{}, index *map[string
 		}
 		promServiceCount.WithLabelValues(p.Name).Set(float64(len((*res))))
 	}
-	if table.Name == "hostgroups" || table.Name == "servicegroups" {
+	if table.Name == "hostgroups" || table.Name == "servicegroups" || table.Name == "contacts" {
 		indexField := table.ColumnsIndex["name"]
 		for i := range *res {
 			row := (*res)[i]
@@ -1490,7 +1575,7 @@ func (p *Peer) checkStatusFlags(table *Table) {
 			p.PeerLock.Unlock()
 			p.DataLock.RUnlock()
 			// force immediate update to fetch all sites
-			p.StatusSet("LastUpdate", time.Now().Unix()-p.LocalConfig.Updateinterval)
+			p.StatusSet("LastUpdate", time.Now().Unix()-p.Config.UpdateInterval)
 			ok := true
 			p.periodicUpdateLMD(&ok)
 			return
@@ -1639,6 +1724,14 @@ func (p *Peer) UpdateObjectByType(table *Table) (restartRequired bool, err error
 		// check for changed timeperiods, because we have to update the linked hosts and services as well
 		p.updateTimeperiodsData(table, res, indexes)
 	} else {
+		// full updates may change states as well
+		hooks := currentWebhooks()
+		checkWebhooks := hooks.HasRules(table.Name)
+		stateIndex, stateTypeIndex := -1, -1
+		if checkWebhooks {
+			stateIndex, stateTypeIndex = table.GetColumn("state").Index, table.GetColumn("state_type").Index
+		}
+		changes := []StateChange{}
 		p.DataLock.Lock()
 		_, hasLastCacheUpdate := table.ColumnsIndex["lmd_last_cache_update"]
 		now := time.Now().Unix()
@@ -1651,14 +1744,22 @@ func (p *Peer) UpdateObjectByType(table *Table) (restartRequired bool, err error
 				p.DataLock.Unlock()
 				return
 			}
+			var previousState, previousStateType interface{}
+			if checkWebhooks {
+				previousState, previousStateType = data[i][stateIndex], data[i][stateTypeIndex]
+			}
 			for j, k := range indexes {
 				data[i][k] = row[j]
 			}
 			if hasLastCacheUpdate {
 				lastUpdate[i] = now
 			}
+			if checkWebhooks && (data[i][stateIndex] != previousState || data[i][stateTypeIndex] != previousStateType) {
+				changes = append(changes, StateChange{Key: webhookKey(table, data[i]), PreviousState: previousState, PreviousStateType: previousStateType})
+			}
 		}
 		p.DataLock.Unlock()
+		hooks.Check(p, table.Name, changes)
 	}
 
 	switch table.Name {
@@ -1776,6 +1877,8 @@ func (p *Peer) GetVirtRowValue(col *ResultColumn, row *[]interface{}, rowNum int
 		return numberToFloat(&value)
 	case StringCol:
 		return value
+	case StringListCol:
+		return value
 	case CustomVarCol:
 		return value
 	case HashMapCol:
@@ -2004,7 +2107,7 @@ func (p *Peer) HTTPQuery(peerAddr string, query string) (res []byte, err error)
 
 // HTTPPostQuery returns response array from thruk api
 func (p *Peer) HTTPPostQuery(peerAddr string, postData url.Values) (output []interface{}, result *HTTPResult, err error) {
-	p.HTTPClient.Timeout = time.Duration(p.LocalConfig.NetTimeout) * time.Second
+	p.HTTPClient.Timeout = time.Duration(p.Config.NetTimeout) * time.Second
 	response, err := p.HTTPClient.PostForm(completePeerHTTPAddr(peerAddr), postData)
 	if err != nil {
 		return
@@ -2095,7 +2198,7 @@ func SpinUpPeers(peers []string) {
 				log.Debugf("[%s] spin up update done", peer.Name)
 			} else {
 				// force new update sooner
-				peer.StatusSet("LastUpdate", time.Now().Unix()-peer.LocalConfig.Updateinterval)
+				peer.StatusSet("LastUpdate", time.Now().Unix()-peer.Config.UpdateInterval)
 			}
 		}(p, waitgroup)
 	}
@@ -2125,6 +2228,18 @@ func (p *Peer) BuildLocalResponseData(res *Response, indexes *[]int) (int, *[][]
 	if table.Name == "tables" || table.Name == "columns" {
 		data = Objects.GetTableColumnsData()
 	}
+	if table.Name == "commands_queue" {
+		data = nil
+		if commandQueue != nil {
+			data = commandQueue.GetTableData(p.ID)
+		}
+	}
+	if table.Name == "nodes" {
+		data = nil
+		if nodeAccessor != nil {
+			data = nodeAccessor.GetTableData()
+		}
+	}
 
 	if len(data) == 0 {
 		return 0, nil, nil
@@ -35,6 +35,49 @@ var (
 		},
 		[]string{"listen"},
 	)
+	promFrontendCommands = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "commands",
+			Help:      "External Commands Counter",
+		},
+		[]string{"command"},
+	)
+	promQueryQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "query_queue_depth",
+			Help:      "Number of Queries Waiting for a Free Slot",
+		},
+	)
+	promQueriesRunning = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "queries_running",
+			Help:      "Number of Concurrently Running Queries",
+		},
+	)
+	promQueryRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "query_rejections",
+			Help:      "Rejected Queries by Reason",
+		},
+		[]string{"reason"},
+	)
+	promWebhookNotifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "webhook",
+			Name:      "notifications",
+			Help:      "Webhook Notifications by Result",
+		},
+		[]string{"rule", "result"},
+	)
 
 	promPeerUpdateInterval = prometheus.NewGauge(
 		prometheus.GaugeOpts{
@@ -157,6 +200,11 @@ func initPrometheus(LocalConfig *Config) (prometheusListener *net.Listener) {
 	prometheus.Register(promFrontendConnections)
 	prometheus.Register(promFrontendBytesSend)
 	prometheus.Register(promFrontendBytesReceived)
+	prometheus.Register(promFrontendCommands)
+	prometheus.Register(promQueryQueueDepth)
+	prometheus.Register(promQueriesRunning)
+	prometheus.Register(promQueryRejections)
+	prometheus.Register(promWebhookNotifications)
 	prometheus.Register(promPeerUpdateInterval)
 	prometheus.Register(promPeerConnections)
 	prometheus.Register(promPeerFailedConnections)
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+// Replica is the cache of a backend replicated from its primary node.
+type Replica struct {
+	PeerID     string
+	Serial     string // snapshot serial, deltas only apply to the same snapshot
+	Flags      OptionalFlags
+	Updated    int64 // last update of the primary
+	FullUpdate int64 // last full update of the primary
+	Tables     map[string][][]interface{}
+	Received   time.Time
+}
+
+// replicationState tracks what has been sent to the secondary node of a backend.
+type replicationState struct {
+	target     string
+	serial     string
+	fullUpdate int64
+	hashes     map[string][]uint64 // hashed dynamic values of each host and service row and a single hash of all other tables
+}
+
+// Replicator streams the cache of the backends of this node to their secondary
+// nodes and keeps the replicas received from other nodes, so a failover can
+// serve data immediately while the new owner catches up.
+type Replicator struct {
+	noCopy   noCopy
+	lock     *LoggingLock
+	nodes    *Nodes
+	targets  map[string]*NodeAddress // secondary node for each backend of this node
+	states   map[string]*replicationState
+	replicas map[string]*Replica // replicas kept for backends of other nodes
+	running  bool
+}
+
+// replicationDeltaTables contains the tables which are sent as delta of their dynamic columns.
+var replicationDeltaTables = []string{"hosts", "services"}
+
+// NewReplicator creates a new replicator for the given cluster.
+func NewReplicator(n *Nodes) *Replicator {
+	return &Replicator{
+		lock:     NewLoggingLock("ReplicatorLock"),
+		nodes:    n,
+		targets:  make(map[string]*NodeAddress),
+		states:   make(map[string]*replicationState),
+		replicas: make(map[string]*Replica),
+	}
+}
+
+// isReplicatedTable returns true if the table data is fetched from the backend
+// and therefore has to be replicated. All other tables are created locally.
+func isReplicatedTable(table *Table, flags OptionalFlags) bool {
+	if table.Virtual || table.GroupBy || table.PassthroughOnly {
+		return false
+	}
+	return len(table.GetInitialKeys(flags)) > 0
+}
+
+// SetTargets sets the secondary nodes for the backends of this node and drops
+// all replicas of backends this node is not the secondary for anymore.
+func (r *Replicator) SetTargets(targets map[string]*NodeAddress, secondaryFor map[string]bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.targets = targets
+	for id := range r.states {
+		if _, ok := targets[id]; !ok {
+			delete(r.states, id)
+		}
+	}
+	for id := range r.replicas {
+		if !secondaryFor[id] {
+			log.Debugf("[%s] dropping replica, this node is not the secondary anymore", id)
+			delete(r.replicas, id)
+		}
+	}
+}
+
+// Take removes and returns the replica of the given backend or nil if there is none.
+func (r *Replicator) Take(peerID string) *Replica {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	replica, ok := r.replicas[peerID]
+	if !ok {
+		return nil
+	}
+	delete(r.replicas, peerID)
+	return replica
+}
+
+// Run sends snapshots or deltas of all backends of this node to their secondary node.
+// It does nothing if the previous run has not finished yet.
+func (r *Replicator) Run() {
+	r.lock.Lock()
+	if r.running {
+		r.lock.Unlock()
+		return
+	}
+	r.running = true
+	targets := make(map[string]*NodeAddress, len(r.targets))
+	for id, node := range r.targets {
+		targets[id] = node
+	}
+	r.lock.Unlock()
+
+	defer func() {
+		r.lock.Lock()
+		r.running = false
+		r.lock.Unlock()
+	}()
+
+	for id, node := range targets {
+		PeerMapLock.RLock()
+		p, ok := PeerMap[id]
+		PeerMapLock.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := r.replicate(p, node); err != nil {
+			log.Debugf("[%s] replication to node %s failed: %s", p.Name, node.HumanIdentifier(), err.Error())
+		}
+	}
+}
+
+// replicate sends a snapshot of the peer cache to the secondary node, or only
+// the changes if the node has received the current snapshot already.
+func (r *Replicator) replicate(p *Peer, node *NodeAddress) (err error) {
+	p.PeerLock.RLock()
+	status := p.Status["PeerStatus"].(PeerStatus)
+	updated := p.Status["LastUpdate"].(int64)
+	fullUpdate := p.Status["LastFullUpdate"].(int64)
+	flags := p.Flags
+	p.PeerLock.RUnlock()
+	if status != PeerStatusUp || flags&LMD == LMD || p.ParentID != "" {
+		// nothing to replicate, lmd backends and their sub peers are not supported
+		return
+	}
+
+	if !node.HasCapability("replicate") {
+		return fmt.Errorf("node does not support replication")
+	}
+
+	r.lock.RLock()
+	state := r.states[p.ID]
+	r.lock.RUnlock()
+	snapshot := state == nil || state.target != node.url || state.fullUpdate != fullUpdate
+	if snapshot {
+		state = &replicationState{
+			target:     node.url,
+			serial:     strconv.FormatInt(time.Now().UnixNano(), 10),
+			fullUpdate: fullUpdate,
+			hashes:     make(map[string][]uint64),
+		}
+	}
+
+	tables, delta := p.replicationData(snapshot, state.hashes)
+	requestData := make(map[string]interface{})
+	requestData["backend"] = p.ID
+	requestData["serial"] = state.serial
+	requestData["snapshot"] = snapshot
+	requestData["flags"] = int(flags)
+	requestData["updated"] = updated
+	requestData["full_update"] = fullUpdate
+	requestData["tables"] = tables
+	requestData["delta"] = delta
+	_, err = r.nodes.SendQueryWait(node, "replicate", requestData, 60*time.Second)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil {
+		// start over with a new snapshot
+		delete(r.states, p.ID)
+		return
+	}
+	r.states[p.ID] = state
+	if snapshot {
+		log.Debugf("[%s] sent snapshot to node %s", p.Name, node.HumanIdentifier())
+	}
+	return
+}
+
+// replicationData returns the rows of all replicated tables. Hosts and services
+// are only included in full for snapshots, otherwise only rows with changed
+// dynamic columns are returned as delta, prefixed by their row number. All other
+// tables are only included for snapshots or if they have changed.
+func (p *Peer) replicationData(snapshot bool, hashes map[string][]uint64) (tables map[string][][]interface{}, delta map[string][][]interface{}) {
+	tables = make(map[string][][]interface{})
+	delta = make(map[string][][]interface{})
+	p.DataLock.RLock()
+	defer p.DataLock.RUnlock()
+	for _, name := range Objects.Order {
+		table := Objects.Tables[name]
+		if !isReplicatedTable(table, p.Flags) {
+			continue
+		}
+		data, ok := p.Tables[name]
+		if !ok {
+			continue
+		}
+		isDelta := false
+		for _, deltaName := range replicationDeltaTables {
+			if name == deltaName {
+				isDelta = true
+			}
+		}
+		if !isDelta {
+			h := fnv.New64a()
+			for _, row := range data.Data {
+				fmt.Fprintf(h, "%v\n", row)
+			}
+			current := h.Sum64()
+			previous := hashes[name]
+			hashes[name] = []uint64{current}
+			if !snapshot && len(previous) == 1 && previous[0] == current {
+				continue
+			}
+		}
+		if !isDelta || snapshot {
+			// copy rows, they will be encoded after releasing the lock
+			rows := make([][]interface{}, len(data.Data))
+			for i, row := range data.Data {
+				rows[i] = make([]interface{}, len(row))
+				copy(rows[i], row)
+			}
+			tables[name] = rows
+		}
+		if !isDelta {
+			continue
+		}
+		_, indexes := table.GetDynamicColumns(p.Flags)
+		previous := hashes[name]
+		current := make([]uint64, len(data.Data))
+		changed := make([][]interface{}, 0)
+		for i, row := range data.Data {
+			values := make([]interface{}, 0, len(indexes)+1)
+			values = append(values, i)
+			for _, k := range indexes {
+				if k < len(row) {
+					values = append(values, row[k])
+				} else {
+					values = append(values, nil)
+				}
+			}
+			h := fnv.New64a()
+			fmt.Fprintf(h, "%v", values[1:])
+			current[i] = h.Sum64()
+			if !snapshot && (i >= len(previous) || previous[i] != current[i]) {
+				changed = append(changed, values)
+			}
+		}
+		hashes[name] = current
+		if !snapshot {
+			delta[name] = changed
+		}
+	}
+	return
+}
+
+// Receive stores a snapshot or applies a delta sent by the primary node of a backend.
+func (r *Replicator) Receive(requestData map[string]interface{}) (err error) {
+	peerID, _ := requestData["backend"].(string)
+	serial, _ := requestData["serial"].(string)
+	snapshot, _ := requestData["snapshot"].(bool)
+	if peerID == "" || serial == "" {
+		return fmt.Errorf("missing backend or serial")
+	}
+	tables, err := interfaceToRows(requestData["tables"])
+	if err != nil {
+		return
+	}
+	delta, err := interfaceToRows(requestData["delta"])
+	if err != nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	replica := r.replicas[peerID]
+	if snapshot {
+		flags, _ := requestData["flags"].(float64)
+		replica = &Replica{
+			PeerID: peerID,
+			Serial: serial,
+			Flags:  OptionalFlags(flags),
+			Tables: tables,
+		}
+		r.replicas[peerID] = replica
+		log.Debugf("[%s] received snapshot", peerID)
+	} else {
+		if replica == nil || replica.Serial != serial {
+			return fmt.Errorf("replica of %s out of sync", peerID)
+		}
+		for name, rows := range tables {
+			replica.Tables[name] = rows
+		}
+		for name, changed := range delta {
+			if err = replica.applyDelta(name, changed); err != nil {
+				delete(r.replicas, peerID)
+				return
+			}
+		}
+	}
+	updated, _ := requestData["updated"].(float64)
+	fullUpdate, _ := requestData["full_update"].(float64)
+	replica.Updated = int64(updated)
+	replica.FullUpdate = int64(fullUpdate)
+	replica.Received = time.Now()
+	return
+}
+
+// applyDelta updates the dynamic columns of the changed rows.
+func (replica *Replica) applyDelta(name string, changed [][]interface{}) error {
+	table, ok := Objects.Tables[name]
+	if !ok {
+		return fmt.Errorf("unknown table %s", name)
+	}
+	rows := replica.Tables[name]
+	_, indexes := table.GetDynamicColumns(replica.Flags)
+	for _, values := range changed {
+		num, ok := values[0].(float64)
+		if !ok || int(num) >= len(rows) || len(values) != len(indexes)+1 {
+			return fmt.Errorf("replica of %s out of sync", replica.PeerID)
+		}
+		row := rows[int(num)]
+		for j, k := range indexes {
+			if k < len(row) {
+				row[k] = values[j+1]
+			}
+		}
+	}
+	return nil
+}
+
+// interfaceToRows converts decoded json tables into rows.
+func interfaceToRows(raw interface{}) (tables map[string][][]interface{}, err error) {
+	tables = make(map[string][][]interface{})
+	if raw == nil {
+		return
+	}
+	rawTables, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tables must be an object")
+	}
+	for name, rawRows := range rawTables {
+		list, ok := rawRows.([]interface{})
+		if !ok && rawRows != nil {
+			return nil, fmt.Errorf("table %s must be a list", name)
+		}
+		rows := make([][]interface{}, len(list))
+		for i, rawRow := range list {
+			if rows[i], ok = rawRow.([]interface{}); !ok {
+				return nil, fmt.Errorf("rows of table %s must be lists", name)
+			}
+		}
+		tables[name] = rows
+	}
+	return
+}
+
+// RestoreReplica fills the cache from a replica, so the peer can answer queries
+// right away. The update loop continues with delta updates from the time of the replica.
+func (p *Peer) RestoreReplica(replica *Replica) (err error) {
+	p.PeerLock.Lock()
+	p.Flags = replica.Flags
+	p.PeerLock.Unlock()
+	for _, name := range Objects.Order {
+		table := Objects.Tables[name]
+		if !isReplicatedTable(table, p.Flags) {
+			// virtual and groupby tables are created from local data
+			if _, err = p.CreateObjectByType(table); err != nil {
+				return
+			}
+			continue
+		}
+		rows, ok := replica.Tables[name]
+		if !ok {
+			return fmt.Errorf("replica contains no %s", name)
+		}
+		if err = p.createObjectsFromData(table, rows); err != nil {
+			return
+		}
+	}
+
+	p.DataLock.RLock()
+	status := p.Tables["status"]
+	if len(status.Data) == 0 {
+		p.DataLock.RUnlock()
+		return fmt.Errorf("replica contains no status")
+	}
+	programStart := status.Data[0][status.Table.ColumnsIndex["program_start"]]
+	p.DataLock.RUnlock()
+	currentMinute, _ := strconv.Atoi(time.Now().Format("4"))
+	p.resetErrors()
+	p.PeerLock.Lock()
+	p.Status["LastUpdateOK"] = true
+	p.Status["LastTimeperiodUpdateMinute"] = currentMinute
+	p.Status["LastUpdate"] = replica.Updated
+	p.Status["LastFullUpdate"] = replica.FullUpdate
+	p.Status["ProgramStart"] = programStart
+	p.PeerLock.Unlock()
+	log.Infof("[%s] restored cache from replica received %s ago", p.Name, time.Since(replica.Received).String())
+	return
+}
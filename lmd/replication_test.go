@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNodeReplication(t *testing.T) {
+	extraConfig := `
+		Listen = ['test.sock', 'http://127.0.0.1:8901']
+		Nodes = ['http://127.0.0.1:8901', 'http://127.0.0.2:8902']
+		ClusterSecret = "secret"
+		ClusterReplication = true
+	`
+	peer := StartTestPeerExtra(1, 10, 20, extraConfig)
+	PauseTestPeers(peer)
+
+	replicator := nodeAccessor.replicator
+	if replicator == nil {
+		t.Fatalf("replicator should not be nil")
+	}
+	PeerMapLock.RLock()
+	p := PeerMap["mockid0"]
+	PeerMapLock.RUnlock()
+
+	// send snapshot through the node api of this node
+	if err := replicator.replicate(p, nodeAccessor.thisNode); err != nil {
+		t.Fatal(err)
+	}
+	replica := replicator.replicas["mockid0"]
+	if replica == nil {
+		t.Fatalf("replica should have been received")
+	}
+	if err := assertEq(10, len(replica.Tables["hosts"])); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(10, len(replica.Tables["services"])); err != nil {
+		t.Error(err)
+	}
+
+	// change a host and send the delta
+	p.DataLock.Lock()
+	hosts := p.Tables["hosts"]
+	hosts.Data[2][hosts.Table.ColumnsIndex["plugin_output"]] = "changed output"
+	p.DataLock.Unlock()
+	hashes := make(map[string][]uint64)
+	for name, list := range replicator.states["mockid0"].hashes {
+		hashes[name] = list
+	}
+	tables, delta := p.replicationData(false, hashes)
+	if err := assertEq(1, len(delta["hosts"])); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(0, len(delta["services"])); err != nil {
+		t.Error(err)
+	}
+	if _, ok := tables["hosts"]; ok {
+		t.Errorf("deltas must not contain all hosts")
+	}
+	// unchanged tables are not sent again
+	if err := assertEq(0, len(tables)); err != nil {
+		t.Errorf("unchanged tables must not be sent: %s", err.Error())
+	}
+	if err := replicator.replicate(p, nodeAccessor.thisNode); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq("changed output", replica.Tables["hosts"][2][hosts.Table.ColumnsIndex["plugin_output"]]); err != nil {
+		t.Error(err)
+	}
+
+	// restore the cache from the replica
+	p.Clear()
+	if err := p.RestoreReplica(replicator.Take("mockid0")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := peer.QueryString("GET hosts\nColumns: name plugin_output\nFilter: plugin_output = changed output\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Error(err)
+	}
+	res, err = peer.QueryString("GET services\nColumns: host_name description\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10, len(res)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq((*Replica)(nil), replicator.Take("mockid0")); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
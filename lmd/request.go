@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
@@ -39,6 +38,14 @@ type Request struct {
 	WaitCondition     []*Filter
 	WaitObject        string
 	KeepAlive         bool
+	AuthUser          string
+	ForwardedBy       string // cluster node which forwarded the command, set by the node api only
+	CommandWait       int
+	SendCommandResult bool
+	CommandDryRun     bool
+	Timelimit         int
+	Auth              string
+	authUserApplied   bool // AuthUser filter has been added, see ApplyAuthUser
 }
 
 // SortDirection can be either Asc or Desc
@@ -94,7 +101,7 @@ func (op *GroupOperator) String() string {
 	return ""
 }
 
-var reRequestAction = regexp.MustCompile(`^GET ([a-z]+)$`)
+var reRequestAction = regexp.MustCompile(`^GET ([a-z_]+)$`)
 var reRequestCommand = regexp.MustCompile(`^COMMAND (\[\d+\].*)$`)
 
 // ParseRequest reads from a connection and returns a single requests.
@@ -160,6 +167,9 @@ func (req *Request) String() (str string) {
 	if req.Offset > 0 {
 		str += fmt.Sprintf("Offset: %d\n", req.Offset)
 	}
+	if req.Timelimit > 0 {
+		str += fmt.Sprintf("Timelimit: %d\n", req.Timelimit)
+	}
 	for _, f := range req.Filter {
 		str += f.String("")
 	}
@@ -234,10 +244,55 @@ func NewRequest(b *bufio.Reader) (req *Request, size int, err error) {
 		}
 	}
 
+	if err = req.ApplyAuthUser(); err != nil {
+		return
+	}
 	err = req.VerifyRequestIntegrity()
 	return
 }
 
+// authUserColumns contains the contact columns used to filter queries with an AuthUser.
+// Objects are visible if the AuthUser is in any of these columns. Tables which are not
+// listed here are not filtered, like in livestatus.
+var authUserColumns = map[string][]string{
+	"hosts":               {"contacts"},
+	"hostsbygroup":        {"contacts"},
+	"services":            {"contacts", "host_contacts"},
+	"servicesbygroup":     {"contacts", "host_contacts"},
+	"servicesbyhostgroup": {"contacts", "host_contacts"},
+	"comments":            {"host_contacts", "service_contacts"},
+	"downtimes":           {"host_contacts", "service_contacts"},
+	"log":                 {"current_host_contacts", "current_service_contacts"},
+}
+
+// ApplyAuthUser limits the result of a query to the objects of the AuthUser contact by adding
+// a filter on the contact columns. Commands are not changed, they are checked by the command policy.
+func (req *Request) ApplyAuthUser() error {
+	if req.AuthUser == "" || req.Command != "" || req.Table == "" || req.authUserApplied {
+		return nil
+	}
+	columns, ok := authUserColumns[req.Table]
+	if !ok {
+		return nil
+	}
+	stack := []*Filter{}
+	for _, column := range columns {
+		line := "Filter: " + column + " >= " + req.AuthUser
+		if err := ParseFilter(column+" >= "+req.AuthUser, &line, req.Table, &stack); err != nil {
+			return err
+		}
+	}
+	if len(stack) > 1 {
+		line := fmt.Sprintf("Or: %d", len(stack))
+		if err := ParseFilterOp("or", strconv.Itoa(len(stack)), &line, &stack); err != nil {
+			return err
+		}
+	}
+	req.Filter = append(req.Filter, stack...)
+	req.authUserApplied = true
+	return nil
+}
+
 // ParseRequestAction parses the first line from a request which
 // may start with GET or COMMAND
 func (req *Request) ParseRequestAction(firstLine *string) (valid bool, err error) {
@@ -264,6 +319,8 @@ func (req *Request) ParseRequestAction(firstLine *string) (valid bool, err error
 	if strings.HasPrefix(*firstLine, "COMMAND ") {
 		matched := reRequestCommand.FindStringSubmatch(*firstLine)
 		req.Command = matched[0]
+		// filter headers of bulk commands refer to the placeholder table
+		req.Table = BulkCommandTable(req.Command)
 		valid = true
 		return
 	}
@@ -280,6 +337,14 @@ func (req *Request) ParseRequestAction(firstLine *string) (valid bool, err error
 // VerifyRequestIntegrity checks for logical errors in the request
 // It returns any error encountered.
 func (req *Request) VerifyRequestIntegrity() (err error) {
+	if req.Command != "" && req.Table != "" && len(req.Filter) == 0 {
+		err = errors.New("bad request: bulk commands require a Filter header")
+		return
+	}
+	if req.CommandDryRun && req.Table == "" {
+		err = errors.New("bad request: CommandDryRun is only supported for bulk commands")
+		return
+	}
 	if req.WaitTrigger != "" {
 		if req.WaitObject == "" {
 			err = errors.New("bad request: WaitTrigger without WaitObject")
@@ -306,12 +371,17 @@ func (req *Request) GetResponse() (*Response, error) {
 		return (NewResponse(req))
 	}
 
+	// The nodes table shows the cluster from the view of this node
+	if req.Table == "nodes" {
+		return (NewResponse(req))
+	}
+
 	// Determine if request for this node only (if backends specified)
 	allBackendsRequested := len(req.Backends) == 0
 	isForOurBackends := false // request for our own backends only
 	if !allBackendsRequested {
 		isForOurBackends = true
-		for _, backend := range req.Backends {
+		for backend := range req.BackendsMap {
 			isOurs := nodeAccessor.IsOurBackend(backend)
 			isForOurBackends = isForOurBackends && isOurs
 		}
@@ -326,7 +396,16 @@ func (req *Request) GetResponse() (*Response, error) {
 	return (req.getDistributedResponse())
 }
 
-// getDistributedResponse builds the response from a distributed setup
+// distributedResult contains the response of a single node for a distributed request.
+type distributedResult struct {
+	rows   [][]interface{}
+	failed map[string]string
+	total  int
+}
+
+// getDistributedResponse builds the response from a distributed setup.
+// Nodes which do not answer within the node timeout or the Timelimit of the
+// request are skipped and their backends are added to the failed hash.
 func (req *Request) getDistributedResponse() (*Response, error) {
 	// Columns for sub-requests
 	// Define request columns if not specified
@@ -339,11 +418,22 @@ func (req *Request) getDistributedResponse() (*Response, error) {
 	// Type of request
 	allBackendsRequested := len(req.Backends) == 0
 
+	timeout := nodeAccessor.queryTimeout
+	if req.Timelimit > 0 && req.Timelimit < timeout {
+		timeout = req.Timelimit
+	}
+
 	// Cluster mode (don't send this request; send sub-requests, build response)
 	var wg sync.WaitGroup
-	nodeBackends := nodeAccessor.nodeBackends
-	collectedDatasets := make(chan [][]interface{}, len(nodeBackends))
-	collectedFailedHashes := make(chan map[string]interface{}, len(nodeBackends))
+	nodeAccessor.lock.RLock()
+	nodeBackends := make(map[string][]string, len(nodeAccessor.nodeBackends))
+	for nodeID, backends := range nodeAccessor.nodeBackends {
+		nodeBackends[nodeID] = backends
+	}
+	nodeAccessor.lock.RUnlock()
+	resultsLock := &sync.Mutex{}
+	results := make(map[string]*distributedResult)
+	queriedNodes := make(map[*NodeAddress][]string)
 	for nodeID, nodeBackends := range nodeBackends {
 		node := nodeAccessor.Node(nodeID)
 		// Limit to requested backends if necessary
@@ -351,72 +441,46 @@ func (req *Request) getDistributedResponse() (*Response, error) {
 		subBackends := req.getSubBackends(allBackendsRequested, nodeBackends)
 		// Skip node if it doesn't have relevant backends
 		if len(subBackends) == 0 {
-			collectedDatasets <- [][]interface{}{}
-			collectedFailedHashes <- map[string]interface{}{}
 			continue
 		}
-
-		// Callback
-		callback := func(responseData interface{}) {
-			defer wg.Done()
-
-			// Hash containing metadata in addition to rows
-			hash, ok := responseData.(map[string]interface{})
-			if !ok {
-				return
-			}
-
-			// Hash containing error messages
-			failedHash, ok := hash["failed"].(map[string]interface{})
-			if !ok {
-				return
-			}
-
-			// Parse data (table rows)
-			rowsVariants, ok := hash["data"].([]interface{})
-			if !ok {
-				return
-			}
-			rows := make([][]interface{}, len(rowsVariants))
-			for i, rowVariant := range rowsVariants {
-				rowVariants, ok := rowVariant.([]interface{})
-				if !ok {
-					return
-				}
-				rows[i] = rowVariants
-			}
-
-			// Collect data
-			collectedDatasets <- rows
-			collectedFailedHashes <- failedHash
-		}
+		queriedNodes[node] = subBackends
 
 		requestData := req.buildDistributedRequestData(subBackends)
 
 		// Send query to node
 		wg.Add(1)
-		err := nodeAccessor.SendQuery(node, "table", requestData, callback)
-		if err != nil {
-			return nil, err
-		}
-
+		go func(node *NodeAddress, subBackends []string) {
+			defer logPanicExit()
+			defer wg.Done()
+			var result *distributedResult
+			responseData, err := nodeAccessor.SendQueryWait(node, "table", requestData, time.Duration(timeout)*time.Second)
+			if err != nil {
+				result = failedDistributedResult(subBackends, fmt.Sprintf("cluster node %s failed: %s", node.HumanIdentifier(), err.Error()))
+			} else {
+				result = parseDistributedResult(responseData, subBackends)
+			}
+			resultsLock.Lock()
+			results[node.id] = result
+			resultsLock.Unlock()
+		}(node, subBackends)
 	}
 
-	// Wait for all requests
-	timeout := 10
+	// Wait for all requests, slow nodes are reported as failed
 	if waitTimeout(&wg, time.Duration(timeout)*time.Second) {
-		err := fmt.Errorf("timeout waiting for partner nodes")
-		return nil, err
+		log.Warnf("timeout after %ds waiting for partner nodes", timeout)
 	}
-	close(collectedDatasets)
-
-	// Double-check that we have the right number of datasets
-	if len(collectedDatasets) != len(nodeBackends) {
-		err := fmt.Errorf("got %d instead of %d datasets", len(collectedDatasets), len(nodeBackends))
-		return nil, err
+	collectedResults := make([]*distributedResult, 0, len(queriedNodes))
+	resultsLock.Lock()
+	for node, subBackends := range queriedNodes {
+		result, ok := results[node.id]
+		if !ok {
+			result = failedDistributedResult(subBackends, fmt.Sprintf("timeout after %ds waiting for cluster node %s", timeout, node.HumanIdentifier()))
+		}
+		collectedResults = append(collectedResults, result)
 	}
+	resultsLock.Unlock()
 
-	res := req.mergeDistributedResponse(collectedDatasets, collectedFailedHashes)
+	res := req.mergeDistributedResponse(collectedResults)
 	res.Columns = resultColumns
 
 	// Process results
@@ -426,14 +490,63 @@ func (req *Request) getDistributedResponse() (*Response, error) {
 	return res, nil
 }
 
+// failedDistributedResult returns an empty result with all given backends marked as failed.
+func failedDistributedResult(subBackends []string, reason string) *distributedResult {
+	result := &distributedResult{failed: make(map[string]string)}
+	for _, id := range subBackends {
+		result.failed[id] = reason
+	}
+	return result
+}
+
+// parseDistributedResult extracts rows, errors and the total count from a wrapped_json node response.
+// All requested backends are marked as failed if the response cannot be parsed.
+func parseDistributedResult(responseData interface{}, subBackends []string) *distributedResult {
+	result := &distributedResult{failed: make(map[string]string)}
+	invalid := func() *distributedResult {
+		return failedDistributedResult(subBackends, "invalid response from cluster node")
+	}
+
+	// Hash containing metadata in addition to rows
+	hash, ok := responseData.(map[string]interface{})
+	if !ok {
+		return invalid()
+	}
+
+	// Hash containing error messages
+	if failedHash, ok := hash["failed"].(map[string]interface{}); ok {
+		for id, val := range failedHash {
+			result.failed[id] = fmt.Sprintf("%v", val)
+		}
+	}
+
+	// Parse data (table rows)
+	rowsVariants, ok := hash["data"].([]interface{})
+	if !ok {
+		return invalid()
+	}
+	result.rows = make([][]interface{}, len(rowsVariants))
+	for i, rowVariant := range rowsVariants {
+		rowVariants, ok := rowVariant.([]interface{})
+		if !ok {
+			return invalid()
+		}
+		result.rows[i] = rowVariants
+	}
+
+	// Total number of rows before applying the limit
+	if total, ok := hash["total"].(float64); ok {
+		result.total = int(total)
+	}
+	return result
+}
+
 func (req *Request) getSubBackends(allBackendsRequested bool, nodeBackends []string) (subBackends []string) {
 	// nodeBackends: all backends handled by current node
 	for _, nodeBackend := range nodeBackends {
 		isRequested := allBackendsRequested
-		for _, requestedBackend := range req.Backends {
-			if requestedBackend == nodeBackend {
-				isRequested = true
-			}
+		if _, ok := req.BackendsMap[nodeBackend]; ok {
+			isRequested = true
 		}
 		if isRequested {
 			subBackends = append(subBackends, nodeBackend)
@@ -455,12 +568,11 @@ func (req *Request) buildDistributedRequestData(subBackends []string) (requestDa
 	requestData["sendcolumnsheader"] = false
 
 	// Columns
-	// Columns need to be defined or else response will add them
+	// Requests without columns return all columns of the table, which
+	// is the same list on all nodes. Stats requests do not need columns.
 	isStatsRequest := len(req.Stats) != 0
 	if len(req.Columns) != 0 {
 		requestData["columns"] = req.Columns
-	} else if !isStatsRequest {
-		panic("columns undefined for dispatched request")
 	}
 
 	// Filter
@@ -504,11 +616,19 @@ func (req *Request) buildDistributedRequestData(subBackends []string) (requestDa
 				direction = "asc"
 			}
 			line = sortField.Name + " " + direction
+			if sortField.Args != "" {
+				line = sortField.Name + " " + sortField.Args + " " + direction
+			}
 			sort = append(sort, line)
 		}
 		requestData["sort"] = sort
 	}
 
+	// Timelimit, so partner nodes stop their own distributed queries in time
+	if req.Timelimit > 0 {
+		requestData["timelimit"] = req.Timelimit
+	}
+
 	// Get hash with metadata in addition to table rows
 	requestData["outputformat"] = "wrapped_json"
 
@@ -516,7 +636,7 @@ func (req *Request) buildDistributedRequestData(subBackends []string) (requestDa
 }
 
 // mergeDistributedResponse returns response object with merged result from distributed requests
-func (req *Request) mergeDistributedResponse(collectedDatasets chan [][]interface{}, collectedFailedHashes chan map[string]interface{}) *Response {
+func (req *Request) mergeDistributedResponse(collectedResults []*distributedResult) *Response {
 	// Build response object
 	res := &Response{
 		Code:    200,
@@ -526,47 +646,61 @@ func (req *Request) mergeDistributedResponse(collectedDatasets chan [][]interfac
 
 	// Merge data
 	isStatsRequest := len(req.Stats) != 0
-	for currentRows := range collectedDatasets {
+	for _, result := range collectedResults {
+		for id, msg := range result.failed {
+			res.Failed[id] = msg
+		}
 		if isStatsRequest {
-			// Stats request
-			// Value (sum), count (number of elements)
-			hasColumns := len(req.Columns)
-			if req.StatsResult == nil {
-				req.StatsResult = make(map[string][]*Filter)
+			req.mergeDistributedStats(result.rows)
+			continue
+		}
+		// Regular and passthrough requests
+		res.Result = append(res.Result, result.rows...)
+		res.ResultTotal += result.total
+	}
+	if res.Result == nil {
+		res.Result = make([][]interface{}, 0)
+	}
+	return res
+}
+
+// mergeDistributedStats applies the raw stats data from a node to the stats result.
+// Rows start with the grouping columns followed by a [value, count] pair for each stats query.
+func (req *Request) mergeDistributedStats(rows [][]interface{}) {
+	hasColumns := len(req.Columns)
+	if req.StatsResult == nil {
+		req.StatsResult = make(map[string][]*Filter)
+	}
+	for _, row := range rows {
+		if len(row) < hasColumns+len(req.Stats) {
+			continue
+		}
+		// group values may be of any type, build the key like getStatsKey does
+		keyValues := make([]string, hasColumns)
+		for x := 0; x < hasColumns; x++ {
+			keyValues[x] = fmt.Sprintf("%v", row[x])
+		}
+		key := strings.Join(keyValues, ";")
+		if _, ok := req.StatsResult[key]; !ok {
+			req.StatsResult[key] = createLocalStatsCopy(&req.Stats)
+		}
+		for i, data := range row[hasColumns:] {
+			if i >= len(req.Stats) {
+				break
 			}
-			for _, row := range currentRows {
-				// apply stats querys
-				key := ""
-				if hasColumns > 0 {
-					keys := []string{}
-					for x := 0; x < hasColumns; x++ {
-						keys = append(keys, row[x].(string))
-					}
-					key = strings.Join(keys, ";")
-				}
-				if _, ok := req.StatsResult[key]; !ok {
-					req.StatsResult[key] = createLocalStatsCopy(&req.Stats)
-				}
-				if hasColumns > 0 {
-					row = row[hasColumns:]
-				}
-				for i := range row {
-					data := reflect.ValueOf(row[i])
-					value, count := data.Index(0).Interface().(float64), int(data.Index(1).Interface().(float64))
-					req.StatsResult[key][i].ApplyValue(value, count)
-				}
+			pair, ok := data.([]interface{})
+			if !ok || len(pair) < 2 {
+				continue
 			}
-		} else {
-			// Regular request
-			res.Result = append(res.Result, currentRows...)
-			currentFailedHash := <-collectedFailedHashes
-			for id, val := range currentFailedHash {
-				str, _ := val.(string)
-				res.Failed[id] = str
+			value := numberToFloat(&pair[0])
+			count := int(numberToFloat(&pair[1]))
+			// nodes without matching rows send the initial value, ex. -1 for min
+			if count == 0 {
+				continue
 			}
+			req.StatsResult[key][i].ApplyValue(value, count)
 		}
 	}
-	return res
 }
 
 // ParseRequestHeaderLine parses a single request line
@@ -630,6 +764,26 @@ func (req *Request) ParseRequestHeaderLine(line *string) (err error) {
 	case "waitcondition":
 		err = ParseFilter(matched[1], line, req.Table, &req.WaitCondition)
 		return
+	case "authuser":
+		req.AuthUser = matched[1]
+		return
+	case "auth":
+		req.Auth = matched[1]
+		return
+	case "forwardedby":
+		// only set from authenticated node api requests
+		err = fmt.Errorf("bad request: ForwardedBy header is not allowed: %s", *line)
+		return
+	case "commanddryrun":
+		err = parseOnOff(&req.CommandDryRun, line, matched[1])
+		return
+	case "timelimit":
+		err = parseIntHeader(&req.Timelimit, matched[0], matched[1], 0)
+		return
+	case "commandwait":
+		req.SendCommandResult = true
+		err = parseIntHeader(&req.CommandWait, matched[0], matched[1], 0)
+		return
 	case "keepalive":
 		err = parseOnOff(&req.KeepAlive, line, matched[1])
 		return
@@ -482,3 +482,130 @@ func TestRequestBlocking(t *testing.T) {
 		panic(err.Error())
 	}
 }
+
+func TestRequestBackendsExpression(t *testing.T) {
+	peer := StartTestPeer(3, 10, 10)
+	PauseTestPeers(peer)
+
+	tags := map[string][]string{
+		"mockid0": {"prod", "eu"},
+		"mockid1": {"prod"},
+		"mockid2": {"test"},
+	}
+	PeerMapLock.RLock()
+	for id, tagList := range tags {
+		PeerMap[id].Config.Tags = tagList
+		PeerMap[id].StatusSet("Tags", tagList)
+	}
+	PeerMap["mockid0"].StatusSet("Section", "Europe/Germany/Berlin")
+	PeerMapLock.RUnlock()
+
+	expressions := map[string]int{
+		"tag:prod":          2,
+		"tag:prod !tag:eu":  1,
+		"!mockid1":          2,
+		"section:Europe/*":  1,
+		"~^MockCon":         3,
+		"~~^mockcon":        3,
+		"tag:t* mockid1":    2,
+		"!section:Europe/*": 2,
+	}
+	for expr, num := range expressions {
+		res, err := peer.QueryString("GET backends\nColumns: peer_key\nBackends: " + expr + "\n\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(num, len(res)); err != nil {
+			t.Errorf("Backends: %s: %s", expr, err.Error())
+		}
+	}
+
+	res, err := peer.QueryString("GET backends\nColumns: peer_key tags\nFilter: tags >= prod\nSort: peer_key asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{"prod", "eu"}, res[0][1]); err != nil {
+		t.Error(err)
+	}
+
+	_, err = peer.QueryString("GET backends\nColumns: peer_key\nBackends: ~(\n\n")
+	if err == nil {
+		t.Errorf("invalid regular expression should fail")
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestAuthUser(t *testing.T) {
+	peer := StartTestPeer(1, 10, 20)
+	PauseTestPeers(peer)
+
+	queries := map[string]int{
+		"GET hosts\nColumns: name\nAuthUser: demo\n\n":             10,
+		"GET hosts\nColumns: name\nAuthUser: nobody\n\n":           0,
+		"GET services\nColumns: description\nAuthUser: demo\n\n":   10,
+		"GET services\nColumns: description\nAuthUser: nobody\n\n": 0,
+		"GET hosts\nStats: name !=\nAuthUser: nobody\n\n":          1,
+		"GET comments\nColumns: id\nAuthUser: nobody\n\n":          0,
+		"GET contacts\nColumns: name\nAuthUser: nobody\n\n":        1,
+	}
+	for query, num := range queries {
+		res, err := peer.QueryString(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(num, len(res)); err != nil {
+			t.Errorf("%s: %s", query, err.Error())
+		}
+	}
+
+	// the contact filter cannot be combined with other filters
+	res, err := peer.QueryString("GET hosts\nColumns: name\nFilter: name = testhost_1\nAuthUser: nobody\nFilter: name = testhost_2\nOr: 2\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(0, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	// stats are counted over the objects of the contact only
+	res, err = peer.QueryString("GET hosts\nStats: name !=\nAuthUser: nobody\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(0.0, res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	// groups are not filtered, clients send the AuthUser with every query
+	for _, table := range []string{"hostgroups", "servicegroups"} {
+		res, err = peer.QueryString("GET " + table + "\nColumns: name\nAuthUser: nobody\n\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := peer.QueryString("GET " + table + "\nColumns: name\n\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(all, res); err != nil {
+			t.Errorf("%s: %s", table, err.Error())
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestHeaderForwardedBy(t *testing.T) {
+	// only the node api sets the forwarding node
+	buf := bufio.NewReader(bytes.NewBufferString("COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0\nForwardedBy: node1\n"))
+	if _, _, err := NewRequest(buf); err == nil {
+		t.Errorf("ForwardedBy header should be rejected")
+	}
+}
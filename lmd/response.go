@@ -52,6 +52,7 @@ var VirtKeyMap = map[string]VirtKeyMapTupel{
 	"parent":                  {Index: -21, Key: "PeerParent", Type: StringCol},
 	"configtool":              {Index: -22, Key: "", Type: HashMapCol},
 	"empty":                   {Index: -23, Key: "", Type: StringCol},
+	"tags":                    {Index: -24, Key: "Tags", Type: StringListCol},
 }
 
 // Response contains the livestatus response data as long with some meta data
@@ -67,6 +68,15 @@ type Response struct {
 	Columns     []ResultColumn
 }
 
+// nodesTablePeer returns a detached peer which serves the nodes table only.
+// The nodes table does not depend on any backend, so it must not require
+// a local peer which owns backends.
+func nodesTablePeer(table *Table) *Peer {
+	p := NewPeer(&Config{}, &Connection{ID: table.Name, Name: table.Name, Source: []string{table.Name}}, &sync.WaitGroup{}, make(chan bool))
+	p.Tables[table.Name] = DataTable{Table: table}
+	return p
+}
+
 // NewResponse creates a new response object for a given request
 // It returns the Response object and any error encountered.
 func NewResponse(req *Request) (res *Response, err error) {
@@ -88,6 +98,16 @@ func NewResponse(req *Request) (res *Response, err error) {
 	}
 	res.Columns = columns
 
+	if table.Name == "nodes" {
+		// nodes are the view of this node on the cluster, build them without any peer
+		res.AppendPeerResult(nodesTablePeer(table), &indexes)
+		if res.Result == nil {
+			res.Result = make([][]interface{}, 0)
+		}
+		res.PostProcessing()
+		return
+	}
+
 	// check if we have to spin up updates, if so, do it parallel
 	selectedPeers := []string{}
 	spinUpPeers := []string{}
@@ -185,8 +205,8 @@ func (res *Response) Less(i, j int) bool {
 			// not implemented
 			return s.Direction == Asc
 		case CustomVarCol:
-			s1, _ := ((*(res.Result[i][s.Index]).(*map[string]interface{}))[s.Args]).(string)
-			s2, _ := ((*(res.Result[j][s.Index]).(*map[string]interface{}))[s.Args]).(string)
+			s1 := customVarSortValue(res.Result[i][s.Index], s.Args)
+			s2 := customVarSortValue(res.Result[j][s.Index], s.Args)
 			if s1 == s2 {
 				continue
 			}
@@ -214,12 +234,29 @@ func (res *Response) Less(i, j int) bool {
 	return true
 }
 
+// customVarSortValue returns the value of a custom variable from a local or a
+// decoded json row, which is the case for results from other cluster nodes.
+func customVarSortValue(value interface{}, name string) string {
+	var vars map[string]interface{}
+	switch v := value.(type) {
+	case *map[string]interface{}:
+		vars = *v
+	case map[string]interface{}:
+		vars = v
+	}
+	str, _ := vars[name].(string)
+	return str
+}
+
 // Swap replaces two data rows while sorting.
 func (res *Response) Swap(i, j int) {
 	res.Result[i], res.Result[j] = res.Result[j], res.Result[i]
 }
 
-// ExpandRequestedBackends fills the requests backends map
+// ExpandRequestedBackends fills the requests backends map.
+// Requested backends can be ids or expressions (see BackendSelector). Negated
+// expressions are removed from the selection, or from all backends if there are
+// no other expressions.
 func (req *Request) ExpandRequestedBackends() (err error) {
 	req.BackendsMap = make(map[string]string)
 	req.BackendErrors = make(map[string]string)
@@ -234,17 +271,71 @@ func (req *Request) ExpandRequestedBackends() (err error) {
 		return
 	}
 
+	selected := false
+	var excludes []*BackendSelector
 	for _, b := range req.Backends {
-		_, Ok := PeerMap[b]
-		if !Ok {
-			req.BackendErrors[b] = fmt.Sprintf("bad request: backend %s does not exist", b)
+		if b == "" {
+			continue
+		}
+		selector, sErr := NewBackendSelector(b)
+		if sErr != nil {
+			return sErr
+		}
+		if selector.Negate {
+			excludes = append(excludes, selector)
+			continue
+		}
+		selected = true
+		if selector.Type == SelectID {
+			_, Ok := PeerMap[b]
+			if !Ok {
+				req.BackendErrors[b] = fmt.Sprintf("bad request: backend %s does not exist", b)
+				continue
+			}
+			req.BackendsMap[b] = b
 			continue
 		}
-		req.BackendsMap[b] = b
+		for id, p := range PeerMap {
+			if selector.Match(p) {
+				req.BackendsMap[id] = id
+			}
+		}
+	}
+	if !selected {
+		for id := range PeerMap {
+			req.BackendsMap[id] = id
+		}
+	}
+	for _, selector := range excludes {
+		for id := range req.BackendsMap {
+			if selector.Match(PeerMap[id]) {
+				delete(req.BackendsMap, id)
+			}
+		}
 	}
 	return
 }
 
+// RestrictBackends limits the expanded backends of the request to the given backend selectors.
+// It returns false if none of the requested backends is left.
+func (req *Request) RestrictBackends(backends []string) (bool, error) {
+	allowed := &Request{Backends: backends}
+	if err := allowed.ExpandRequestedBackends(); err != nil {
+		return false, err
+	}
+	for id := range req.BackendsMap {
+		if _, ok := allowed.BackendsMap[id]; !ok {
+			delete(req.BackendsMap, id)
+		}
+	}
+	if len(req.BackendsMap) == 0 {
+		return false, nil
+	}
+	// later backend expansions, ex. in cluster mode, must not add other backends
+	req.Backends = sortedBackends(req.BackendsMap)
+	return true, nil
+}
+
 // PostProcessing does all the post processing required for a request like sorting
 // and cutting of limits, applying offsets and calculating final stats.
 func (res *Response) PostProcessing() {
@@ -267,7 +358,7 @@ func (res *Response) PostProcessing() {
 
 	// apply request offset
 	if res.Request.Offset > 0 {
-		if res.Request.Offset > res.ResultTotal {
+		if res.Request.Offset > len(res.Result) {
 			res.Result = make([][]interface{}, 0)
 		} else {
 			res.Result = res.Result[res.Request.Offset:]
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Output formats of the rest api
+const (
+	restFormatJSON   = "json"
+	restFormatNDJSON = "ndjson"
+	restFormatCSV    = "csv"
+	restFormatSSE    = "sse"
+)
+
+// restContentTypes maps the output formats to their content type.
+var restContentTypes = map[string]string{
+	restFormatJSON:   "application/json",
+	restFormatNDJSON: "application/x-ndjson",
+	restFormatCSV:    "text/csv",
+	restFormatSSE:    "text/event-stream",
+}
+
+// restAcceptTypes maps accepted media types to output formats.
+var restAcceptTypes = map[string]string{
+	"application/*":        restFormatJSON,
+	"application/json":     restFormatJSON,
+	"application/x-ndjson": restFormatNDJSON,
+	"application/ndjson":   restFormatNDJSON,
+	"text/csv":             restFormatCSV,
+	"text/*":               restFormatCSV,
+	"text/event-stream":    restFormatSSE,
+}
+
+// reRestFilter matches compact filters like state!=0 or custom_variables FOO=bar.
+var reRestFilter = regexp.MustCompile(`^\s*([a-zA-Z0-9_]+(?:\s+[a-zA-Z0-9_]+)?)\s*(!=~~|!=~|!~~|!>=|=~~|>=|<=|!=|~~|!~|=~|=|~|<|>)\s?(.*)$`)
+
+// restError sends an error object with the given http status code.
+func (c *HTTPServerController) restError(w http.ResponseWriter, code int, err error) {
+	j := make(map[string]interface{})
+	j["error"] = err.Error()
+	j["code"] = code
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(j)
+}
+
+// restTable answers GET /v1/<table> requests. The query is built from url
+// parameters and the output format is negotiated from the Accept header or the
+// format parameter. The sse format subscribes to an event stream of changes.
+func (c *HTTPServerController) restTable(w http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+	format, err := restOutputFormat(request, c.listenerConfig().OutputFormat)
+	if err != nil {
+		c.restError(w, http.StatusNotAcceptable, err)
+		return
+	}
+
+	tableName := ps.ByName("table")
+	if tableName == "tables" {
+		if format == restFormatSSE {
+			c.restError(w, http.StatusNotAcceptable, fmt.Errorf("event streams are not supported for the list of tables"))
+			return
+		}
+		c.restTables(w, format)
+		return
+	}
+	if _, exists := Objects.Tables[tableName]; !exists {
+		c.restError(w, http.StatusNotFound, fmt.Errorf("table not found: %s", tableName))
+		return
+	}
+
+	requestData, err := restRequestData(tableName, request.URL.Query())
+	if err != nil {
+		c.restError(w, http.StatusBadRequest, err)
+		return
+	}
+	if format == restFormatSSE {
+		c.restStream(w, request, requestData)
+		return
+	}
+	req, err := parseRequestDataToRequest(requestData)
+	if err != nil {
+		c.restError(w, http.StatusBadRequest, err)
+		return
+	}
+	// final stats values instead of the raw data used between cluster nodes
+	req.SendStatsData = false
+	err = req.ExpandRequestedBackends()
+	if err != nil {
+		c.restError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err = c.restrict(req, request); err != nil {
+		c.restError(w, http.StatusForbidden, err)
+		return
+	}
+	release, err := c.acquireQuery(request)
+	if err != nil {
+		c.restError(w, schedulerErrorCode(err), err)
+		return
+	}
+	res, err := req.GetResponse()
+	release()
+	if err != nil {
+		c.restError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	columns := restResultColumns(req)
+	c.restOutput(w, format, columns, res.Result, res.ResultTotal, res.Failed)
+}
+
+// restTables lists all tables with their number of columns.
+func (c *HTTPServerController) restTables(w http.ResponseWriter, format string) {
+	rows := make([][]interface{}, 0, len(Objects.Order))
+	for _, name := range Objects.Order {
+		table := Objects.Tables[name]
+		tableType := "cached"
+		switch {
+		case table.Virtual:
+			tableType = "virtual"
+		case table.PassthroughOnly:
+			tableType = "passthrough"
+		}
+		rows = append(rows, []interface{}{name, tableType, len(table.Columns)})
+	}
+	c.restOutput(w, format, []string{"name", "type", "columns"}, rows, len(rows), map[string]string{})
+}
+
+// restOutput writes the result rows in the requested format. The total number
+// of rows and failed backends are sent as X-LMD-Total and X-LMD-Failed header
+// for formats which cannot contain them.
+func (c *HTTPServerController) restOutput(w http.ResponseWriter, format string, columns []string, rows [][]interface{}, total int, failed map[string]string) {
+	if total < len(rows) {
+		total = len(rows)
+	}
+	buf := new(bytes.Buffer)
+	switch format {
+	case restFormatCSV:
+		writer := csv.NewWriter(buf)
+		writer.Write(columns)
+		for _, row := range rows {
+			record := make([]string, len(row))
+			for i, value := range row {
+				record[i] = restCSVValue(value)
+			}
+			writer.Write(record)
+		}
+		writer.Flush()
+	case restFormatNDJSON:
+		enc := json.NewEncoder(buf)
+		for _, row := range rows {
+			if err := enc.Encode(restRowObject(columns, row)); err != nil {
+				c.restError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	default:
+		objects := make([]map[string]interface{}, len(rows))
+		for i, row := range rows {
+			objects[i] = restRowObject(columns, row)
+		}
+		j := make(map[string]interface{})
+		j["data"] = objects
+		j["total"] = total
+		j["failed"] = failed
+		if err := json.NewEncoder(buf).Encode(j); err != nil {
+			c.restError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", restContentTypes[format])
+	w.Header().Set("X-LMD-Total", strconv.Itoa(total))
+	if len(failed) > 0 {
+		failedJSON, _ := json.Marshal(failed)
+		w.Header().Set("X-LMD-Failed", string(failedJSON))
+	}
+	w.Write(buf.Bytes())
+}
+
+// restOutputFormat returns the output format from the format parameter or the Accept header.
+// Requests without preference get the default format of the listener or json.
+func restOutputFormat(request *http.Request, defaultFormat string) (string, error) {
+	if _, ok := restContentTypes[defaultFormat]; !ok {
+		defaultFormat = restFormatJSON
+	}
+	if format := request.URL.Query().Get("format"); format != "" {
+		if _, ok := restContentTypes[format]; !ok {
+			return "", fmt.Errorf("unsupported format: %s, must be json, ndjson, csv or sse", format)
+		}
+		return format, nil
+	}
+	accept := request.Header.Get("Accept")
+	if accept == "" {
+		return defaultFormat, nil
+	}
+	for _, mediaType := range strings.Split(accept, ",") {
+		mediaType = strings.ToLower(strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0]))
+		if mediaType == "*/*" {
+			return defaultFormat, nil
+		}
+		if format, ok := restAcceptTypes[mediaType]; ok {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported media type: %s, must be application/json, application/x-ndjson, text/csv or text/event-stream", accept)
+}
+
+// restRequestData converts url parameters into request data for parseRequestDataToRequest.
+func restRequestData(tableName string, params url.Values) (requestData map[string]interface{}, err error) {
+	requestData = make(map[string]interface{})
+	requestData["table"] = tableName
+	for key, values := range params {
+		switch key {
+		case "columns", "backends":
+			list := []interface{}{}
+			for _, value := range restSplitList(values) {
+				list = append(list, value)
+			}
+			requestData[key] = list
+		case "filter", "stats":
+			list := []interface{}{}
+			for _, value := range values {
+				list = append(list, restFilterLine(value))
+			}
+			requestData[key] = list
+		case "sort":
+			list := []interface{}{}
+			for _, value := range restSplitList(values) {
+				list = append(list, restSortLine(value))
+			}
+			requestData[key] = list
+		case "limit", "offset", "timelimit":
+			num, cerr := strconv.Atoi(values[0])
+			if cerr != nil || num < 0 {
+				err = fmt.Errorf("bad request: %s must be a positive number", key)
+				return
+			}
+			requestData[key] = float64(num)
+		case "format":
+		default:
+			err = fmt.Errorf("bad request: unknown parameter %s", key)
+			return
+		}
+	}
+	// the header row is part of the output format
+	requestData["sendcolumnsheader"] = false
+	return
+}
+
+// restSplitList returns all comma separated values of a parameter.
+func restSplitList(values []string) (list []string) {
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return
+}
+
+// restFilterLine converts compact filters like state!=0 into livestatus syntax.
+// Everything else, ex. stats like "sum latency", is used unchanged.
+func restFilterLine(value string) string {
+	matches := reRestFilter.FindStringSubmatch(value)
+	if matches == nil {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(matches[1] + " " + matches[2] + " " + matches[3])
+}
+
+// restSortLine converts sort parameters like name, -name or "name desc" into livestatus syntax.
+func restSortLine(value string) string {
+	if strings.HasPrefix(value, "-") {
+		return strings.TrimPrefix(value, "-") + " desc"
+	}
+	if strings.HasSuffix(value, " asc") || strings.HasSuffix(value, " desc") {
+		return value
+	}
+	return value + " asc"
+}
+
+// restResultColumns returns the names of the result columns, stats are named stats_1, stats_2, ...
+func restResultColumns(req *Request) []string {
+	columns := make([]string, 0, len(req.Columns)+len(req.Stats))
+	columns = append(columns, req.Columns...)
+	for i := range req.Stats {
+		columns = append(columns, fmt.Sprintf("stats_%d", i+1))
+	}
+	return columns
+}
+
+// restRowObject converts a result row into an object with the column names as keys.
+func restRowObject(columns []string, row []interface{}) map[string]interface{} {
+	obj := make(map[string]interface{}, len(columns))
+	for i, name := range columns {
+		if i < len(row) {
+			obj[name] = row[i]
+		}
+	}
+	return obj
+}
+
+// restCSVValue formats a single value for csv output, lists and hashes are json encoded.
+func restCSVValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int, int64, bool:
+		return fmt.Sprintf("%v", v)
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return string(encoded)
+	}
+}
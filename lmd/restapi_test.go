@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func restTestRequest(handler http.Handler, path string, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func restTestResult(t *testing.T, rec *httptest.ResponseRecorder) (data []map[string]interface{}, total int) {
+	if rec.Code != http.StatusOK {
+		t.Fatalf("request failed with %d: %s", rec.Code, rec.Body.String())
+	}
+	var result struct {
+		Data  []map[string]interface{}
+		Total int
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result.Data, result.Total
+}
+
+func TestRestAPI(t *testing.T) {
+	peer := StartTestPeer(1, 10, 20)
+	PauseTestPeers(peer)
+	handler, _ := initializeHTTPRouter(nil)
+
+	data, total := restTestResult(t, restTestRequest(handler, "/v1/hosts?columns=name,state&filter=name=testhost_1", ""))
+	if err := assertEq(1, total); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("testhost_1", data[0]["name"]); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(0.0, data[0]["state"]); err != nil {
+		t.Error(err)
+	}
+
+	// sort, offset and limit
+	data, total = restTestResult(t, restTestRequest(handler, "/v1/hosts?columns=name&sort=-name&limit=2&offset=1", "application/json"))
+	if err := assertEq(10, total); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(2, len(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq("testhost_8", data[0]["name"]); err != nil {
+		t.Error(err)
+	}
+
+	// stats
+	data, _ = restTestResult(t, restTestRequest(handler, "/v1/hosts?stats=name!%3D&stats=state%3D0", ""))
+	if err := assertEq(10.0, data[0]["stats_1"]); err != nil {
+		t.Error(err)
+	}
+
+	// csv
+	rec := restTestRequest(handler, "/v1/hosts?columns=name,state&sort=name", "text/csv")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if err := assertEq(11, len(lines)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("name,state", lines[0]); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("testhost_1,0", lines[1]); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("text/csv", rec.Header().Get("Content-Type")); err != nil {
+		t.Error(err)
+	}
+
+	// ndjson
+	rec = restTestRequest(handler, "/v1/services?columns=host_name,description&format=ndjson", "text/csv")
+	lines = strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if err := assertEq(10, len(lines)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("10", rec.Header().Get("X-LMD-Total")); err != nil {
+		t.Error(err)
+	}
+
+	// discovery
+	data, _ = restTestResult(t, restTestRequest(handler, "/v1/tables", ""))
+	found := false
+	for _, table := range data {
+		if table["name"] == "hosts" && table["type"] == "cached" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("hosts table not listed")
+	}
+	data, _ = restTestResult(t, restTestRequest(handler, "/v1/columns?columns=name&filter=table=hosts&filter=name=state", ""))
+	if err := assertEq(1, len(data)); err != nil {
+		t.Error(err)
+	}
+
+	// errors
+	for _, test := range []struct {
+		path   string
+		accept string
+		code   int
+	}{
+		{"/v1/unknown", "", http.StatusNotFound},
+		{"/v1/hosts?limit=x", "", http.StatusBadRequest},
+		{"/v1/hosts?foo=bar", "", http.StatusBadRequest},
+		{"/v1/hosts?filter=state", "", http.StatusBadRequest},
+		{"/v1/hosts", "text/html", http.StatusNotAcceptable},
+	} {
+		rec = restTestRequest(handler, test.path, test.accept)
+		if err := assertEq(test.code, rec.Code); err != nil {
+			t.Errorf("%s: %s", test.path, err.Error())
+		}
+		errObj := make(map[string]interface{})
+		if err := json.Unmarshal(rec.Body.Bytes(), &errObj); err != nil {
+			t.Fatal(err)
+		}
+		if err := assertEq(float64(test.code), errObj["code"]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// table requests without body
+	rec = restTestRequest(handler, "/table/hosts", "")
+	if err := assertEq(http.StatusOK, rec.Code); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// restCommandsRequest is the body of POST /v1/commands requests.
+type restCommandsRequest struct {
+	Commands []restCommand `json:"commands"`
+	Backends []string      `json:"backends"`  // default backends for all commands
+	AuthUser string        `json:"auth_user"` // same as the AuthUser header, taken from the user on authenticated listeners
+	Wait     int           `json:"wait"`      // same as the CommandWait header in milliseconds
+}
+
+// restCommand is a single command with optional target backends. Bulk commands
+// with $HOSTNAME$ or $SERVICEDESC$ placeholders reference their objects by filter.
+type restCommand struct {
+	Command  string   `json:"command"`
+	Backends []string `json:"backends"`
+	Filter   []string `json:"filter"`
+}
+
+// UnmarshalJSON accepts plain strings as commands as well.
+func (cmd *restCommand) UnmarshalJSON(data []byte) error {
+	var command string
+	if err := json.Unmarshal(data, &command); err == nil {
+		cmd.Command = command
+		return nil
+	}
+	type plain restCommand
+	return json.Unmarshal(data, (*plain)(cmd))
+}
+
+// restCommandResult contains the result of a single command.
+type restCommandResult struct {
+	Command  string                   `json:"command"`
+	Backends []map[string]interface{} `json:"backends"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+// restCommands answers POST /v1/commands requests. Commands are checked against
+// the command policy of the listener, routed and sent like livestatus commands
+// and the result is returned for each backend.
+func (c *HTTPServerController) restCommands(w http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+	body := &restCommandsRequest{}
+	defer request.Body.Close()
+	if err := json.NewDecoder(request.Body).Decode(body); err != nil {
+		c.restError(w, http.StatusBadRequest, fmt.Errorf("request not understood"))
+		return
+	}
+	if len(body.Commands) == 0 {
+		c.restError(w, http.StatusBadRequest, fmt.Errorf("bad request: no commands"))
+		return
+	}
+
+	// check all commands before sending any of them
+	policy := c.commandPolicy()
+	reqs := make([]*Request, 0, len(body.Commands))
+	for i := range body.Commands {
+		req, err := body.Commands[i].request(body)
+		if err != nil {
+			c.restError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err = c.restrict(req, request); err != nil {
+			log.Warnf("rejected command from %s to %s: %s", request.RemoteAddr, request.Host, err.Error())
+			c.restError(w, http.StatusForbidden, err)
+			return
+		}
+		if err = policy.Check(req.Command, req.AuthUser); err != nil {
+			log.Warnf("rejected command from %s to %s: %s", request.RemoteAddr, request.Host, err.Error())
+			rejectCommand(c.auditEntry(req, request), err)
+			c.restError(w, http.StatusForbidden, err)
+			return
+		}
+		reqs = append(reqs, req)
+	}
+
+	t1 := time.Now()
+	results := make([]*restCommandResult, 0, len(reqs))
+	for _, req := range reqs {
+		results = append(results, c.sendRestCommand(policy, req, request))
+	}
+	log.Infof("incoming http command request from %s to %s finished in %s", request.RemoteAddr, request.Host, time.Since(t1))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+// sendRestCommand sends a single command and returns its result for each backend.
+func (c *HTTPServerController) sendRestCommand(policy *CommandPolicy, req *Request, request *http.Request) *restCommandResult {
+	result := &restCommandResult{Command: req.Command, Backends: []map[string]interface{}{}}
+	if isManagementCommand, err := ProcessManagementCommand(req.Command); isManagementCommand {
+		entry := c.auditEntry(req, request)
+		if err != nil {
+			rejectCommand(entry, err)
+			result.Error = err.Error()
+			return result
+		}
+		auditCommand(entry)
+		return result
+	}
+	if isQueueCommand, err := ProcessQueueCommand(req.Command); isQueueCommand {
+		entry := c.auditEntry(req, request)
+		if err != nil {
+			rejectCommand(entry, err)
+			result.Error = err.Error()
+			return result
+		}
+		auditCommand(entry)
+		return result
+	}
+
+	var res *Response
+	if req.Table != "" {
+		// bulk command with placeholders, expand it for all matching objects
+		backends, err := policy.AuthorizedBackends(req.AuthUser, sortedBackends(req.BackendsMap))
+		if err != nil {
+			rejectCommand(c.auditEntry(req, request), err)
+			result.Error = err.Error()
+			return result
+		}
+		expanded, err := ExpandBulkCommand(req, backends)
+		if err != nil {
+			rejectCommand(c.auditEntry(req, request), err)
+			result.Error = err.Error()
+			return result
+		}
+		commandsByPeer := make(map[string][]string)
+		auditEntries := []*AuditEntry{}
+		targets := sortedKeys(expanded)
+		for _, pID := range targets {
+			for _, command := range expanded[pID] {
+				entry := c.auditEntry(req, request)
+				entry.Command = command
+				entry.Peers = []string{pID}
+				auditEntries = append(auditEntries, entry)
+				commandsByPeer[pID] = append(commandsByPeer[pID], command)
+			}
+		}
+		res = CommandResultResponse(req, targets, SendCommands(&commandsByPeer, auditEntries), nil)
+	} else {
+		entry := c.auditEntry(req, request)
+		targets, err := policy.AuthorizedBackends(req.AuthUser, RouteCommand(req.Command, req.BackendsMap))
+		if err != nil {
+			rejectCommand(entry, err)
+			result.Error = err.Error()
+			return result
+		}
+		entry.Peers = targets
+		res = SendCommandWithResults(req, targets, entry)
+	}
+	for _, row := range res.Result {
+		result.Backends = append(result.Backends, restRowObject(res.Request.Columns, row))
+	}
+	return result
+}
+
+// request converts the command into a livestatus command request.
+func (cmd *restCommand) request(body *restCommandsRequest) (req *Request, err error) {
+	command := strings.TrimSpace(cmd.Command)
+	if command == "" {
+		return nil, fmt.Errorf("bad request: empty command")
+	}
+	if !strings.HasPrefix(command, "COMMAND ") {
+		command = fmt.Sprintf("COMMAND [%d] %s", time.Now().Unix(), command)
+	}
+	if strings.Contains(command, "\n") {
+		return nil, fmt.Errorf("bad request: commands must not contain newlines")
+	}
+	req = &Request{
+		Command:           command,
+		Table:             BulkCommandTable(command),
+		AuthUser:          body.AuthUser,
+		CommandWait:       body.Wait,
+		SendCommandResult: true,
+		Backends:          cmd.Backends,
+	}
+	if len(req.Backends) == 0 {
+		req.Backends = body.Backends
+	}
+	if len(cmd.Filter) > 0 {
+		if req.Table == "" {
+			return nil, fmt.Errorf("bad request: filter requires a command with $HOSTNAME$ or $SERVICEDESC$ placeholders")
+		}
+		filter := make([]interface{}, len(cmd.Filter))
+		for i, line := range cmd.Filter {
+			filter[i] = restFilterLine(line)
+		}
+		if err = parseHTTPFilterRequestData(req, filter, "Filter"); err != nil {
+			return nil, err
+		}
+	}
+	if err = req.VerifyRequestIntegrity(); err != nil {
+		return nil, err
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		return nil, err
+	}
+	for _, msg := range req.BackendErrors {
+		return nil, fmt.Errorf("%s", msg)
+	}
+	return
+}
+
+// commandPolicy returns the command policy of the http listener.
+func (c *HTTPServerController) commandPolicy() *CommandPolicy {
+	if c.listener == nil {
+		return &CommandPolicy{}
+	}
+	return GetCommandPolicy(c.listener.LocalConfig, c.listener.ConnectionString)
+}
+
+// auditEntry returns a new audit log entry for a command from a http request.
+func (c *HTTPServerController) auditEntry(req *Request, request *http.Request) *AuditEntry {
+	return NewAuditEntry(req, request.RemoteAddr, c.listener)
+}
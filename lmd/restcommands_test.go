@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var reCommandTimestamp = regexp.MustCompile(`COMMAND \[\d+\]`)
+
+func TestRestCommands(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	listener := &Listener{
+		ConnectionString: "http://127.0.0.1:8901",
+		LocalConfig: &Config{
+			CommandDeny: []string{"SHUTDOWN_*"},
+			Listeners: []ListenerConfig{
+				{Listen: "http://127.0.0.1:8901", RequireAuthUser: true},
+			},
+		},
+	}
+	handler, _ := initializeHTTPRouter(listener)
+
+	tests := []struct {
+		body   string
+		code   int
+		result string
+	}{
+		{`{"commands": ["SCHEDULE_FORCED_HOST_CHECK;testhost_1;0"], "auth_user": "demo@localhost"}`, http.StatusOK,
+			`{"results":[{"backends":[{"confirmed":0,"error":"","peer_key":"mockid0","success":1}],"command":"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0"}]}`},
+		{`{"commands": [{"command": "COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;$HOSTNAME$;0", "filter": ["name=testhost_2"], "backends": ["mockid0"]}], "auth_user": "demo@localhost"}`, http.StatusOK,
+			`{"results":[{"backends":[{"confirmed":0,"error":"","peer_key":"mockid0","success":1}],"command":"COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;$HOSTNAME$;0"}]}`},
+		{`{"commands": ["SCHEDULE_FORCED_HOST_CHECK;testhost_1;0"]}`, http.StatusForbidden,
+			`{"code":403,"error":"forbidden: commands require an AuthUser header"}`},
+		{`{"commands": ["SCHEDULE_FORCED_HOST_CHECK;testhost_1;0", "SHUTDOWN_PROGRAM"], "auth_user": "demo@localhost"}`, http.StatusForbidden,
+			`{"code":403,"error":"forbidden: command SHUTDOWN_PROGRAM is not allowed"}`},
+		{`{"commands": ["SCHEDULE_FORCED_HOST_CHECK;testhost_1;0"], "backends": ["unknown"], "auth_user": "demo@localhost"}`, http.StatusBadRequest,
+			`{"code":400,"error":"bad request: backend unknown does not exist"}`},
+		{`{"commands": ["SCHEDULE_FORCED_HOST_CHECK;$HOSTNAME$;0"], "auth_user": "demo@localhost"}`, http.StatusBadRequest,
+			`{"code":400,"error":"bad request: bulk commands require a Filter header"}`},
+		{`{"commands": []}`, http.StatusBadRequest,
+			`{"code":400,"error":"bad request: no commands"}`},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/v1/commands", strings.NewReader(strings.Replace(test.body, "COMMAND [0] ", "", -1)))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if err := assertEq(test.code, rec.Code); err != nil {
+			t.Errorf("%s: %s", test.body, err.Error())
+		}
+		// commands get the current timestamp
+		var result interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(result)
+		got := reCommandTimestamp.ReplaceAllString(string(body), "COMMAND [0]")
+		if err := assertEq(test.result, got); err != nil {
+			t.Errorf("%s: %s", test.body, err.Error())
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
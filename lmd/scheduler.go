@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+var errQueryRateLimited = errors.New("too many requests: query rate limit exceeded, try again later")
+var errQueryQueueTimeout = errors.New("service unavailable: too many concurrent queries, timeout while waiting in queue")
+
+// queryScheduler limits the queries from all clients, nil means unlimited.
+// It is replaced on reload, use currentQueryScheduler to access it.
+var queryScheduler *QueryScheduler
+var querySchedulerLock sync.RWMutex
+
+// QueryScheduler bounds the number of concurrently executing queries and limits the query rate of each client.
+type QueryScheduler struct {
+	noCopy       noCopy
+	lock         sync.Mutex
+	slots        chan bool // buffered with MaxQueries, nil means no limit
+	queueTimeout time.Duration
+	rate         float64 // queries per second for each client, 0 means no limit
+	burst        float64
+	buckets      map[string]*queryBucket
+	lastCleanup  time.Time
+}
+
+// queryBucket is the token bucket of a single client.
+type queryBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// NewQueryScheduler creates a new scheduler from the MaxQueries, QueryQueueTimeout, QueryRateLimit
+// and QueryRateBurst settings. It returns nil if no limits are set.
+func NewQueryScheduler(conf *Config) *QueryScheduler {
+	if conf.MaxQueries <= 0 && conf.QueryRateLimit <= 0 {
+		return nil
+	}
+	s := &QueryScheduler{
+		queueTimeout: time.Duration(conf.QueryQueueTimeout) * time.Second,
+		rate:         conf.QueryRateLimit,
+		burst:        float64(conf.QueryRateBurst),
+		buckets:      make(map[string]*queryBucket),
+		lastCleanup:  time.Now(),
+	}
+	if conf.MaxQueries > 0 {
+		s.slots = make(chan bool, conf.MaxQueries)
+	}
+	if s.burst <= 0 {
+		s.burst = math.Max(1, math.Ceil(s.rate))
+	}
+	return s
+}
+
+// initQueryScheduler replaces the query scheduler with a new one from the configuration.
+// Queries which are running or queued in the previous scheduler finish there and still
+// update the metrics.
+func initQueryScheduler(conf *Config) {
+	scheduler := NewQueryScheduler(conf)
+	querySchedulerLock.Lock()
+	queryScheduler = scheduler
+	querySchedulerLock.Unlock()
+}
+
+// currentQueryScheduler returns the query scheduler, which may be nil.
+func currentQueryScheduler() *QueryScheduler {
+	querySchedulerLock.RLock()
+	defer querySchedulerLock.RUnlock()
+	return queryScheduler
+}
+
+// Acquire waits for a free query slot for the given client. The returned function must be called
+// once the query has finished. It returns an error if the client exceeded its rate limit or if no
+// slot became available within the queue timeout.
+// It is safe to call on nil.
+func (s *QueryScheduler) Acquire(client string) (release func(), err error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	if !s.allow(client) {
+		promQueryRejections.WithLabelValues("rate_limit").Inc()
+		return nil, errQueryRateLimited
+	}
+	if s.slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case s.slots <- true:
+	default:
+		// all slots are busy, wait in queue
+		promQueryQueueDepth.Inc()
+		timer := time.NewTimer(s.queueTimeout)
+		select {
+		case s.slots <- true:
+			timer.Stop()
+			promQueryQueueDepth.Dec()
+		case <-timer.C:
+			promQueryQueueDepth.Dec()
+			promQueryRejections.WithLabelValues("queue_timeout").Inc()
+			return nil, errQueryQueueTimeout
+		}
+	}
+	promQueriesRunning.Inc()
+	once := sync.Once{}
+	release = func() {
+		once.Do(func() {
+			promQueriesRunning.Dec()
+			<-s.slots
+		})
+	}
+	return release, nil
+}
+
+// allow takes a token from the bucket of the client and returns false if there is none left.
+func (s *QueryScheduler) allow(client string) bool {
+	if s.rate <= 0 {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastCleanup) > time.Minute {
+		s.cleanup(now)
+	}
+	bucket, ok := s.buckets[client]
+	if !ok {
+		bucket = &queryBucket{tokens: s.burst, lastRefill: now}
+		s.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(s.burst, bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*s.rate)
+	bucket.lastRefill = now
+	if bucket.tokens < 1 {
+		log.Debugf("query rate limit of %.1f/s exceeded for %s", s.rate, client)
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// cleanup removes the buckets of clients which would be full again. The lock must be held by the caller.
+func (s *QueryScheduler) cleanup(now time.Time) {
+	for client, bucket := range s.buckets {
+		if bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*s.rate >= s.burst {
+			delete(s.buckets, client)
+		}
+	}
+	s.lastCleanup = now
+}
+
+// schedulerClient returns the key for the rate limit of a client. Authenticated clients are
+// limited by their user name, all others by their address without port. Unix socket clients
+// have no address, so all unauthenticated unix socket clients share one limit.
+func schedulerClient(remote string, user *ListenerUser) string {
+	if user != nil {
+		return "user:" + user.Name
+	}
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
+}
+
+// schedulerErrorCode returns the response code for errors from Acquire.
+func schedulerErrorCode(err error) int {
+	if err == errQueryRateLimited {
+		return 429
+	}
+	return 503
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQuerySchedulerRateLimit(t *testing.T) {
+	if NewQueryScheduler(&Config{}) != nil {
+		t.Errorf("expected no scheduler without limits")
+	}
+	s := NewQueryScheduler(&Config{QueryRateLimit: 1, QueryRateBurst: 2})
+	for i := 0; i < 2; i++ {
+		release, err := s.Acquire("10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if _, err := s.Acquire("10.0.0.1"); err != errQueryRateLimited {
+		t.Errorf("expected rate limit error, got %v", err)
+	}
+	if _, err := s.Acquire("10.0.0.2"); err != nil {
+		t.Errorf("other clients must not be limited: %s", err.Error())
+	}
+
+	if err := assertEq("10.0.0.1", schedulerClient("10.0.0.1:43210", nil)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("user:demo", schedulerClient("10.0.0.1:43210", &ListenerUser{Name: "demo"})); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("@", schedulerClient("@", nil)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQuerySchedulerQueue(t *testing.T) {
+	s := NewQueryScheduler(&Config{MaxQueries: 1})
+	s.queueTimeout = 50 * time.Millisecond
+
+	release, err := s.Acquire("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Acquire("b"); err != errQueryQueueTimeout {
+		t.Errorf("expected queue timeout, got %v", err)
+	}
+
+	// queued queries continue once a slot is free
+	s.queueTimeout = 5 * time.Second
+	done := make(chan error)
+	go func() {
+		next, qErr := s.Acquire("b")
+		if qErr == nil {
+			next()
+		}
+		done <- qErr
+	}()
+	time.Sleep(20 * time.Millisecond)
+	release()
+	release()
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQuerySchedulerHTTP(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+	queryScheduler = NewQueryScheduler(&Config{QueryRateLimit: 0.1, QueryRateBurst: 1})
+	defer func() { queryScheduler = nil }()
+
+	handler, _ := initializeHTTPRouter(nil)
+	rec := restTestRequest(handler, "/v1/hosts?columns=name", "")
+	if err := assertEq(http.StatusOK, rec.Code); err != nil {
+		t.Error(err)
+	}
+	rec = restTestRequest(handler, "/v1/hosts?columns=name", "")
+	if err := assertEq(http.StatusTooManyRequests, rec.Code); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestQuerySchedulerReload(t *testing.T) {
+	initQueryScheduler(&Config{MaxQueries: 1})
+	release, err := currentQueryScheduler().Acquire("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// running queries keep their slot in the previous scheduler
+	initQueryScheduler(&Config{MaxQueries: 1})
+	next, err := currentQueryScheduler().Acquire("b")
+	if err != nil {
+		t.Errorf("expected free slot after reload, got %s", err.Error())
+	} else {
+		next()
+	}
+	release()
+
+	initQueryScheduler(&Config{})
+	if currentQueryScheduler() != nil {
+		t.Errorf("expected no scheduler without limits")
+	}
+}
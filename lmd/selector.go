@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// BackendSelectorType defines how a backend selector matches.
+type BackendSelectorType int
+
+// BackendSelector types
+const (
+	_ BackendSelectorType = iota
+	// SelectID matches the backend id exactly
+	SelectID
+	// SelectTag matches any of the backend tags, wildcards are allowed
+	SelectTag
+	// SelectSection matches the backend section, wildcards are allowed
+	SelectSection
+	// SelectName matches the backend name by regular expression
+	SelectName
+)
+
+// BackendSelector is a single entry from the Backends header.
+// Supported forms are: <id>, tag:<tag>, section:<section>, ~<regex> and ~~<case insensitive regex>.
+// Each of them can be negated by a leading !.
+type BackendSelector struct {
+	Type   BackendSelectorType
+	Negate bool
+	Value  string
+	Regexp *regexp.Regexp
+}
+
+// NewBackendSelector parses a single backend expression.
+func NewBackendSelector(expr string) (s *BackendSelector, err error) {
+	s = &BackendSelector{Type: SelectID}
+	if strings.HasPrefix(expr, "!") {
+		s.Negate = true
+		expr = expr[1:]
+	}
+	s.Value = expr
+	switch {
+	case strings.HasPrefix(expr, "tag:"):
+		s.Type = SelectTag
+		s.Value = strings.TrimPrefix(expr, "tag:")
+		s.Regexp, err = wildcardToRegexp(s.Value)
+	case strings.HasPrefix(expr, "section:"):
+		s.Type = SelectSection
+		s.Value = strings.TrimPrefix(expr, "section:")
+		s.Regexp, err = wildcardToRegexp(s.Value)
+	case strings.HasPrefix(expr, "~~"):
+		s.Type = SelectName
+		s.Value = strings.TrimPrefix(expr, "~~")
+		s.Regexp, err = regexp.Compile("(?i)" + s.Value)
+	case strings.HasPrefix(expr, "~"):
+		s.Type = SelectName
+		s.Value = strings.TrimPrefix(expr, "~")
+		s.Regexp, err = regexp.Compile(s.Value)
+	}
+	if err != nil {
+		err = fmt.Errorf("bad request: invalid backend expression %s: %s", expr, err.Error())
+		return nil, err
+	}
+	if s.Value == "" {
+		return nil, fmt.Errorf("bad request: empty backend expression")
+	}
+	return
+}
+
+// Match returns true if the peer matches this selector. Negation is not applied.
+func (s *BackendSelector) Match(p *Peer) bool {
+	switch s.Type {
+	case SelectID:
+		return p.ID == s.Value
+	case SelectTag:
+		for _, tag := range p.Config.Tags {
+			if s.Regexp.MatchString(tag) {
+				return true
+			}
+		}
+		return false
+	case SelectSection:
+		return s.Regexp.MatchString(p.StatusGet("Section").(string))
+	case SelectName:
+		return s.Regexp.MatchString(p.Name)
+	}
+	return false
+}
+
+// wildcardToRegexp converts a pattern with * and ? wildcards into an anchored regular expression.
+// The * matches across slashes, so section:Europe/* selects all subsections as well.
+func wildcardToRegexp(pattern string) (*regexp.Regexp, error) {
+	quoted := regexp.QuoteMeta(pattern)
+	quoted = strings.Replace(quoted, `\*`, ".*", -1)
+	quoted = strings.Replace(quoted, `\?`, ".", -1)
+	return regexp.Compile("^" + quoted + "$")
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StreamKeepAliveInterval sets the interval in seconds in which idle event streams send keepalive comments.
+// In cluster mode, streams also refresh their data in this interval to pick up changes from other nodes.
+const StreamKeepAliveInterval = 15
+
+// streamKeyColumns contains the columns which identify a row for all tables supporting event streams.
+// The peer_key is always part of the key.
+var streamKeyColumns = map[string][]string{
+	"status":        {},
+	"hosts":         {"name"},
+	"services":      {"host_name", "description"},
+	"hostgroups":    {"name"},
+	"servicegroups": {"name"},
+	"contacts":      {"name"},
+	"contactgroups": {"name"},
+	"commands":      {"name"},
+	"timeperiods":   {"name"},
+	"comments":      {"id"},
+	"downtimes":     {"id"},
+}
+
+// streamDependencies contains the tables whose delta updates affect the result of a subscribed table.
+// Streams for other tables are only updated after full updates.
+var streamDependencies = map[string][]string{
+	"status":        {"status"},
+	"hosts":         {"hosts", "services"},
+	"services":      {"hosts", "services"},
+	"hostgroups":    {"hosts", "services"},
+	"servicegroups": {"hosts", "services"},
+	"comments":      {"comments"},
+	"downtimes":     {"downtimes"},
+}
+
+// streamIncremental contains the tables whose streams only fetch the changed rows after delta updates.
+var streamIncremental = map[string]bool{
+	"hosts":     true,
+	"services":  true,
+	"comments":  true,
+	"downtimes": true,
+}
+
+// streamMaxChangedKeys sets the number of changed rows of a backend above which streams fetch the complete result.
+const streamMaxChangedKeys = 1000
+
+// streamSubscribers contains all connected event stream clients.
+var streamSubscribers = make(map[*streamSubscriber]bool)
+var streamSubscribersLock sync.Mutex
+
+// streamSubscriber is a single client of an event stream.
+type streamSubscriber struct {
+	requestData map[string]interface{}
+	table       string
+	columns     []string
+	keyIndexes  []int
+	peerIndex   int
+	client      string                    // client key for the query scheduler
+	restrict    func(*Request) error      // applies the listener settings and the authenticated user
+	backends    map[string]string         // subscribed backends, nil means all
+	rows        map[string]*streamRow     // rows sent to the client so far by key
+	pending     map[string]*streamChanges // changes by backend since the last update, guarded by streamSubscribersLock
+	notify      chan bool                 // buffered with size 1, so notifications are coalesced
+}
+
+// streamChanges contains the changed rows of a single backend.
+type streamChanges struct {
+	full bool                // the complete result has to be fetched
+	keys map[string][]string // changed rows by their joined key columns
+}
+
+// streamRow is a row as sent to the client.
+type streamRow struct {
+	peerKey string
+	keys    []string
+	key     map[string]interface{}
+	data    string
+}
+
+// streamEvent is a single server-sent event.
+type streamEvent struct {
+	name string
+	data string
+}
+
+// streamNotify wakes up all event streams subscribed to the given backend after a full update, so they fetch
+// their complete result again.
+// It never blocks, slow clients will pick up all changes with their next update.
+func streamNotify(peerKey string) {
+	streamSubscribersLock.Lock()
+	defer streamSubscribersLock.Unlock()
+	for s := range streamSubscribers {
+		if !s.subscribes(peerKey) {
+			continue
+		}
+		s.changes(peerKey).setFull()
+		s.wake()
+	}
+}
+
+// streamPublish wakes up all event streams affected by a delta update of the given table. The keys contain the
+// key columns of the changed rows, streams for incremental tables fetch only those rows. Nil keys mean the whole
+// table has changed.
+func streamPublish(peerKey string, table string, keys [][]string) {
+	if keys != nil && len(keys) == 0 {
+		return
+	}
+	streamSubscribersLock.Lock()
+	defer streamSubscribersLock.Unlock()
+	for s := range streamSubscribers {
+		if !s.subscribes(peerKey) || !s.dependsOn(table) {
+			continue
+		}
+		c := s.changes(peerKey)
+		if keys == nil || !streamIncremental[s.table] {
+			c.setFull()
+			s.wake()
+			continue
+		}
+		for _, key := range keys {
+			// hosts and services streams match changes of the other table by the host name
+			if table != s.table {
+				key = key[:1]
+			}
+			c.add(key)
+		}
+		s.wake()
+	}
+}
+
+// streamHasSubscribers returns true if there are any event stream clients.
+func streamHasSubscribers() bool {
+	streamSubscribersLock.Lock()
+	defer streamSubscribersLock.Unlock()
+	return len(streamSubscribers) > 0
+}
+
+// setFull marks the complete result as changed.
+func (c *streamChanges) setFull() {
+	c.full = true
+	c.keys = nil
+}
+
+// add marks the row with the given key columns as changed.
+func (c *streamChanges) add(key []string) {
+	if c.full {
+		return
+	}
+	if len(c.keys) >= streamMaxChangedKeys {
+		c.setFull()
+		return
+	}
+	c.keys[strings.Join(key, ";")] = key
+}
+
+// merge adds all changes from other.
+func (c *streamChanges) merge(other *streamChanges) {
+	if other.full {
+		c.setFull()
+		return
+	}
+	for _, key := range other.keys {
+		c.add(key)
+	}
+}
+
+// contains returns true if the row with the given key columns has changed.
+func (c *streamChanges) contains(key []string) bool {
+	if _, ok := c.keys[strings.Join(key, ";")]; ok {
+		return true
+	}
+	_, ok := c.keys[key[0]]
+	return ok
+}
+
+// restStream answers GET /v1/<table> requests with the text/event-stream format. The client gets a snapshot of
+// the current result followed by add, change and remove events whenever the backends have been updated.
+func (c *HTTPServerController) restStream(w http.ResponseWriter, request *http.Request, requestData map[string]interface{}) {
+	s, err := newStreamSubscriber(requestData, func(req *Request) error { return c.restrict(req, request) })
+	if err != nil {
+		code := http.StatusBadRequest
+		if strings.HasPrefix(err.Error(), "forbidden:") {
+			code = http.StatusForbidden
+		}
+		c.restError(w, code, err)
+		return
+	}
+	s.client = schedulerClient(request.RemoteAddr, requestUser(request))
+	// register before fetching the snapshot, so no update gets lost
+	streamSubscribersLock.Lock()
+	streamSubscribers[s] = true
+	streamSubscribersLock.Unlock()
+	defer func() {
+		streamSubscribersLock.Lock()
+		delete(streamSubscribers, s)
+		streamSubscribersLock.Unlock()
+	}()
+
+	// only the snapshot is limited, updates are triggered by the backends
+	release, err := c.acquireQuery(request)
+	if err != nil {
+		c.restError(w, schedulerErrorCode(err), err)
+		return
+	}
+	events, err := s.update(nil)
+	release()
+	if err != nil {
+		c.restError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// the stream outlives the write timeout of the http server, so take over the connection
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		c.restError(w, http.StatusInternalServerError, fmt.Errorf("event streams are not supported by this connection"))
+		return
+	}
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		c.restError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer conn.Close()
+	log.Debugf("event stream from %s for table %s started", request.RemoteAddr, requestData["table"])
+
+	// detect closed connections, clients do not send anything after the request
+	done := make(chan bool)
+	go func() {
+		conn.SetReadDeadline(time.Time{})
+		io.Copy(ioutil.Discard, bufrw)
+		close(done)
+	}()
+
+	timeout := c.streamWriteTimeout()
+	bufrw.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n")
+	err = writeStreamEvents(conn, bufrw, timeout, events)
+
+	keepAlive := time.NewTicker(StreamKeepAliveInterval * time.Second)
+	defer keepAlive.Stop()
+	for err == nil {
+		select {
+		case <-done:
+			log.Debugf("event stream from %s closed by client", request.RemoteAddr)
+			return
+		case <-keepAlive.C:
+			changes := s.takeChanges()
+			switch {
+			case nodeAccessor != nil && nodeAccessor.IsClustered():
+				// changes from other nodes are not published here
+				err = s.send(conn, bufrw, timeout, nil)
+			case len(changes) > 0:
+				// retry changes which have been postponed by the query scheduler
+				err = s.send(conn, bufrw, timeout, changes)
+			default:
+				err = writeStreamEvents(conn, bufrw, timeout, []streamEvent{})
+			}
+		case <-s.notify:
+			err = s.send(conn, bufrw, timeout, s.takeChanges())
+		}
+	}
+	// slow clients are disconnected once a write runs into the timeout
+	log.Debugf("event stream from %s closed: %s", request.RemoteAddr, err.Error())
+}
+
+// newStreamSubscriber returns a new subscriber for the given request data.
+// All requests are passed to restrict, which may be nil.
+func newStreamSubscriber(requestData map[string]interface{}, restrict func(*Request) error) (s *streamSubscriber, err error) {
+	tableName := requestData["table"].(string)
+	keyColumns, ok := streamKeyColumns[tableName]
+	if !ok {
+		return nil, fmt.Errorf("bad request: event streams are not supported for table %s", tableName)
+	}
+	for _, key := range []string{"stats", "limit", "offset"} {
+		if _, ok := requestData[key]; ok {
+			return nil, fmt.Errorf("bad request: %s cannot be used with event streams", key)
+		}
+	}
+	if _, ok := requestData["columns"]; !ok {
+		return nil, fmt.Errorf("bad request: event streams require columns")
+	}
+
+	// the key columns are always part of the result
+	columns := []string{}
+	for _, col := range requestData["columns"].([]interface{}) {
+		columns = append(columns, col.(string))
+	}
+	s = &streamSubscriber{
+		requestData: requestData,
+		table:       tableName,
+		restrict:    restrict,
+		pending:     make(map[string]*streamChanges),
+		notify:      make(chan bool, 1),
+	}
+	for _, key := range append([]string{"peer_key"}, keyColumns...) {
+		index := -1
+		for i, col := range columns {
+			if col == key {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			index = len(columns)
+			columns = append(columns, key)
+			requestData["columns"] = append(requestData["columns"].([]interface{}), key)
+		}
+		if key == "peer_key" {
+			s.peerIndex = index
+			continue
+		}
+		s.keyIndexes = append(s.keyIndexes, index)
+	}
+	s.columns = columns
+
+	req, err := s.request()
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Backends) > 0 {
+		s.backends = req.BackendsMap
+	}
+	return
+}
+
+// request returns a new request for the subscribed query.
+func (s *streamSubscriber) request() (req *Request, err error) {
+	req, err = parseRequestDataToRequest(s.requestData)
+	if err != nil {
+		return
+	}
+	req.SendStatsData = false
+	err = req.ExpandRequestedBackends()
+	if err == nil && s.restrict != nil {
+		err = s.restrict(req)
+	}
+	return
+}
+
+// subscribes returns true if the stream contains rows from the given backend.
+// The caller must hold the streamSubscribersLock.
+func (s *streamSubscriber) subscribes(peerKey string) bool {
+	if s.backends == nil {
+		return true
+	}
+	_, ok := s.backends[peerKey]
+	return ok
+}
+
+// dependsOn returns true if changes of the given table affect the stream.
+func (s *streamSubscriber) dependsOn(table string) bool {
+	for _, name := range streamDependencies[s.table] {
+		if name == table {
+			return true
+		}
+	}
+	return false
+}
+
+// changes returns the pending changes of the given backend. The caller must hold the streamSubscribersLock.
+func (s *streamSubscriber) changes(peerKey string) *streamChanges {
+	c, ok := s.pending[peerKey]
+	if !ok {
+		c = &streamChanges{keys: make(map[string][]string)}
+		s.pending[peerKey] = c
+	}
+	return c
+}
+
+// wake notifies the stream without blocking. The caller must hold the streamSubscribersLock.
+func (s *streamSubscriber) wake() {
+	select {
+	case s.notify <- true:
+	default:
+	}
+}
+
+// takeChanges returns and resets the pending changes.
+func (s *streamSubscriber) takeChanges() (changes map[string]*streamChanges) {
+	streamSubscribersLock.Lock()
+	defer streamSubscribersLock.Unlock()
+	changes = s.pending
+	s.pending = make(map[string]*streamChanges)
+	return
+}
+
+// restoreChanges adds changes back which could not be sent yet.
+func (s *streamSubscriber) restoreChanges(changes map[string]*streamChanges) {
+	streamSubscribersLock.Lock()
+	defer streamSubscribersLock.Unlock()
+	for peerKey, c := range changes {
+		s.changes(peerKey).merge(c)
+	}
+}
+
+// restrictToChanges limits the request to the changed rows. It returns false if the complete result has
+// to be fetched instead.
+func (s *streamSubscriber) restrictToChanges(req *Request, changes map[string]*streamChanges) (ok bool, err error) {
+	if !streamIncremental[s.table] {
+		return false, nil
+	}
+	backends := []string{}
+	stack := []*Filter{}
+	for peerKey, c := range changes {
+		if c.full {
+			return false, nil
+		}
+		if _, ok := req.BackendsMap[peerKey]; !ok || len(c.keys) == 0 {
+			continue
+		}
+		backends = append(backends, peerKey)
+		for _, key := range c.keys {
+			if err = streamKeyFilter(s.table, key, &stack); err != nil {
+				return false, err
+			}
+		}
+	}
+	sort.Strings(backends)
+	req.Backends = backends
+	req.BackendsMap = make(map[string]string)
+	for _, peerKey := range backends {
+		req.BackendsMap[peerKey] = peerKey
+	}
+	if len(stack) > 1 {
+		line := fmt.Sprintf("Or: %d", len(stack))
+		if err = ParseFilterOp("or", strconv.Itoa(len(stack)), &line, &stack); err != nil {
+			return false, err
+		}
+	}
+	req.Filter = append(req.Filter, stack...)
+	return true, nil
+}
+
+// streamKeyFilter adds a filter for the row with the given key columns to the stack. Keys with a single
+// column of the hosts and services tables refer to the host name.
+func streamKeyFilter(table string, key []string, stack *[]*Filter) error {
+	columns := streamKeyColumns[table]
+	if table == "services" {
+		columns = []string{"host_name", "description"}[:len(key)]
+	}
+	for i, column := range columns {
+		value := column + " = " + key[i]
+		line := "Filter: " + value
+		if err := ParseFilter(value, &line, table, stack); err != nil {
+			return err
+		}
+	}
+	if len(columns) > 1 {
+		line := fmt.Sprintf("And: %d", len(columns))
+		return ParseFilterOp("and", strconv.Itoa(len(columns)), &line, stack)
+	}
+	return nil
+}
+
+// update fetches the result and returns the events for all changes since the previous update. Only the changed
+// rows are fetched for incremental tables, nil changes fetch the complete result.
+// The first update returns a single snapshot event.
+func (s *streamSubscriber) update(changes map[string]*streamChanges) (events []streamEvent, err error) {
+	req, err := s.request()
+	if err != nil {
+		return
+	}
+	partial := false
+	if s.rows != nil && changes != nil {
+		partial, err = s.restrictToChanges(req, changes)
+		if err != nil {
+			return
+		}
+		if partial && len(req.BackendsMap) == 0 {
+			return
+		}
+	}
+	res, err := req.GetResponse()
+	if err != nil {
+		return
+	}
+
+	snapshot := s.rows == nil
+	objects := []map[string]interface{}{}
+	rows := make(map[string]*streamRow, len(res.Result))
+	for _, resRow := range res.Result {
+		obj := restRowObject(s.columns, resRow)
+		encoded, jErr := json.Marshal(obj)
+		if jErr != nil {
+			return nil, jErr
+		}
+		row := &streamRow{
+			peerKey: fmt.Sprintf("%v", resRow[s.peerIndex]),
+			key:     map[string]interface{}{"peer_key": resRow[s.peerIndex]},
+			data:    string(encoded),
+		}
+		for _, i := range s.keyIndexes {
+			row.key[s.columns[i]] = resRow[i]
+			row.keys = append(row.keys, fmt.Sprintf("%v", resRow[i]))
+		}
+		key := row.peerKey + ";" + strings.Join(row.keys, ";")
+		rows[key] = row
+		if snapshot {
+			objects = append(objects, obj)
+			continue
+		}
+		previous, ok := s.rows[key]
+		switch {
+		case !ok:
+			events = append(events, streamEvent{name: "add", data: row.data})
+		case previous.data != row.data:
+			events = append(events, streamEvent{name: "change", data: row.data})
+		}
+	}
+
+	if snapshot {
+		encoded, jErr := json.Marshal(map[string]interface{}{"data": objects, "total": len(objects), "failed": res.Failed})
+		if jErr != nil {
+			return nil, jErr
+		}
+		events = append(events, streamEvent{name: "snapshot", data: string(encoded)})
+	}
+
+	removed := []string{}
+	for key, previous := range s.rows {
+		if _, ok := rows[key]; ok {
+			continue
+		}
+		// keep rows which have not been fetched again
+		if partial {
+			if c, ok := changes[previous.peerKey]; !ok || !c.contains(previous.keys) {
+				rows[key] = previous
+				continue
+			}
+		}
+		// keep rows from failed backends until they are back
+		if _, ok := res.Failed[previous.peerKey]; ok {
+			rows[key] = previous
+			continue
+		}
+		removed = append(removed, key)
+	}
+	sort.Strings(removed)
+	for _, key := range removed {
+		encoded, jErr := json.Marshal(s.rows[key].key)
+		if jErr != nil {
+			return nil, jErr
+		}
+		events = append(events, streamEvent{name: "remove", data: string(encoded)})
+	}
+
+	s.rows = rows
+	return
+}
+
+// send updates the result and writes all changes to the client. Errors from the query are sent as error events.
+// Updates count against the query limits of the client, postponed changes are retried with the next keepalive.
+func (s *streamSubscriber) send(conn net.Conn, bufrw *bufio.ReadWriter, timeout time.Duration, changes map[string]*streamChanges) error {
+	release, err := currentQueryScheduler().Acquire(s.client)
+	if err != nil {
+		log.Debugf("event stream update for %s postponed: %s", s.client, err.Error())
+		if changes != nil {
+			s.restoreChanges(changes)
+		}
+		return nil
+	}
+	events, err := s.update(changes)
+	release()
+	if err != nil {
+		encoded, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
+		events = []streamEvent{{name: "error", data: string(encoded)}}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	return writeStreamEvents(conn, bufrw, timeout, events)
+}
+
+// writeStreamEvents writes the events to the client, an empty list sends a keepalive comment.
+// The write fails if the client does not accept the data within the timeout.
+func writeStreamEvents(conn net.Conn, bufrw *bufio.ReadWriter, timeout time.Duration, events []streamEvent) error {
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if len(events) == 0 {
+		bufrw.WriteString(": keepalive\n\n")
+	}
+	for _, e := range events {
+		fmt.Fprintf(bufrw, "event: %s\ndata: %s\n\n", e.name, e.data)
+	}
+	return bufrw.Flush()
+}
+
+// streamWriteTimeout returns the time a stream client has to accept new events.
+func (c *HTTPServerController) streamWriteTimeout() time.Duration {
+	if c.listener == nil || c.listener.LocalConfig.ListenTimeout <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(c.listener.LocalConfig.ListenTimeout) * time.Second
+}
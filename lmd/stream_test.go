@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type streamTestEvent struct {
+	name string
+	data map[string]interface{}
+}
+
+// streamTestEvents parses the server-sent events of the response into a channel.
+func streamTestEvents(res *http.Response) chan *streamTestEvent {
+	events := make(chan *streamTestEvent, 100)
+	go func() {
+		defer close(events)
+		reader := bufio.NewReader(res.Body)
+		event := &streamTestEvent{}
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.data)
+			case line == "" && event.name != "":
+				events <- event
+				event = &streamTestEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func streamTestNextEvent(t *testing.T, events chan *streamTestEvent) *streamTestEvent {
+	select {
+	case event := <-events:
+		if event == nil {
+			t.Fatalf("stream closed")
+		}
+		return event
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout while waiting for stream event")
+	}
+	return nil
+}
+
+// streamTestSetHostState changes the cached host state of all backends.
+func streamTestSetHostState(name string, state float64) {
+	PeerMapLock.RLock()
+	defer PeerMapLock.RUnlock()
+	for _, p := range PeerMap {
+		p.DataLock.Lock()
+		p.Tables["hosts"].Index[name][Objects.Tables["hosts"].GetColumn("state").Index] = state
+		p.DataLock.Unlock()
+		streamNotify(p.ID)
+	}
+}
+
+func TestRestStream(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+	handler, _ := initializeHTTPRouter(nil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/v1/hosts?columns=state&filter=state=0", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if err = assertEq("text/event-stream", res.Header.Get("Content-Type")); err != nil {
+		t.Error(err)
+	}
+	events := streamTestEvents(res)
+
+	// initial snapshot contains the key columns as well
+	event := streamTestNextEvent(t, events)
+	if err = assertEq("snapshot", event.name); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10.0, event.data["total"]); err != nil {
+		t.Error(err)
+	}
+	first := event.data["data"].([]interface{})[0].(map[string]interface{})
+	if err = assertEq("mockid0", first["peer_key"]); err != nil {
+		t.Error(err)
+	}
+	if _, ok := first["name"]; !ok {
+		t.Errorf("key column name missing in snapshot")
+	}
+
+	// host does not match the filter anymore
+	streamTestSetHostState("testhost_1", 1)
+	event = streamTestNextEvent(t, events)
+	if err = assertEq("remove", event.name); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(map[string]interface{}{"peer_key": "mockid0", "name": "testhost_1"}, event.data); err != nil {
+		t.Error(err)
+	}
+
+	// host matches again
+	streamTestSetHostState("testhost_1", 0)
+	event = streamTestNextEvent(t, events)
+	if err = assertEq("add", event.name); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("testhost_1", event.data["name"]); err != nil {
+		t.Error(err)
+	}
+
+	// unchanged updates do not send anything
+	streamNotify(peer.ID)
+	req, _ = http.NewRequest("GET", server.URL+"/v1/hosts?columns=name,state&filter=name=testhost_2&format=sse", nil)
+	res2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res2.Body.Close()
+	events2 := streamTestEvents(res2)
+	streamTestNextEvent(t, events2)
+
+	// changed rows which still match are sent as change event
+	streamTestSetHostState("testhost_2", 2)
+	event = streamTestNextEvent(t, events2)
+	if err = assertEq("change", event.name); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("testhost_2", event.data["name"]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(2.0, event.data["state"]); err != nil {
+		t.Error(err)
+	}
+	event = streamTestNextEvent(t, events)
+	if err = assertEq("remove", event.name); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("testhost_2", event.data["name"]); err != nil {
+		t.Error(err)
+	}
+
+	// errors
+	for _, path := range []string{
+		"/v1/hosts?format=sse",
+		"/v1/hosts?columns=name&stats=state%3D0&format=sse",
+		"/v1/log?columns=message&format=sse",
+	} {
+		rec := restTestRequest(handler, path, "")
+		if err = assertEq(http.StatusBadRequest, rec.Code); err != nil {
+			t.Errorf("%s: %s", path, err.Error())
+		}
+	}
+
+	if err = StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRestStreamPublish(t *testing.T) {
+	peer := StartTestPeer(1, 10, 20)
+	PauseTestPeers(peer)
+	handler, _ := initializeHTTPRouter(nil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/v1/hosts?columns=state&format=sse", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	events := streamTestEvents(res)
+	streamTestNextEvent(t, events)
+
+	// delta updates fetch only the published rows
+	PeerMapLock.RLock()
+	backend := PeerMap["mockid0"]
+	PeerMapLock.RUnlock()
+	setState := func(name string, state float64) {
+		backend.DataLock.Lock()
+		backend.Tables["hosts"].Index[name][Objects.Tables["hosts"].GetColumn("state").Index] = state
+		backend.DataLock.Unlock()
+	}
+	setState("testhost_3", 1)
+	setState("testhost_2", 1)
+	streamPublish(backend.ID, "hosts", [][]string{{"testhost_2"}})
+	event := streamTestNextEvent(t, events)
+	if err = assertEq("change", event.name); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("testhost_2", event.data["name"]); err != nil {
+		t.Error(err)
+	}
+
+	// changed services refer to their host, full updates fetch everything
+	setState("testhost_2", 2)
+	streamPublish(backend.ID, "services", [][]string{{"testhost_2", "testsvc_1"}})
+	event = streamTestNextEvent(t, events)
+	if err = assertEq("testhost_2", event.data["name"]); err != nil {
+		t.Error(err)
+	}
+	streamNotify(backend.ID)
+	event = streamTestNextEvent(t, events)
+	if err = assertEq("change", event.name); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("testhost_3", event.data["name"]); err != nil {
+		t.Error(err)
+	}
+
+	// updates are postponed by the query scheduler
+	s := &streamSubscriber{table: "hosts", pending: make(map[string]*streamChanges)}
+	s.restoreChanges(map[string]*streamChanges{backend.ID: {keys: map[string][]string{"testhost_1": {"testhost_1"}}}})
+	changes := s.takeChanges()
+	if err = assertEq(true, changes[backend.ID].contains([]string{"testhost_1"})); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(0, len(s.takeChanges())); err != nil {
+		t.Error(err)
+	}
+
+	if err = StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// webhooks contains the configured webhook rules, nil unless Webhooks are configured.
+// It is replaced on reload, use currentWebhooks to access it.
+var webhooks *WebhookManager
+var webhooksLock sync.RWMutex
+
+// webhookRetryInterval sets the delay before the first retry, it doubles with every further attempt.
+var webhookRetryInterval = 1 * time.Second
+
+// webhookQueueSize is the number of notifications waiting for delivery per rule before new ones are dropped.
+const webhookQueueSize = 1000
+
+// reWebhookHeader matches filter lines which start with a livestatus header like Filter: or Or:.
+var reWebhookHeader = regexp.MustCompile(`^[A-Za-z]+:`)
+
+// webhookDefaultColumns are sent if a rule has no Columns.
+var webhookDefaultColumns = map[string][]string{
+	"hosts":    {"name", "state", "state_type", "plugin_output", "last_state_change"},
+	"services": {"host_name", "description", "state", "state_type", "plugin_output", "last_state_change"},
+}
+
+// Webhook defines a rule which posts state changes of matching hosts or services to an url.
+type Webhook struct {
+	Name          string
+	Table         string
+	Filter        []string
+	Columns       []string
+	URL           string
+	Payload       string
+	Headers       []string
+	Timeout       int
+	MaxRetries    int
+	DedupInterval int64
+	RateLimit     int
+}
+
+// StateChange is a changed state or state type of a host or service found during the delta update.
+type StateChange struct {
+	Key               string // host name or host name;service description
+	PreviousState     interface{}
+	PreviousStateType interface{}
+}
+
+// WebhookManager evaluates the webhook rules and delivers notifications in the background.
+type WebhookManager struct {
+	noCopy      noCopy
+	rules       []*webhookRule
+	stopChannel chan bool
+}
+
+// webhookRule is a parsed webhook with its delivery queue, deduplication and rate limit state.
+type webhookRule struct {
+	Webhook
+	columns    []string
+	filter     string
+	request    *Request       // parsed query of the rule
+	indexes    []int          // data indexes of the request columns
+	resColumns []ResultColumn // result columns of the request
+	template   *template.Template
+	headers    http.Header
+	client     *http.Client
+	queue      chan []byte
+	lock       sync.Mutex
+	sent       map[string]time.Time
+	tokens     float64
+	lastRefill time.Time
+}
+
+// NewWebhookManager creates the webhook rules from the configuration. Invalid rules are logged and skipped.
+func NewWebhookManager(conf []Webhook) *WebhookManager {
+	m := &WebhookManager{}
+	for i := range conf {
+		rule, err := newWebhookRule(conf[i])
+		if err != nil {
+			log.Errorf("webhook %s disabled: %s", conf[i].Name, err.Error())
+			continue
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return m
+}
+
+// initWebhooks stops the current webhooks and starts new ones from the configuration.
+func initWebhooks(conf *Config) {
+	var m *WebhookManager
+	if len(conf.Webhooks) > 0 {
+		m = NewWebhookManager(conf.Webhooks)
+		m.Start()
+	}
+	webhooksLock.Lock()
+	previous := webhooks
+	webhooks = m
+	webhooksLock.Unlock()
+	previous.Stop()
+}
+
+// currentWebhooks returns the webhook manager, which may be nil.
+func currentWebhooks() *WebhookManager {
+	webhooksLock.RLock()
+	defer webhooksLock.RUnlock()
+	return webhooks
+}
+
+// newWebhookRule validates the webhook and returns the parsed rule.
+func newWebhookRule(w Webhook) (rule *webhookRule, err error) {
+	if w.Name == "" {
+		w.Name = w.URL
+	}
+	if _, ok := webhookDefaultColumns[w.Table]; !ok {
+		return nil, fmt.Errorf("table must be hosts or services")
+	}
+	if w.URL == "" {
+		return nil, fmt.Errorf("no url set")
+	}
+	if w.Timeout <= 0 {
+		w.Timeout = 10
+	}
+	if w.MaxRetries < 0 {
+		w.MaxRetries = 0
+	}
+	if w.DedupInterval <= 0 {
+		w.DedupInterval = 300
+	}
+	if w.RateLimit <= 0 {
+		w.RateLimit = 60
+	}
+	rule = &webhookRule{
+		Webhook:    w,
+		columns:    w.Columns,
+		headers:    make(http.Header),
+		client:     &http.Client{Timeout: time.Duration(w.Timeout) * time.Second},
+		queue:      make(chan []byte, webhookQueueSize),
+		sent:       make(map[string]time.Time),
+		tokens:     float64(w.RateLimit),
+		lastRefill: time.Now(),
+	}
+	if len(rule.columns) == 0 {
+		rule.columns = webhookDefaultColumns[w.Table]
+	}
+	for _, line := range w.Filter {
+		line = strings.TrimSpace(line)
+		if !reWebhookHeader.MatchString(line) {
+			line = "Filter: " + line
+		}
+		rule.filter += line + "\n"
+	}
+	// parse the query once to catch errors in filters and columns
+	if rule.request, _, err = NewRequest(bufio.NewReader(bytes.NewBufferString(rule.query()))); err != nil {
+		return nil, err
+	}
+	if rule.indexes, rule.resColumns, err = rule.request.BuildResponseIndexes(Objects.Tables[w.Table]); err != nil {
+		return nil, err
+	}
+	if w.Payload != "" {
+		rule.template, err = template.New(w.Name).Funcs(template.FuncMap{"json": webhookJSON}).Parse(w.Payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rule.headers.Set("Content-Type", "application/json")
+	for _, header := range w.Headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid header %s, must be <name>: <value>", header)
+		}
+		rule.headers.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return
+}
+
+// Start starts delivering notifications in the background.
+func (m *WebhookManager) Start() {
+	stopChannel := make(chan bool)
+	m.stopChannel = stopChannel
+	for _, rule := range m.rules {
+		go func(rule *webhookRule) {
+			defer logPanicExit()
+			for {
+				select {
+				case <-stopChannel:
+					return
+				case payload := <-rule.queue:
+					rule.deliver(payload, stopChannel)
+				}
+			}
+		}(rule)
+	}
+}
+
+// Stop stops delivering notifications. It is safe to call on a nil manager.
+func (m *WebhookManager) Stop() {
+	if m == nil || m.stopChannel == nil {
+		return
+	}
+	close(m.stopChannel)
+	m.stopChannel = nil
+}
+
+// HasRules returns true if there are rules for the given table. It is safe to call on a nil manager.
+func (m *WebhookManager) HasRules(table string) bool {
+	if m == nil {
+		return false
+	}
+	for _, rule := range m.rules {
+		if rule.Table == table {
+			return true
+		}
+	}
+	return false
+}
+
+// Check evaluates all rules of the table against the changed objects of the peer and
+// queues notifications for all matching objects.
+func (m *WebhookManager) Check(p *Peer, table string, changes []StateChange) {
+	if m == nil || len(changes) == 0 {
+		return
+	}
+	changesByKey := make(map[string]*StateChange, len(changes))
+	for i := range changes {
+		changesByKey[changes[i].Key] = &changes[i]
+	}
+	for _, rule := range m.rules {
+		if rule.Table != table {
+			continue
+		}
+		rows, err := rule.matchingRows(p, changes)
+		if err != nil {
+			log.Warnf("[%s] webhook %s failed: %s", p.Name, rule.Name, err.Error())
+			continue
+		}
+		for _, row := range rows {
+			key := fmt.Sprintf("%v", row["host_name"])
+			if table == "hosts" {
+				key = fmt.Sprintf("%v", row["name"])
+			} else {
+				key += fmt.Sprintf(";%v", row["description"])
+			}
+			change, ok := changesByKey[key]
+			if !ok {
+				continue
+			}
+			row["rule"] = rule.Name
+			row["peer_key"] = p.ID
+			row["peer_name"] = p.Name
+			row["previous_state"] = change.PreviousState
+			row["previous_state_type"] = change.PreviousStateType
+			rule.notify(fmt.Sprintf("%s;%s;%v;%v", p.ID, key, row["state"], row["state_type"]), row)
+		}
+	}
+}
+
+// webhookKey returns the key of a cached host or service row as used in StateChange.
+func webhookKey(table *Table, row []interface{}) string {
+	if table.Name == "hosts" {
+		return fmt.Sprintf("%v", row[table.ColumnsIndex["name"]])
+	}
+	return fmt.Sprintf("%v;%v", row[table.ColumnsIndex["host_name"]], row[table.ColumnsIndex["description"]])
+}
+
+// query returns the livestatus query for the rule.
+func (rule *webhookRule) query() string {
+	columns := append([]string{}, rule.columns...)
+	if rule.Table == "hosts" {
+		columns = append(columns, "name", "state", "state_type")
+	} else {
+		columns = append(columns, "host_name", "description", "state", "state_type")
+	}
+	return fmt.Sprintf("GET %s\nColumns: %s\n%s", rule.Table, strings.Join(columns, " "), rule.filter)
+}
+
+// matchingRows returns all changed objects of the peer which match the filter of the rule.
+// The changed rows are looked up in the cache index, so only those rows are matched.
+func (rule *webhookRule) matchingRows(p *Peer, changes []StateChange) (rows []map[string]interface{}, err error) {
+	p.DataLock.RLock()
+	defer p.DataLock.RUnlock()
+	data := p.Tables[rule.Table]
+	if data.Table == nil {
+		return nil, fmt.Errorf("table %s is not available", rule.Table)
+	}
+	table := data.Table
+Changes:
+	for _, change := range changes {
+		row, ok := data.Index[change.Key]
+		if !ok {
+			continue
+		}
+		refs := p.rowRefs(table, row)
+		for _, f := range rule.request.Filter {
+			if !p.MatchRowFilter(table, &refs, f, &row, 0) {
+				continue Changes
+			}
+		}
+		resRow := make([]interface{}, len(rule.indexes))
+		for k, i := range rule.indexes {
+			col := &(rule.resColumns[k])
+			if i < 0 || i >= len(row) {
+				resRow[k] = p.GetRowValue(col, &row, 0, table, &refs)
+			} else {
+				resRow[k] = row[i]
+			}
+			if resRow[k] == nil {
+				resRow[k] = col.Column.GetEmptyValue()
+			}
+			if col.Column.Type == CustomVarCol {
+				resRow[k] = interfaceToCustomVarHash(&resRow[k])
+			}
+		}
+		rows = append(rows, restRowObject(rule.request.Columns, resRow))
+	}
+	return
+}
+
+// notify queues a notification unless it has been sent within the DedupInterval or the RateLimit is exceeded.
+func (rule *webhookRule) notify(dedupKey string, row map[string]interface{}) {
+	now := time.Now()
+	rule.lock.Lock()
+	for key, last := range rule.sent {
+		if now.Sub(last) >= time.Duration(rule.DedupInterval)*time.Second {
+			delete(rule.sent, key)
+		}
+	}
+	if _, ok := rule.sent[dedupKey]; ok {
+		rule.lock.Unlock()
+		log.Debugf("webhook %s: skipping duplicate notification for %s", rule.Name, dedupKey)
+		promWebhookNotifications.WithLabelValues(rule.Name, "deduplicated").Inc()
+		return
+	}
+	// token bucket which refills RateLimit tokens per minute
+	rule.tokens += now.Sub(rule.lastRefill).Minutes() * float64(rule.RateLimit)
+	if rule.tokens > float64(rule.RateLimit) {
+		rule.tokens = float64(rule.RateLimit)
+	}
+	rule.lastRefill = now
+	if rule.tokens < 1 {
+		rule.lock.Unlock()
+		log.Warnf("webhook %s: rate limit of %d per minute exceeded, dropping notification for %s", rule.Name, rule.RateLimit, dedupKey)
+		promWebhookNotifications.WithLabelValues(rule.Name, "ratelimited").Inc()
+		return
+	}
+	rule.tokens--
+	rule.sent[dedupKey] = now
+	rule.lock.Unlock()
+
+	payload, err := rule.payload(row)
+	if err != nil {
+		log.Warnf("webhook %s: cannot build payload: %s", rule.Name, err.Error())
+		promWebhookNotifications.WithLabelValues(rule.Name, "failed").Inc()
+		return
+	}
+	select {
+	case rule.queue <- payload:
+	default:
+		log.Warnf("webhook %s: queue is full, dropping notification for %s", rule.Name, dedupKey)
+		promWebhookNotifications.WithLabelValues(rule.Name, "dropped").Inc()
+	}
+}
+
+// payload returns the rendered Payload template or the json encoded row if there is no template.
+func (rule *webhookRule) payload(row map[string]interface{}) ([]byte, error) {
+	if rule.template == nil {
+		return json.Marshal(row)
+	}
+	buf := new(bytes.Buffer)
+	if err := rule.template.Execute(buf, row); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// deliver posts the payload and retries MaxRetries times with increasing delay.
+func (rule *webhookRule) deliver(payload []byte, stopChannel chan bool) {
+	delay := webhookRetryInterval
+	for attempt := 0; ; attempt++ {
+		err := rule.post(payload)
+		if err == nil {
+			promWebhookNotifications.WithLabelValues(rule.Name, "sent").Inc()
+			return
+		}
+		if attempt >= rule.MaxRetries {
+			log.Warnf("webhook %s: giving up after %d attempts: %s", rule.Name, attempt+1, err.Error())
+			promWebhookNotifications.WithLabelValues(rule.Name, "failed").Inc()
+			return
+		}
+		log.Debugf("webhook %s: post failed, retrying in %s: %s", rule.Name, delay, err.Error())
+		select {
+		case <-stopChannel:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// post sends the payload to the url of the rule.
+func (rule *webhookRule) post(payload []byte) error {
+	req, err := http.NewRequest("POST", rule.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	for name, values := range rule.headers {
+		req.Header[name] = values
+	}
+	res, err := rule.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", rule.URL, res.Status)
+	}
+	return nil
+}
+
+// webhookJSON is the json function of payload templates.
+func webhookJSON(value interface{}) (string, error) {
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookTestReceiver records all posted payloads and fails the first failures requests.
+type webhookTestReceiver struct {
+	lock     sync.Mutex
+	failures int
+	requests int
+	payloads []string
+}
+
+func (r *webhookTestReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests++
+	if r.requests <= r.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	r.payloads = append(r.payloads, string(body))
+}
+
+func (r *webhookTestReceiver) waitFor(t *testing.T, num int) []string {
+	for i := 0; i < 200; i++ {
+		r.lock.Lock()
+		payloads := r.payloads
+		r.lock.Unlock()
+		if len(payloads) >= num {
+			return payloads
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("timeout while waiting for %d webhook payloads", num)
+	return nil
+}
+
+// webhookTestChange changes the cached host state and returns the state change for the webhook check.
+func webhookTestChange(p *Peer, name string, state float64) []StateChange {
+	index := Objects.Tables["hosts"].GetColumn("state").Index
+	p.DataLock.Lock()
+	row := p.Tables["hosts"].Index[name]
+	previous := row[index]
+	row[index] = state
+	p.DataLock.Unlock()
+	return []StateChange{{Key: name, PreviousState: previous, PreviousStateType: 1.0}}
+}
+
+func TestWebhooks(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	receiver := &webhookTestReceiver{failures: 1}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	defer func(interval time.Duration) { webhookRetryInterval = interval }(webhookRetryInterval)
+	webhookRetryInterval = 10 * time.Millisecond
+
+	m := NewWebhookManager([]Webhook{
+		{
+			Name:       "down",
+			Table:      "hosts",
+			Filter:     []string{"state = 1", "Filter: name ~ testhost"},
+			URL:        server.URL,
+			Payload:    `{"text": {{json .name}}, "state": {{.state}}, "previous": {{.previous_state}}}`,
+			MaxRetries: 2,
+			RateLimit:  2,
+		},
+		{Name: "invalid filter", Table: "hosts", Filter: []string{"state"}, URL: server.URL},
+		{Name: "invalid table", Table: "log", URL: server.URL},
+	})
+	if err := assertEq(1, len(m.rules)); err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasRules("hosts") || m.HasRules("services") {
+		t.Errorf("expected rules for hosts only")
+	}
+	m.Start()
+	defer m.Stop()
+
+	PeerMapLock.RLock()
+	p := PeerMap[PeerMapOrder[0]]
+	PeerMapLock.RUnlock()
+
+	// first post fails and will be retried
+	m.Check(p, "hosts", webhookTestChange(p, "testhost_1", 1))
+	payloads := receiver.waitFor(t, 1)
+	if err := assertEq(`{"text": "testhost_1", "state": 1, "previous": 0}`, payloads[0]); err != nil {
+		t.Error(err)
+	}
+
+	// same transition again is deduplicated, a not matching state is ignored
+	m.Check(p, "hosts", webhookTestChange(p, "testhost_1", 1))
+	m.Check(p, "hosts", webhookTestChange(p, "testhost_2", 2))
+
+	// rate limit allows only 2 notifications
+	m.Check(p, "hosts", append(webhookTestChange(p, "testhost_3", 1), webhookTestChange(p, "testhost_4", 1)...))
+	payloads = receiver.waitFor(t, 2)
+	time.Sleep(100 * time.Millisecond)
+	receiver.lock.Lock()
+	if err := assertEq(2, len(receiver.payloads)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(3, receiver.requests); err != nil {
+		t.Error(err)
+	}
+	receiver.lock.Unlock()
+	if err := assertEq(`{"text": "testhost_3", "state": 1, "previous": 0}`, payloads[1]); err != nil {
+		t.Error(err)
+	}
+
+	// default payload contains all columns
+	rule, err := newWebhookRule(Webhook{Table: "services", URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := rule.payload(map[string]interface{}{"host_name": "testhost_1", "state": 2})
+	row := make(map[string]interface{})
+	if err = json.Unmarshal(payload, &row); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("testhost_1", row["host_name"]); err != nil {
+		t.Error(err)
+	}
+
+	// reloads replace the webhooks
+	initWebhooks(&Config{Webhooks: []Webhook{{Table: "hosts", URL: server.URL}}})
+	if !currentWebhooks().HasRules("hosts") {
+		t.Errorf("expected rules for hosts after reload")
+	}
+	initWebhooks(&Config{})
+	if err = assertEq((*WebhookManager)(nil), currentWebhooks()); err != nil {
+		t.Error(err)
+	}
+
+	// full updates report changes with the same keys as delta updates
+	services := Objects.Tables["services"]
+	serviceRow := make([]interface{}, services.MaxIndex)
+	serviceRow[services.ColumnsIndex["host_name"]] = "testhost_1"
+	serviceRow[services.ColumnsIndex["description"]] = "testsvc_1"
+	if err = assertEq("testhost_1;testsvc_1", webhookKey(services, serviceRow)); err != nil {
+		t.Error(err)
+	}
+
+	if err = StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestWebhooksDeltaUpdate(t *testing.T) {
+	peer := StartTestPeer(1, 10, 20)
+	PauseTestPeers(peer)
+
+	receiver := &webhookTestReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	initWebhooks(&Config{Webhooks: []Webhook{
+		{Name: "host", Table: "hosts", Filter: []string{"name = testhost_1"}, URL: server.URL, Payload: `{{json .name}} {{.previous_state}}`},
+		{Name: "service", Table: "services", Filter: []string{"host_alias = tomcat"}, Columns: []string{"host_alias"}, URL: server.URL, Payload: `{{json .host_alias}} {{.previous_state}}`},
+	}})
+	defer initWebhooks(&Config{})
+
+	PeerMapLock.RLock()
+	p := PeerMap[PeerMapOrder[0]]
+	PeerMapLock.RUnlock()
+
+	// changed hosts from the delta update are matched against the rule filter
+	webhookTestChange(p, "testhost_1", 3)
+	webhookTestChange(p, "testhost_2", 3)
+	if err := p.UpdateDeltaTableHosts("Filter: name = testhost_1\nFilter: name = testhost_2\nOr: 2\n"); err != nil {
+		t.Fatal(err)
+	}
+	payloads := receiver.waitFor(t, 1)
+	if err := assertEq(`"testhost_1" 3`, payloads[0]); err != nil {
+		t.Error(err)
+	}
+
+	// services are matched with columns of their host
+	index := Objects.Tables["services"].GetColumn("state").Index
+	p.DataLock.Lock()
+	for key, row := range p.Tables["services"].Index {
+		if strings.HasPrefix(key, "testhost_1;") {
+			row[index] = 3.0
+			break
+		}
+	}
+	p.DataLock.Unlock()
+	if err := p.UpdateDeltaTableServices("Filter: host_name = testhost_1\n"); err != nil {
+		t.Fatal(err)
+	}
+	payloads = receiver.waitFor(t, 2)
+	if err := assertEq(`"tomcat" 3`, payloads[1]); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	receiver.lock.Lock()
+	if err := assertEq(2, len(receiver.payloads)); err != nil {
+		t.Error(err)
+	}
+	receiver.lock.Unlock()
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}